@@ -0,0 +1,41 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// requireServiceToken is middleware that only lets through other services, which send
+// SERVICE_TOKEN as a bearer token. Without SERVICE_TOKEN the routes it guards are off.
+func (app *App) requireServiceToken(next http.Handler) http.Handler {
+	return app.requireBearer("service", "SERVICE_TOKEN", app.ServiceToken, next)
+}
+
+// requireMetrics is middleware for /metrics: Prometheus scrapes with METRICS_TOKEN as a
+// bearer token, as it does on the broker. Without METRICS_TOKEN /metrics is off.
+func (app *App) requireMetrics(next http.Handler) http.Handler {
+	return app.requireBearer("metrics", "METRICS_TOKEN", app.MetricsToken, next)
+}
+
+// requireBearer only lets through requests whose bearer token is token, which is read
+// from the environment variable env. With an empty token the routes it guards are off.
+// realm names the token in errors and in WWW-Authenticate.
+func (app *App) requireBearer(realm, env, token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			app.ErrorJSON(w, fmt.Errorf("%s endpoints are disabled; set %s", realm, env), http.StatusForbidden)
+			return
+		}
+
+		raw, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(strings.TrimSpace(raw)), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf("Bearer realm=%q", realm))
+			app.ErrorJSON(w, fmt.Errorf("%s token required", realm), http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
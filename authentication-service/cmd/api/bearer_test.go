@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireMetrics(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		name   string
+		token  string
+		header string
+		want   int
+	}{
+		{name: "no token configured", header: "Bearer anything", want: http.StatusForbidden},
+		{name: "no header", token: "scrape", want: http.StatusUnauthorized},
+		{name: "wrong token", token: "scrape", header: "Bearer scrap", want: http.StatusUnauthorized},
+		{name: "service token isn't enough", token: "scrape", header: "Bearer service", want: http.StatusUnauthorized},
+		{name: "metrics token", token: "scrape", header: "Bearer scrape", want: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &App{MetricsToken: tt.token, ServiceToken: "service"}
+
+			r := httptest.NewRequest("GET", "/metrics", nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			app.requireMetrics(ok).ServeHTTP(w, r)
+
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+			if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") != `Bearer realm="metrics"` {
+				t.Errorf("WWW-Authenticate = %q", w.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
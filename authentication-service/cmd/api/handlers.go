@@ -1,11 +1,15 @@
 package main
 
 import (
+	"auth/data"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
 
 func (app *App) Authenticate(w http.ResponseWriter, r *http.Request) {
@@ -34,9 +38,35 @@ func (app *App) Authenticate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	//accounts that haven't been verified yet, or were deactivated, can't log in
+	if user.Active != 1 {
+		app.ErrorJSON(w, errors.New("account is not active"), http.StatusForbidden)
+		return
+	}
+
+	//include what the user may do, so callers can authorize without asking again
+	roles, err := user.Roles()
+	if err != nil {
+		app.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	permissions, err := user.Permissions()
+	if err != nil {
+		app.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	//tokens issued for this login carry the session version, so they can be revoked
+	session, err := app.Models.User.GetSession(user.ID)
+	if err != nil {
+		app.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
 	//log the authentication data to the logger service
 	// log authentication
-	err = app.logRequest("authentication", fmt.Sprintf("%s logged in", user.Email))
+	err = app.logRequest(r.Context(), "authentication", fmt.Sprintf("%s logged in", user.Email))
 	if err != nil {
 		app.ErrorJSON(w, errors.New("error log the data to mongodb: "+err.Error()), http.StatusInternalServerError)
 		return
@@ -45,14 +75,19 @@ func (app *App) Authenticate(w http.ResponseWriter, r *http.Request) {
 	payload := response{
 		Error:   false,
 		Message: fmt.Sprintf("Logged in user %s", user.Email),
-		Data:    user,
+		Data: struct {
+			*data.User
+			Roles          []string          `json:"roles"`
+			Permissions    []data.Permission `json:"permissions"`
+			SessionVersion int               `json:"session_version"`
+		}{user, roles, permissions, session.Version},
 	}
 
 	app.WriteJSON(w, http.StatusAccepted, payload)
 
 }
 
-func (app *App) logRequest(name, data string) error {
+func (app *App) logRequest(ctx context.Context, name, data string) error {
 	var entry struct {
 		Name string `json:"name"`
 		Data string `json:"data"`
@@ -64,16 +99,20 @@ func (app *App) logRequest(name, data string) error {
 	jsonData, _ := json.MarshalIndent(entry, "", "\t")
 	logServiceURL := "http://logger-service:8080/log"
 
-	request, err := http.NewRequest("POST", logServiceURL, bytes.NewBuffer(jsonData))
+	request, err := http.NewRequestWithContext(ctx, "POST", logServiceURL, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return err
 	}
 
-	client := &http.Client{}
-	_, err = client.Do(request)
+	client := &http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)}
+
+	done := app.Metrics.TrackDownstream("logger", "http")
+	res, err := client.Do(request)
+	done(err)
 	if err != nil {
 		return err
 	}
+	res.Body.Close()
 
 	return nil
 }
@@ -2,16 +2,21 @@ package main
 
 import (
 	"auth/data"
+	"auth/token"
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"shared/metrics"
+	"shared/tracing"
 	"time"
 
 	_ "github.com/jackc/pgconn"
 	_ "github.com/jackc/pgx/v4"
 	_ "github.com/jackc/pgx/v4/stdlib"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
 
 const webPort = "8080"
@@ -19,13 +24,54 @@ const webPort = "8080"
 var counts int64
 
 type App struct {
-	DB     *sql.DB
-	Models data.Models
+	DB      *sql.DB
+	Models  data.Models
+	Metrics *metrics.Metrics
+
+	// Tokens signs the links mailed to users who register
+	Tokens    *token.Signer
+	VerifyURL string
+	VerifyTTL time.Duration
+
+	ResetURL string
+	ResetTTL time.Duration
+	// ForgotPassword is throttled per client and per address, and its mails are sent
+	// from ResetQueue by a fixed number of workers
+	ResetsPerIP    *throttle
+	ResetsPerEmail *throttle
+	ResetQueue     chan resetRequest
+
+	// AdminFailuresPerIP and AdminFailuresPerEmail count failed admin logins, after
+	// which requireAdmin refuses a client or an account for a while
+	AdminFailuresPerIP    *throttle
+	AdminFailuresPerEmail *throttle
+
+	// ServiceToken is the credential other services present, as a bearer token, to
+	// the routes meant only for them
+	ServiceToken string
+	// MetricsToken is the bearer token Prometheus scrapes /metrics with
+	MetricsToken string
 }
 
 func main() {
+	// "migrate up|down|status" manages the schema and exits
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(runMigrate(os.Args[2:]))
+	}
+
 	log.Println("Starting authentication server...")
 
+	// send traces to the collector, or to stdout/a file when there isn't one
+	shutdownTracing, err := tracing.Setup(context.Background(), "authentication-service")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = shutdownTracing(ctx)
+	}()
+
 	//connect to database
 	conn := connectToPostgres()
 	if conn == nil {
@@ -36,8 +82,41 @@ func main() {
 
 	//set up the application
 	app := &App{
-		DB:     conn,
-		Models: data.New(conn),
+		DB:      conn,
+		Models:  data.New(conn),
+		Metrics: metrics.New("auth"),
+
+		ServiceToken: os.Getenv("SERVICE_TOKEN"),
+		MetricsToken: os.Getenv("METRICS_TOKEN"),
+
+		AdminFailuresPerIP:    newThrottle(adminFailuresPerIP, adminFailureWindow),
+		AdminFailuresPerEmail: newThrottle(adminFailuresPerEmail, adminFailureWindow),
+	}
+	if app.ServiceToken == "" {
+		log.Println("No SERVICE_TOKEN configured, the broker can't check sessions and will refuse every token")
+	}
+
+	// bring the schema up to date unless that is left to "migrate up"
+	if os.Getenv("MIGRATE_ON_START") != "false" {
+		applied, err := data.MigrateUp()
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, m := range applied {
+			log.Printf("Applied migration %d_%s\n", m.Version, m.Name)
+		}
+	}
+
+	// set up signing for the verification links sent on registration
+	err = app.configureVerification()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// and for the forgot password flow
+	err = app.configurePasswordReset()
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	log.Printf("Strating authentication server on port %s\n", webPort)
@@ -45,10 +124,10 @@ func main() {
 	//setup the server
 	srv := &http.Server{
 		Addr:    fmt.Sprintf(":%s", webPort),
-		Handler: app.routes(),
+		Handler: otelhttp.NewHandler(app.routes(), "authentication-service"),
 	}
 
-	err := srv.ListenAndServe()
+	err = srv.ListenAndServe()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -57,6 +136,72 @@ func main() {
 
 }
 
+// configureVerification reads how registration verifies email addresses:
+//
+//	VERIFY_SECRET  HMAC secret for verification links, at least 32 bytes
+//	VERIFY_URL     where the links point, defaults to http://localhost:8083/verify
+//	VERIFY_TTL     how long a link stays valid, defaults to 24h
+func (app *App) configureVerification() error {
+	secret := []byte(os.Getenv("VERIFY_SECRET"))
+	if len(secret) == 0 {
+		log.Println("No VERIFY_SECRET configured, generating a temporary one")
+
+		var err error
+		secret, err = token.GenerateSecret()
+		if err != nil {
+			return err
+		}
+	}
+
+	signer, err := token.NewSigner(secret)
+	if err != nil {
+		return fmt.Errorf("VERIFY_SECRET: %w", err)
+	}
+	app.Tokens = signer
+
+	app.VerifyURL = os.Getenv("VERIFY_URL")
+	if app.VerifyURL == "" {
+		app.VerifyURL = "http://localhost:8083/verify"
+	}
+
+	app.VerifyTTL = 24 * time.Hour
+	if s := os.Getenv("VERIFY_TTL"); s != "" {
+		app.VerifyTTL, err = time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("VERIFY_TTL: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// configurePasswordReset reads how forgotten passwords are reset:
+//
+//	RESET_URL           where reset links point, defaults to the reset page this service
+//	                    serves at http://localhost:8083/password/reset
+//	RESET_TTL           how long a reset token stays valid, defaults to 1h
+func (app *App) configurePasswordReset() error {
+	app.ResetURL = os.Getenv("RESET_URL")
+	if app.ResetURL == "" {
+		app.ResetURL = "http://localhost:8083/password/reset"
+	}
+
+	app.ResetTTL = time.Hour
+	if s := os.Getenv("RESET_TTL"); s != "" {
+		var err error
+		app.ResetTTL, err = time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("RESET_TTL: %w", err)
+		}
+	}
+
+	app.ResetsPerIP = newThrottle(resetsPerIP, resetWindow)
+	app.ResetsPerEmail = newThrottle(resetsPerEmail, resetWindow)
+	app.startResetWorkers()
+
+	return nil
+}
+
 func openPostgresConn(dsn string) (*sql.DB, error) {
 	db, err := sql.Open("pgx", dsn)
 	if err != nil {
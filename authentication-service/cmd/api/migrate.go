@@ -0,0 +1,102 @@
+package main
+
+import (
+	"auth/data"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+const migrateUsage = `usage: authApp migrate <command>
+
+commands:
+  up         apply every pending migration
+  down [n]   undo the last n applied migrations (default 1)
+  status     list the migrations and whether they have been applied`
+
+// runMigrate runs the migrate subcommand against the database in DSN and returns the
+// exit code
+func runMigrate(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		return 2
+	}
+
+	steps := 1
+	switch {
+	case args[0] == "down" && len(args) == 2:
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 1 {
+			fmt.Fprintln(os.Stderr, "down takes a positive number of migrations to undo")
+			return 2
+		}
+		steps = n
+	case (args[0] == "up" || args[0] == "down" || args[0] == "status") && len(args) == 1:
+	default:
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		return 2
+	}
+
+	conn := connectToPostgres()
+	if conn == nil {
+		log.Println("Can't connect to Postgres!")
+		return 1
+	}
+	defer conn.Close()
+
+	data.New(conn)
+
+	switch args[0] {
+	case "up":
+		applied, err := data.MigrateUp()
+		for _, m := range applied {
+			fmt.Printf("applied %d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		if len(applied) == 0 {
+			fmt.Println("schema is up to date")
+		}
+
+	case "down":
+		undone, err := data.MigrateDown(steps)
+		for _, m := range undone {
+			fmt.Printf("undid %d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		if len(undone) == 0 {
+			fmt.Println("no migrations to undo")
+		}
+
+	case "status":
+		states, err := data.MigrationStatus()
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED")
+		for _, s := range states {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = s.AppliedAt.Format(time.RFC3339)
+			}
+			if s.Unknown {
+				applied += " (not in this build)"
+			}
+			fmt.Fprintf(tw, "%04d\t%s\t%s\n", s.Version, s.Name, applied)
+		}
+		tw.Flush()
+	}
+
+	return 0
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"auth/data"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limits on the forgot password flow. Each address gets a few reset mails an hour and
+// each client a few more requests, and a fixed number of workers send the mails from a
+// bounded queue, so that the endpoint can't be used to flood inboxes or the service.
+const (
+	resetsPerEmail = 3
+	resetsPerIP    = 10
+	resetWindow    = time.Hour
+	resetWorkers   = 4
+	resetQueueSize = 100
+)
+
+// ForgotPassword mails a reset link to the account with the given email. It answers the
+// same way, straight away, whether or not there is such an account; the lookup and the
+// mail happen in the background so that timing doesn't tell either.
+func (app *App) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	if ok, retry := app.ResetsPerIP.Allow(clientIP(r)); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retry.Seconds())+1))
+		app.ErrorJSON(w, errors.New("too many password reset requests, try again later"), http.StatusTooManyRequests)
+		return
+	}
+
+	var requestPayload struct {
+		Email string `json:"email"`
+	}
+
+	err := app.ReadJSON(w, r, &requestPayload, false)
+	if err != nil {
+		app.ErrorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	email := strings.TrimSpace(requestPayload.Email)
+
+	var errs validationErrors
+	errs.email("email", email)
+	if len(errs) > 0 {
+		app.writeValidation(w, errs)
+		return
+	}
+
+	// an address over its limit gets the same answer, but no more mail
+	if ok, _ := app.ResetsPerEmail.Allow(strings.ToLower(email)); ok {
+		select {
+		case app.ResetQueue <- resetRequest{ctx: context.WithoutCancel(r.Context()), email: email}:
+		default:
+			app.ErrorJSON(w, errors.New("too many password reset requests, try again later"), http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	payload := response{
+		Error:   false,
+		Message: "if an account exists for that email, a reset link has been sent to it",
+	}
+
+	app.WriteJSON(w, http.StatusAccepted, payload)
+}
+
+// resetRequest is a reset mail waiting for a worker
+type resetRequest struct {
+	ctx   context.Context
+	email string
+}
+
+// startResetWorkers starts the workers that send the reset mails ForgotPassword queues
+func (app *App) startResetWorkers() {
+	app.ResetQueue = make(chan resetRequest, resetQueueSize)
+
+	for i := 0; i < resetWorkers; i++ {
+		go func() {
+			for req := range app.ResetQueue {
+				ctx, cancel := context.WithTimeout(req.ctx, 30*time.Second)
+				err := app.sendPasswordReset(ctx, req.email)
+				cancel()
+				if err != nil {
+					log.Println("forgot password:", err)
+				}
+			}
+		}()
+	}
+}
+
+// clientIP returns the address the request came from, without the port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// sendPasswordReset issues a reset token for the active user with email, if there is
+// one, and mails it to them
+func (app *App) sendPasswordReset(ctx context.Context, email string) error {
+	user, err := app.Models.User.GetByEmail(email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if user.Active != 1 {
+		return nil
+	}
+
+	raw, err := app.Models.Reset.Create(user.ID, app.ResetTTL)
+	if err != nil {
+		return err
+	}
+
+	link := app.ResetURL + "?token=" + url.QueryEscape(raw)
+	message := fmt.Sprintf("Someone asked to reset your password. If it was you, follow this link within %s to choose a new one:\n\n%s\n\nIf it wasn't, you can ignore this mail.", app.ResetTTL, link)
+
+	return app.sendMail(ctx, user.Email, "Reset your password", message)
+}
+
+// ResetPassword sets a new password for the user a reset token was issued to. The token
+// is looked up by its hash, so comparing it leaks nothing about the stored tokens, and
+// every way a token can be wrong gets the same answer. The token is only used up if the
+// password changes; with it every reset token and session the user had become invalid,
+// as the session version moves on in the same transaction.
+func (app *App) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	err := app.ReadJSON(w, r, &requestPayload, false)
+	if err != nil {
+		app.ErrorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	var errs validationErrors
+	if requestPayload.Token == "" {
+		errs.add("token", "is required")
+	}
+	errs.password("password", requestPayload.Password)
+	if len(errs) > 0 {
+		app.writeValidation(w, errs)
+		return
+	}
+
+	userID, err := app.Models.Reset.Redeem(requestPayload.Token, requestPayload.Password)
+	if errors.Is(err, data.ErrResetInvalid) {
+		app.ErrorJSON(w, err, http.StatusBadRequest)
+		return
+	} else if err != nil {
+		app.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	who := fmt.Sprintf("user %d", userID)
+	if user, err := app.Models.User.GetOne(userID); err == nil {
+		who = user.Email
+	}
+
+	err = app.logRequest(r.Context(), "password-reset", fmt.Sprintf("%s reset their password", who))
+	if err != nil {
+		log.Println("reset password:", err)
+	}
+
+	payload := response{
+		Error:   false,
+		Message: "password has been reset, please log in again",
+	}
+
+	app.WriteJSON(w, http.StatusOK, payload)
+}
+
+// resetPage is what a reset link opens: a form that posts the token from the link and
+// the new password to POST /password/reset
+var resetPage = template.Must(template.New("reset").Parse(`<!doctype html>
+<html>
+<head><meta charset="utf-8"><title>Reset your password</title></head>
+<body>
+<h1>Reset your password</h1>
+<form id="reset">
+<input type="hidden" name="token" value="{{.}}">
+<label>New password <input type="password" name="password" autocomplete="new-password" required></label>
+<button type="submit">Reset password</button>
+</form>
+<p id="result"></p>
+<script>
+document.getElementById("reset").addEventListener("submit", async (e) => {
+	e.preventDefault();
+	const form = new FormData(e.target);
+	const res = await fetch(window.location.pathname, {
+		method: "POST",
+		headers: {"Content-Type": "application/json"},
+		body: JSON.stringify({token: form.get("token"), password: form.get("password")}),
+	});
+	const body = await res.json();
+	document.getElementById("result").textContent = body.message;
+});
+</script>
+</body>
+</html>
+`))
+
+// ResetPasswordPage serves the page a reset link points at. It doesn't check the token;
+// only ResetPassword does, when the new password is submitted.
+func (app *App) ResetPasswordPage(w http.ResponseWriter, r *http.Request) {
+	raw := r.URL.Query().Get("token")
+	if raw == "" {
+		app.ErrorJSON(w, errors.New("token is required"), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	err := resetPage.Execute(w, raw)
+	if err != nil {
+		log.Println("reset password page:", err)
+	}
+}
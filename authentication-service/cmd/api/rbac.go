@@ -0,0 +1,232 @@
+package main
+
+import (
+	"auth/data"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// roleName is what a role may be called
+var roleName = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,49}$`)
+
+func (v *validationErrors) permissions(field string, permissions []data.Permission) {
+	for i, p := range permissions {
+		if p.Action == "" || len(p.Action) > 100 {
+			v.add(fmt.Sprintf("%s[%d].action", field, i), "must be 1 to 100 characters")
+		}
+		if p.Resource == "" || len(p.Resource) > maxFieldLength {
+			v.add(fmt.Sprintf("%s[%d].resource", field, i), fmt.Sprintf("must be 1 to %d characters", maxFieldLength))
+		}
+	}
+}
+
+// Authorize decides whether a user may perform an action on a resource. It is for
+// other services only, which send SERVICE_TOKEN, and the subject is a user id, as in
+// the tokens the broker issues. The answer is 200 either way, with data.allowed
+// telling; a denial always gives the same reason, so that it says nothing about
+// whether the user exists, is active or which roles they have.
+func (app *App) Authorize(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Subject  string `json:"subject"`
+		Action   string `json:"action"`
+		Resource string `json:"resource"`
+	}
+
+	err := app.ReadJSON(w, r, &requestPayload, false)
+	if err != nil {
+		app.ErrorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	var errs validationErrors
+	id, convErr := strconv.Atoi(requestPayload.Subject)
+	if convErr != nil || id < 1 {
+		errs.add("subject", "must be a user id")
+	}
+	if requestPayload.Action == "" {
+		errs.add("action", "is required")
+	}
+	if len(errs) > 0 {
+		app.writeValidation(w, errs)
+		return
+	}
+	if requestPayload.Resource == "" {
+		requestPayload.Resource = data.Any
+	}
+
+	decision := map[string]any{
+		"allowed":  false,
+		"subject":  requestPayload.Subject,
+		"action":   requestPayload.Action,
+		"resource": requestPayload.Resource,
+	}
+
+	user, err := app.Models.User.GetOne(id)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		app.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if user != nil && user.Active == 1 {
+		allowed, err := user.Can(requestPayload.Action, requestPayload.Resource)
+		if err != nil {
+			app.ErrorJSON(w, err, http.StatusInternalServerError)
+			return
+		}
+		if allowed {
+			decision["allowed"] = true
+			app.WriteJSON(w, http.StatusOK, response{Error: false, Message: "allowed", Data: decision})
+			return
+		}
+	}
+
+	decision["reason"] = "not allowed"
+	app.WriteJSON(w, http.StatusOK, response{Error: false, Message: "denied", Data: decision})
+}
+
+// ListRoles returns every role with its permissions
+func (app *App) ListRoles(w http.ResponseWriter, r *http.Request) {
+	roles, err := app.Models.Role.GetAll()
+	if err != nil {
+		app.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	payload := response{
+		Error:   false,
+		Message: fmt.Sprintf("%d roles", len(roles)),
+		Data:    roles,
+	}
+
+	app.WriteJSON(w, http.StatusOK, payload)
+}
+
+// SaveRole creates or replaces the role named in the URL
+func (app *App) SaveRole(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Description string            `json:"description"`
+		Permissions []data.Permission `json:"permissions"`
+	}
+
+	err := app.ReadJSON(w, r, &requestPayload, false)
+	if err != nil {
+		app.ErrorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	name := chi.URLParam(r, "name")
+
+	var errs validationErrors
+	if !roleName.MatchString(name) {
+		errs.add("name", "must be lowercase letters, digits, - or _, starting with a letter, at most 50 characters")
+	}
+	errs.name("description", requestPayload.Description)
+	errs.permissions("permissions", requestPayload.Permissions)
+	if len(errs) > 0 {
+		app.writeValidation(w, errs)
+		return
+	}
+
+	err = app.Models.Role.Save(data.Role{
+		Name:        name,
+		Description: requestPayload.Description,
+		Permissions: requestPayload.Permissions,
+	})
+	if err != nil {
+		app.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	role, err := app.Models.Role.GetByName(name)
+	if err != nil {
+		app.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.audit(r, "saved role %s", role.Name)
+
+	payload := response{
+		Error:   false,
+		Message: fmt.Sprintf("saved role %s", role.Name),
+		Data:    role,
+	}
+
+	app.WriteJSON(w, http.StatusOK, payload)
+}
+
+// DeleteRole deletes a role and takes it away from everyone who had it. The user and
+// admin roles can't be deleted.
+func (app *App) DeleteRole(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	err := app.Models.Role.DeleteByName(name)
+	if errors.Is(err, data.ErrUnknownRole) {
+		app.ErrorJSON(w, err, http.StatusNotFound)
+		return
+	} else if errors.Is(err, data.ErrBuiltinRole) {
+		app.ErrorJSON(w, err, http.StatusConflict)
+		return
+	} else if err != nil {
+		app.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.audit(r, "deleted role %s", name)
+
+	payload := response{
+		Error:   false,
+		Message: fmt.Sprintf("deleted role %s", name),
+	}
+
+	app.WriteJSON(w, http.StatusOK, payload)
+}
+
+// SetUserRoles replaces the roles assigned to a user on top of their user or admin role
+func (app *App) SetUserRoles(w http.ResponseWriter, r *http.Request) {
+	user := app.userFromURL(w, r)
+	if user == nil {
+		return
+	}
+
+	var requestPayload struct {
+		Roles []string `json:"roles"`
+	}
+
+	err := app.ReadJSON(w, r, &requestPayload, false)
+	if err != nil {
+		app.ErrorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	err = user.SetRoles(requestPayload.Roles)
+	if errors.Is(err, data.ErrUnknownRole) {
+		app.writeValidation(w, validationErrors{{Field: "roles", Message: err.Error()}})
+		return
+	} else if err != nil {
+		app.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	roles, err := user.Roles()
+	if err != nil {
+		app.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.audit(r, "set the roles of user %d (%s) to %s", user.ID, user.Email, strings.Join(roles, ", "))
+
+	payload := response{
+		Error:   false,
+		Message: fmt.Sprintf("roles of %s set", user.Email),
+		Data:    map[string]any{"roles": roles},
+	}
+
+	app.WriteJSON(w, http.StatusOK, payload)
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"auth/data"
+	"auth/token"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// verifyStamp ties a verification token to the state of the account it was issued
+// for; an admin editing or deactivating the account invalidates the token
+func verifyStamp(user *data.User) string {
+	return strconv.FormatInt(user.UpdatedAt.UnixNano(), 36)
+}
+
+// Register signs a user up. The account stays inactive until the user follows the link
+// mailed to them.
+func (app *App) Register(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Email     string `json:"email"`
+		FirstName string `json:"first_name"`
+		LastName  string `json:"last_name"`
+		Password  string `json:"password"`
+	}
+
+	err := app.ReadJSON(w, r, &requestPayload, false)
+	if err != nil {
+		app.ErrorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	requestPayload.Email = strings.TrimSpace(requestPayload.Email)
+
+	var errs validationErrors
+	errs.email("email", requestPayload.Email)
+	errs.password("password", requestPayload.Password)
+	errs.name("first_name", requestPayload.FirstName)
+	errs.name("last_name", requestPayload.LastName)
+	if len(errs) > 0 {
+		app.writeValidation(w, errs)
+		return
+	}
+
+	taken, err := app.emailTaken(requestPayload.Email, 0)
+	if err != nil {
+		app.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	if taken {
+		app.ErrorJSON(w, fmt.Errorf("a user with email %s already exists", requestPayload.Email), http.StatusConflict)
+		return
+	}
+
+	id, err := app.Models.User.Insert(data.User{
+		Email:     requestPayload.Email,
+		FirstName: requestPayload.FirstName,
+		LastName:  requestPayload.LastName,
+		Password:  requestPayload.Password,
+		Active:    0,
+		Role:      data.RoleUser,
+	})
+	if err != nil {
+		app.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	user, err := app.Models.User.GetOne(id)
+	if err != nil {
+		app.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	// without the mail the account could never be activated, and the email address
+	// would stay taken, so undo the sign up and let the user try again
+	err = app.sendVerification(r.Context(), user)
+	if err != nil {
+		log.Println("register:", err)
+		if err := user.DeleteByID(user.ID); err != nil {
+			log.Println("register:", err)
+		}
+		app.ErrorJSON(w, errors.New("could not send the verification mail, please try again later"), http.StatusBadGateway)
+		return
+	}
+
+	err = app.logRequest(r.Context(), "registration", fmt.Sprintf("%s registered", user.Email))
+	if err != nil {
+		log.Println("register:", err)
+	}
+
+	payload := response{
+		Error:   false,
+		Message: fmt.Sprintf("registered %s, check your mail to verify the account", user.Email),
+		Data:    user,
+	}
+
+	app.WriteJSON(w, http.StatusCreated, payload)
+}
+
+// sendVerification mails user a link that activates their account
+func (app *App) sendVerification(ctx context.Context, user *data.User) error {
+	tok, err := app.Tokens.Sign(token.Claims{
+		UserID:  user.ID,
+		Email:   user.Email,
+		Purpose: token.PurposeVerify,
+		Stamp:   verifyStamp(user),
+	}, app.VerifyTTL)
+	if err != nil {
+		return err
+	}
+
+	link := app.VerifyURL + "?token=" + url.QueryEscape(tok)
+	message := fmt.Sprintf("Welcome! Follow this link within %s to verify your account:\n\n%s", app.VerifyTTL, link)
+
+	return app.sendMail(ctx, user.Email, "Verify your account", message)
+}
+
+// sendMail hands a message to the mail service
+func (app *App) sendMail(ctx context.Context, to, subject, message string) error {
+	var msg struct {
+		To      string `json:"to"`
+		Subject string `json:"subject"`
+		Message string `json:"message"`
+	}
+
+	msg.To = to
+	msg.Subject = subject
+	msg.Message = message
+
+	jsonData, _ := json.Marshal(msg)
+	mailServiceURL := "http://mailer-service:8080/send"
+
+	request, err := http.NewRequestWithContext(ctx, "POST", mailServiceURL, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport), Timeout: 10 * time.Second}
+
+	done := app.Metrics.TrackDownstream("mailer", "http")
+	res, err := client.Do(request)
+	done(err)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("mail service answered %d", res.StatusCode)
+	}
+
+	return nil
+}
+
+// Verify activates the account named by the token in the query string
+func (app *App) Verify(w http.ResponseWriter, r *http.Request) {
+	raw := r.URL.Query().Get("token")
+	if raw == "" {
+		app.ErrorJSON(w, errors.New("token is required"), http.StatusBadRequest)
+		return
+	}
+
+	claims, err := app.Tokens.Verify(token.PurposeVerify, raw)
+	if errors.Is(err, token.ErrExpired) {
+		app.ErrorJSON(w, errors.New("the verification link has expired"), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		app.ErrorJSON(w, errors.New("invalid verification link"), http.StatusBadRequest)
+		return
+	}
+
+	user, err := app.Models.User.GetOne(claims.UserID)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.ErrorJSON(w, errors.New("invalid verification link"), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		app.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if user.Active == 1 {
+		payload := response{
+			Error:   false,
+			Message: fmt.Sprintf("%s is already verified", user.Email),
+		}
+		app.WriteJSON(w, http.StatusOK, payload)
+		return
+	}
+
+	if user.Email != claims.Email || verifyStamp(user) != claims.Stamp {
+		app.ErrorJSON(w, errors.New("the verification link is no longer valid"), http.StatusBadRequest)
+		return
+	}
+
+	user.Active = 1
+	err = user.Update()
+	if err != nil {
+		app.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	err = app.logRequest(r.Context(), "registration", fmt.Sprintf("%s verified", user.Email))
+	if err != nil {
+		log.Println("verify:", err)
+	}
+
+	payload := response{
+		Error:   false,
+		Message: fmt.Sprintf("verified %s, you can now log in", user.Email),
+	}
+
+	app.WriteJSON(w, http.StatusOK, payload)
+}
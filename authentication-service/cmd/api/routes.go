@@ -14,15 +14,64 @@ func (app *App) routes() http.Handler {
 	//specify who is allowed to connect
 	mux.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   []string{"https://*", "http://*"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
 		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
 		AllowCredentials: true,
 		MaxAge:           300,
 	}))
 
 	mux.Use(middleware.Heartbeat("/ping"))
+	mux.Use(app.Metrics.Middleware)
+
+	// prometheus metrics, behind METRICS_TOKEN
+	mux.With(app.requireMetrics).Handle("/metrics", app.Metrics.Handler())
 
 	mux.Post("/auth", app.Authenticate)
 
+	// self-service sign up
+	mux.Post("/register", app.Register)
+	mux.Get("/verify", app.Verify)
+
+	// forgotten passwords
+	mux.Post("/password/forgot", app.ForgotPassword)
+	mux.Get("/password/reset", app.ResetPasswordPage)
+	mux.Post("/password/reset", app.ResetPassword)
+
+	// policy checks for the broker and other services
+	mux.With(app.requireServiceToken).Post("/authorize", app.Authorize)
+
+	// session versions, which the broker checks its tokens against, and the refresh
+	// tokens it has exchanged
+	mux.Route("/sessions", func(mux chi.Router) {
+		mux.Use(app.requireServiceToken)
+
+		mux.Get("/{id}", app.GetSession)
+		mux.Post("/{id}/revoke", app.RevokeSessions)
+		mux.Post("/{id}/refresh", app.UseRefreshToken)
+	})
+
+	// user management, for admins only
+	mux.Route("/users", func(mux chi.Router) {
+		mux.Use(app.requireAdmin)
+
+		mux.Get("/", app.ListUsers)
+		mux.Post("/", app.CreateUser)
+		mux.Get("/{id}", app.GetUser)
+		mux.Patch("/{id}", app.UpdateUser)
+		mux.Delete("/{id}", app.DeleteUser)
+		mux.Post("/{id}/deactivate", app.DeactivateUser)
+		mux.Post("/{id}/password", app.ResetUserPassword)
+		mux.Put("/{id}/roles", app.SetUserRoles)
+	})
+
+	// roles and their permissions, for admins only
+	mux.Route("/roles", func(mux chi.Router) {
+		mux.Use(app.requireAdmin)
+
+		mux.Get("/", app.ListRoles)
+		mux.Put("/{name}", app.SaveRole)
+		mux.Delete("/{name}", app.DeleteRole)
+	})
+
 	return mux
 }
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"auth/data"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// GetSession returns the session version of a user and whether they are active, so
+// that the broker can refuse tokens issued before their sessions were revoked
+func (app *App) GetSession(w http.ResponseWriter, r *http.Request) {
+	user := app.userFromURL(w, r)
+	if user == nil {
+		return
+	}
+
+	session, err := app.Models.User.GetSession(user.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.ErrorJSON(w, fmt.Errorf("user %d not found", user.ID), http.StatusNotFound)
+		return
+	} else if err != nil {
+		app.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	payload := response{
+		Error:   false,
+		Message: fmt.Sprintf("session of user %d", user.ID),
+		Data:    session,
+	}
+
+	app.WriteJSON(w, http.StatusOK, payload)
+}
+
+// RevokeSessions ends every session a user has: the tokens issued to them so far are
+// refused from now on, by every broker
+func (app *App) RevokeSessions(w http.ResponseWriter, r *http.Request) {
+	user := app.userFromURL(w, r)
+	if user == nil {
+		return
+	}
+
+	session, err := user.RevokeSessions()
+	if errors.Is(err, sql.ErrNoRows) {
+		app.ErrorJSON(w, fmt.Errorf("user %d not found", user.ID), http.StatusNotFound)
+		return
+	} else if err != nil {
+		app.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.audit(r, "revoked the sessions of user %d (%s)", user.ID, user.Email)
+
+	payload := response{
+		Error:   false,
+		Message: fmt.Sprintf("sessions revoked for %s", user.Email),
+		Data:    session,
+	}
+
+	app.WriteJSON(w, http.StatusOK, payload)
+}
+
+// UseRefreshToken records that the broker exchanged one of the user's refresh tokens,
+// and answers 409 if that token was exchanged before, by any broker
+func (app *App) UseRefreshToken(w http.ResponseWriter, r *http.Request) {
+	user := app.userFromURL(w, r)
+	if user == nil {
+		return
+	}
+
+	var requestPayload struct {
+		TokenID   string    `json:"token_id"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+
+	err := app.ReadJSON(w, r, &requestPayload, false)
+	if err != nil {
+		app.ErrorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	var errs validationErrors
+	if requestPayload.TokenID == "" || len(requestPayload.TokenID) > 64 {
+		errs.add("token_id", "is required and at most 64 characters")
+	}
+	if requestPayload.ExpiresAt.IsZero() {
+		errs.add("expires_at", "is required")
+	}
+	if len(errs) > 0 {
+		app.writeValidation(w, errs)
+		return
+	}
+
+	err = user.UseRefreshToken(requestPayload.TokenID, requestPayload.ExpiresAt)
+	if errors.Is(err, data.ErrRefreshUsed) {
+		app.ErrorJSON(w, err, http.StatusConflict)
+		return
+	} else if err != nil {
+		app.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	payload := response{
+		Error:   false,
+		Message: fmt.Sprintf("refresh token of user %d used", user.ID),
+	}
+
+	app.WriteJSON(w, http.StatusOK, payload)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// throttle allows each key a number of events per fixed window, for instance a few
+// password reset mails per email address an hour.
+type throttle struct {
+	limit  int
+	window time.Duration
+
+	mu        sync.Mutex
+	windows   map[string]*throttleWindow
+	lastPrune time.Time
+}
+
+type throttleWindow struct {
+	start time.Time
+	count int
+}
+
+func newThrottle(limit int, window time.Duration) *throttle {
+	return &throttle{
+		limit:   limit,
+		window:  window,
+		windows: make(map[string]*throttleWindow),
+	}
+}
+
+// Allow counts an event for key and reports whether it is within the limit. If it
+// isn't, Allow also says how long until the key's window ends.
+func (t *throttle) Allow(key string) (bool, time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+
+	// forget the windows that have ended, at most once a window
+	if now.Sub(t.lastPrune) > t.window {
+		for k, w := range t.windows {
+			if now.Sub(w.start) >= t.window {
+				delete(t.windows, k)
+			}
+		}
+		t.lastPrune = now
+	}
+
+	w, ok := t.windows[key]
+	if !ok || now.Sub(w.start) >= t.window {
+		w = &throttleWindow{start: now}
+		t.windows[key] = w
+	}
+
+	if w.count >= t.limit {
+		return false, w.start.Add(t.window).Sub(now)
+	}
+	w.count++
+
+	return true, 0
+}
+
+// Blocked reports, without counting an event, whether key has used up its window and
+// if so how long until the window ends
+func (t *throttle) Blocked(key string) (bool, time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+
+	w, ok := t.windows[key]
+	if !ok || now.Sub(w.start) >= t.window || w.count < t.limit {
+		return false, 0
+	}
+
+	return true, w.start.Add(t.window).Sub(now)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestThrottle(t *testing.T) {
+	tests := []struct {
+		name   string
+		limit  int
+		window time.Duration
+		keys   []string
+		wait   time.Duration
+		want   []bool
+	}{
+		{name: "within the limit", limit: 2, window: time.Hour, keys: []string{"a", "a"}, want: []bool{true, true}},
+		{name: "over the limit", limit: 2, window: time.Hour, keys: []string{"a", "a", "a"}, want: []bool{true, true, false}},
+		{name: "keys are counted apart", limit: 1, window: time.Hour, keys: []string{"a", "b", "a"}, want: []bool{true, true, false}},
+		{name: "a new window starts afresh", limit: 1, window: 10 * time.Millisecond, keys: []string{"a", "a"}, wait: 20 * time.Millisecond, want: []bool{true, true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			th := newThrottle(tt.limit, tt.window)
+			for i, key := range tt.keys {
+				if i > 0 {
+					time.Sleep(tt.wait)
+				}
+
+				ok, retry := th.Allow(key)
+				if ok != tt.want[i] {
+					t.Fatalf("event %d for %s: allowed = %v, want %v", i, key, ok, tt.want[i])
+				}
+				if !ok && (retry <= 0 || retry > tt.window) {
+					t.Errorf("event %d: retry after %s, want within %s", i, retry, tt.window)
+				}
+			}
+		})
+	}
+}
+
+func TestThrottleBlocked(t *testing.T) {
+	th := newThrottle(2, time.Hour)
+
+	for i := 0; i < 3; i++ {
+		if blocked, _ := th.Blocked("a"); blocked {
+			t.Fatalf("blocked after %d checks; Blocked mustn't count", i)
+		}
+	}
+
+	th.Allow("a")
+	if blocked, _ := th.Blocked("a"); blocked {
+		t.Fatal("blocked within the limit")
+	}
+
+	th.Allow("a")
+	blocked, retry := th.Blocked("a")
+	if !blocked || retry <= 0 || retry > time.Hour {
+		t.Errorf("Blocked = %v, %s; want blocked for up to an hour", blocked, retry)
+	}
+	if blocked, _ := th.Blocked("b"); blocked {
+		t.Error("another key is blocked")
+	}
+}
@@ -0,0 +1,557 @@
+package main
+
+import (
+	"auth/data"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Password rules. bcrypt ignores everything past 72 bytes, so longer passwords would
+// silently be truncated.
+const (
+	minPasswordLength = 8
+	maxPasswordLength = 72
+	maxFieldLength    = 255
+)
+
+// fieldError describes one field of a request that failed validation
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// validationErrors collects field errors while a request is checked
+type validationErrors []fieldError
+
+func (v *validationErrors) add(field, message string) {
+	*v = append(*v, fieldError{Field: field, Message: message})
+}
+
+func (v *validationErrors) email(field, email string) {
+	if email == "" {
+		v.add(field, "is required")
+		return
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email || len(email) > maxFieldLength {
+		v.add(field, "must be a valid email address")
+	}
+}
+
+func (v *validationErrors) password(field, password string) {
+	switch {
+	case len(password) < minPasswordLength:
+		v.add(field, fmt.Sprintf("must be at least %d characters", minPasswordLength))
+	case len(password) > maxPasswordLength:
+		v.add(field, fmt.Sprintf("must be at most %d bytes", maxPasswordLength))
+	case strings.TrimSpace(password) == "":
+		v.add(field, "must not be blank")
+	}
+}
+
+func (v *validationErrors) name(field, name string) {
+	if len(name) > maxFieldLength {
+		v.add(field, fmt.Sprintf("must be at most %d characters", maxFieldLength))
+	}
+}
+
+func (v *validationErrors) role(field, role string) {
+	if role != data.RoleUser && role != data.RoleAdmin {
+		v.add(field, fmt.Sprintf("must be %s or %s", data.RoleUser, data.RoleAdmin))
+	}
+}
+
+// writeValidation sends a 400 listing the fields at fault
+func (app *App) writeValidation(w http.ResponseWriter, errs validationErrors) {
+	payload := response{
+		Error:   true,
+		Message: "invalid request",
+		Data:    map[string]any{"errors": errs},
+	}
+
+	app.WriteJSON(w, http.StatusBadRequest, payload)
+}
+
+// Limits on failed admin logins. Every failure counts against the client and against
+// the email tried, so that the Basic auth on the admin routes can't be used to guess
+// passwords, from one address or spread over many.
+const (
+	adminFailuresPerIP    = 20
+	adminFailuresPerEmail = 5
+	adminFailureWindow    = 15 * time.Minute
+)
+
+type adminKey struct{}
+
+// requireAdmin is middleware that only lets through active admins, who authenticate
+// with their email and password over HTTP Basic auth. Whether someone is an admin
+// comes from their roles, the same as for every other permission. A client or an
+// email with too many failed logins gets a 429 without its password being checked.
+func (app *App) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		email, password, ok := r.BasicAuth()
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="users", charset="UTF-8"`)
+			app.ErrorJSON(w, errors.New("admin credentials required"), http.StatusUnauthorized)
+			return
+		}
+
+		ip, account := clientIP(r), strings.ToLower(strings.TrimSpace(email))
+		blocked, retry := app.AdminFailuresPerIP.Blocked(ip)
+		if !blocked {
+			blocked, retry = app.AdminFailuresPerEmail.Blocked(account)
+		}
+		if blocked {
+			w.Header().Set("Retry-After", strconv.Itoa(int(retry.Seconds())+1))
+			app.ErrorJSON(w, errors.New("too many failed logins, try again later"), http.StatusTooManyRequests)
+			return
+		}
+
+		fail := func() {
+			app.AdminFailuresPerIP.Allow(ip)
+			app.AdminFailuresPerEmail.Allow(account)
+			w.Header().Set("WWW-Authenticate", `Basic realm="users", charset="UTF-8"`)
+			app.ErrorJSON(w, errors.New("invalid credentials"), http.StatusUnauthorized)
+		}
+
+		user, err := app.Models.User.GetByEmail(email)
+		if err != nil {
+			fail()
+			return
+		}
+
+		valid, err := user.PasswordMatches(password)
+		if err != nil || !valid || user.Active != 1 {
+			fail()
+			return
+		}
+
+		admin, err := user.Can(data.ActionAdmin, data.ResourceAuth)
+		if err != nil {
+			app.ErrorJSON(w, err, http.StatusInternalServerError)
+			return
+		}
+		if !admin {
+			app.ErrorJSON(w, errors.New("admin permission required"), http.StatusForbidden)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), adminKey{}, user)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// adminFrom returns the admin making the request
+func adminFrom(ctx context.Context) *data.User {
+	admin, _ := ctx.Value(adminKey{}).(*data.User)
+	return admin
+}
+
+// audit records what an admin did in the logger; a logger outage doesn't fail the request
+func (app *App) audit(r *http.Request, format string, args ...any) {
+	message := fmt.Sprintf(format, args...)
+	if admin := adminFrom(r.Context()); admin != nil {
+		message = admin.Email + " " + message
+	}
+
+	err := app.logRequest(r.Context(), "user-admin", message)
+	if err != nil {
+		log.Println("audit:", err)
+	}
+}
+
+// userFromURL loads the user named by the {id} URL parameter, replying with an error
+// and returning nil if there isn't one
+func (app *App) userFromURL(w http.ResponseWriter, r *http.Request) *data.User {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil || id < 1 {
+		app.ErrorJSON(w, errors.New("invalid user id"), http.StatusBadRequest)
+		return nil
+	}
+
+	user, err := app.Models.User.GetOne(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.ErrorJSON(w, fmt.Errorf("user %d not found", id), http.StatusNotFound)
+		return nil
+	} else if err != nil {
+		app.ErrorJSON(w, err, http.StatusInternalServerError)
+		return nil
+	}
+
+	return user
+}
+
+// emailTaken reports whether a user other than id already has email
+func (app *App) emailTaken(email string, id int) (bool, error) {
+	user, err := app.Models.User.GetByEmail(email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return user.ID != id, nil
+}
+
+// ListUsers returns one page of users. Query parameters:
+//
+//	q         part of the email, first or last name
+//	active    true or false
+//	role      user or admin
+//	sort      id (default), email, first_name, last_name, created_at or updated_at
+//	order     asc (default) or desc
+//	page      page number, from 1
+//	per_page  users per page, up to 100 (default 20)
+func (app *App) ListUsers(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var errs validationErrors
+
+	filter := data.UserFilter{
+		Search: strings.TrimSpace(query.Get("q")),
+		Role:   query.Get("role"),
+		Sort:   query.Get("sort"),
+	}
+
+	if s := query.Get("active"); s != "" {
+		active, err := strconv.ParseBool(s)
+		if err != nil {
+			errs.add("active", "must be true or false")
+		}
+		filter.Active = &active
+	}
+	if filter.Role != "" {
+		errs.role("role", filter.Role)
+	}
+
+	switch query.Get("order") {
+	case "", "asc":
+	case "desc":
+		filter.Desc = true
+	default:
+		errs.add("order", "must be asc or desc")
+	}
+
+	for _, p := range []struct {
+		name string
+		dst  *int
+	}{{"page", &filter.Page}, {"per_page", &filter.PerPage}} {
+		if s := query.Get(p.name); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 1 {
+				errs.add(p.name, "must be a positive number")
+			}
+			*p.dst = n
+		}
+	}
+
+	if len(errs) > 0 {
+		app.writeValidation(w, errs)
+		return
+	}
+
+	page, err := app.Models.User.List(filter)
+	if errors.Is(err, data.ErrUnknownSort) {
+		app.writeValidation(w, validationErrors{{Field: "sort", Message: err.Error()}})
+		return
+	} else if err != nil {
+		app.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	payload := response{
+		Error:   false,
+		Message: fmt.Sprintf("%d users", page.Total),
+		Data:    page,
+	}
+
+	app.WriteJSON(w, http.StatusOK, payload)
+}
+
+// GetUser returns one user
+func (app *App) GetUser(w http.ResponseWriter, r *http.Request) {
+	user := app.userFromURL(w, r)
+	if user == nil {
+		return
+	}
+
+	payload := response{
+		Error:   false,
+		Message: fmt.Sprintf("user %d", user.ID),
+		Data:    user,
+	}
+
+	app.WriteJSON(w, http.StatusOK, payload)
+}
+
+// CreateUser adds a user. Users are active, with the user role, unless told otherwise.
+func (app *App) CreateUser(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Email     string `json:"email"`
+		FirstName string `json:"first_name"`
+		LastName  string `json:"last_name"`
+		Password  string `json:"password"`
+		Active    *bool  `json:"active"`
+		Role      string `json:"role"`
+	}
+
+	err := app.ReadJSON(w, r, &requestPayload, false)
+	if err != nil {
+		app.ErrorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	requestPayload.Email = strings.TrimSpace(requestPayload.Email)
+	if requestPayload.Role == "" {
+		requestPayload.Role = data.RoleUser
+	}
+
+	var errs validationErrors
+	errs.email("email", requestPayload.Email)
+	errs.password("password", requestPayload.Password)
+	errs.name("first_name", requestPayload.FirstName)
+	errs.name("last_name", requestPayload.LastName)
+	errs.role("role", requestPayload.Role)
+	if len(errs) > 0 {
+		app.writeValidation(w, errs)
+		return
+	}
+
+	taken, err := app.emailTaken(requestPayload.Email, 0)
+	if err != nil {
+		app.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	if taken {
+		app.ErrorJSON(w, fmt.Errorf("a user with email %s already exists", requestPayload.Email), http.StatusConflict)
+		return
+	}
+
+	active := 1
+	if requestPayload.Active != nil && !*requestPayload.Active {
+		active = 0
+	}
+
+	id, err := app.Models.User.Insert(data.User{
+		Email:     requestPayload.Email,
+		FirstName: requestPayload.FirstName,
+		LastName:  requestPayload.LastName,
+		Password:  requestPayload.Password,
+		Active:    active,
+		Role:      requestPayload.Role,
+	})
+	if err != nil {
+		app.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	user, err := app.Models.User.GetOne(id)
+	if err != nil {
+		app.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.audit(r, "created user %d (%s)", user.ID, user.Email)
+
+	payload := response{
+		Error:   false,
+		Message: fmt.Sprintf("created user %s", user.Email),
+		Data:    user,
+	}
+
+	app.WriteJSON(w, http.StatusCreated, payload)
+}
+
+// UpdateUser changes the fields present in the request and leaves the rest alone.
+// Admins can't deactivate themselves or give up their own admin role.
+func (app *App) UpdateUser(w http.ResponseWriter, r *http.Request) {
+	user := app.userFromURL(w, r)
+	if user == nil {
+		return
+	}
+
+	var requestPayload struct {
+		Email     *string `json:"email"`
+		FirstName *string `json:"first_name"`
+		LastName  *string `json:"last_name"`
+		Active    *bool   `json:"active"`
+		Role      *string `json:"role"`
+	}
+
+	err := app.ReadJSON(w, r, &requestPayload, false)
+	if err != nil {
+		app.ErrorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	var errs validationErrors
+	if requestPayload.Email != nil {
+		user.Email = strings.TrimSpace(*requestPayload.Email)
+		errs.email("email", user.Email)
+	}
+	if requestPayload.FirstName != nil {
+		user.FirstName = *requestPayload.FirstName
+		errs.name("first_name", user.FirstName)
+	}
+	if requestPayload.LastName != nil {
+		user.LastName = *requestPayload.LastName
+		errs.name("last_name", user.LastName)
+	}
+	if requestPayload.Active != nil {
+		user.Active = 0
+		if *requestPayload.Active {
+			user.Active = 1
+		}
+	}
+	if requestPayload.Role != nil {
+		user.Role = *requestPayload.Role
+		errs.role("role", user.Role)
+	}
+	if len(errs) > 0 {
+		app.writeValidation(w, errs)
+		return
+	}
+
+	if admin := adminFrom(r.Context()); admin != nil && admin.ID == user.ID && (user.Active != 1 || user.Role != admin.Role) {
+		app.ErrorJSON(w, errors.New("you can't deactivate yourself or change your own role"), http.StatusConflict)
+		return
+	}
+
+	if requestPayload.Email != nil {
+		taken, err := app.emailTaken(user.Email, user.ID)
+		if err != nil {
+			app.ErrorJSON(w, err, http.StatusInternalServerError)
+			return
+		}
+		if taken {
+			app.ErrorJSON(w, fmt.Errorf("a user with email %s already exists", user.Email), http.StatusConflict)
+			return
+		}
+	}
+
+	err = user.Update()
+	if err != nil {
+		app.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.audit(r, "updated user %d (%s)", user.ID, user.Email)
+	app.respondWithUser(w, user.ID, fmt.Sprintf("updated user %s", user.Email))
+}
+
+// DeactivateUser stops a user from logging in without deleting them
+func (app *App) DeactivateUser(w http.ResponseWriter, r *http.Request) {
+	user := app.userFromURL(w, r)
+	if user == nil {
+		return
+	}
+
+	if admin := adminFrom(r.Context()); admin != nil && admin.ID == user.ID {
+		app.ErrorJSON(w, errors.New("you can't deactivate yourself"), http.StatusConflict)
+		return
+	}
+
+	user.Active = 0
+	err := user.Update()
+	if err != nil {
+		app.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.audit(r, "deactivated user %d (%s)", user.ID, user.Email)
+	app.respondWithUser(w, user.ID, fmt.Sprintf("deactivated user %s", user.Email))
+}
+
+// DeleteUser removes a user for good
+func (app *App) DeleteUser(w http.ResponseWriter, r *http.Request) {
+	user := app.userFromURL(w, r)
+	if user == nil {
+		return
+	}
+
+	if admin := adminFrom(r.Context()); admin != nil && admin.ID == user.ID {
+		app.ErrorJSON(w, errors.New("you can't delete yourself"), http.StatusConflict)
+		return
+	}
+
+	err := user.Delete()
+	if err != nil {
+		app.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.audit(r, "deleted user %d (%s)", user.ID, user.Email)
+
+	payload := response{
+		Error:   false,
+		Message: fmt.Sprintf("deleted user %s", user.Email),
+	}
+
+	app.WriteJSON(w, http.StatusOK, payload)
+}
+
+// ResetUserPassword sets a new password for a user
+func (app *App) ResetUserPassword(w http.ResponseWriter, r *http.Request) {
+	user := app.userFromURL(w, r)
+	if user == nil {
+		return
+	}
+
+	var requestPayload struct {
+		Password string `json:"password"`
+	}
+
+	err := app.ReadJSON(w, r, &requestPayload, false)
+	if err != nil {
+		app.ErrorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	var errs validationErrors
+	errs.password("password", requestPayload.Password)
+	if len(errs) > 0 {
+		app.writeValidation(w, errs)
+		return
+	}
+
+	err = user.ResetPassword(requestPayload.Password)
+	if err != nil {
+		app.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.audit(r, "reset the password of user %d (%s)", user.ID, user.Email)
+
+	payload := response{
+		Error:   false,
+		Message: fmt.Sprintf("password reset for %s", user.Email),
+	}
+
+	app.WriteJSON(w, http.StatusOK, payload)
+}
+
+// respondWithUser reloads a user after a change and sends it back
+func (app *App) respondWithUser(w http.ResponseWriter, id int, message string) {
+	user, err := app.Models.User.GetOne(id)
+	if err != nil {
+		app.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	payload := response{
+		Error:   false,
+		Message: message,
+		Data:    user,
+	}
+
+	app.WriteJSON(w, http.StatusOK, payload)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireAdminThrottled(t *testing.T) {
+	tests := []struct {
+		name string
+		// fail counts failed logins before the request
+		fail func(app *App)
+	}{
+		{name: "client", fail: func(app *App) {
+			for i := 0; i < adminFailuresPerIP; i++ {
+				app.AdminFailuresPerIP.Allow("192.0.2.1")
+			}
+		}},
+		{name: "email, in any case", fail: func(app *App) {
+			for i := 0; i < adminFailuresPerEmail; i++ {
+				app.AdminFailuresPerEmail.Allow("admin@example.com")
+			}
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &App{
+				AdminFailuresPerIP:    newThrottle(adminFailuresPerIP, adminFailureWindow),
+				AdminFailuresPerEmail: newThrottle(adminFailuresPerEmail, adminFailureWindow),
+			}
+			tt.fail(app)
+
+			// the app has no database, so reaching the password check would panic
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				t.Error("a throttled login got through")
+			})
+
+			r := httptest.NewRequest("GET", "/admin/users", nil)
+			r.RemoteAddr = "192.0.2.1:5000"
+			r.SetBasicAuth("Admin@Example.com", "guess")
+			w := httptest.NewRecorder()
+			app.requireAdmin(next).ServeHTTP(w, r)
+
+			if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+				t.Errorf("status = %d, Retry-After %q; want a 429 with Retry-After", w.Code, w.Header().Get("Retry-After"))
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Limits on how many users one page of a listing holds
+const (
+	DefaultPerPage = 20
+	MaxPerPage     = 100
+)
+
+// ErrUnknownSort is returned when a listing is asked to sort by a field it can't
+var ErrUnknownSort = errors.New("unknown sort field")
+
+// sortColumns maps the fields a listing can be sorted by to their columns
+var sortColumns = map[string]string{
+	"id":         "id",
+	"email":      "email",
+	"first_name": "first_name",
+	"last_name":  "last_name",
+	"created_at": "created_at",
+	"updated_at": "updated_at",
+}
+
+// UserFilter selects, orders and pages a listing of users. Zero values mean "any" for
+// the filters and the defaults for the rest.
+type UserFilter struct {
+	// Search matches part of the email, first or last name, ignoring case
+	Search string
+	Active *bool
+	Role   string
+
+	// Sort names the field to order by, defaulting to id
+	Sort string
+	Desc bool
+
+	Page    int
+	PerPage int
+}
+
+// normalize fills in defaults and clamps the paging
+func (f *UserFilter) normalize() error {
+	if f.Sort == "" {
+		f.Sort = "id"
+	}
+	if _, ok := sortColumns[f.Sort]; !ok {
+		return fmt.Errorf("%w %q", ErrUnknownSort, f.Sort)
+	}
+
+	if f.Page < 1 {
+		f.Page = 1
+	}
+	if f.PerPage < 1 {
+		f.PerPage = DefaultPerPage
+	}
+	if f.PerPage > MaxPerPage {
+		f.PerPage = MaxPerPage
+	}
+
+	return nil
+}
+
+// UserPage is one page of a listing of users
+type UserPage struct {
+	Users      []*User `json:"users"`
+	Page       int     `json:"page"`
+	PerPage    int     `json:"per_page"`
+	Total      int     `json:"total"`
+	TotalPages int     `json:"total_pages"`
+}
+
+// List returns one page of the users matching filter, and how many match in total
+func (u *User) List(filter UserFilter) (*UserPage, error) {
+	err := filter.normalize()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var where []string
+	var args []any
+
+	if filter.Search != "" {
+		args = append(args, "%"+escapeLike(filter.Search)+"%")
+		n := len(args)
+		where = append(where, fmt.Sprintf("(email ilike $%d or first_name ilike $%d or last_name ilike $%d)", n, n, n))
+	}
+	if filter.Active != nil {
+		active := 0
+		if *filter.Active {
+			active = 1
+		}
+		args = append(args, active)
+		where = append(where, fmt.Sprintf("user_active = $%d", len(args)))
+	}
+	if filter.Role != "" {
+		args = append(args, filter.Role)
+		where = append(where, fmt.Sprintf("user_role = $%d", len(args)))
+	}
+
+	conditions := ""
+	if len(where) > 0 {
+		conditions = " where " + strings.Join(where, " and ")
+	}
+
+	var total int
+	err = db.QueryRowContext(ctx, "select count(*) from users"+conditions, args...).Scan(&total)
+	if err != nil {
+		return nil, err
+	}
+
+	order := "asc"
+	if filter.Desc {
+		order = "desc"
+	}
+
+	// the sort column comes from sortColumns, never from the caller directly
+	query := `select id, email, first_name, last_name, password, user_active, user_role, created_at, updated_at
+	from users` + conditions +
+		fmt.Sprintf(" order by %s %s, id %s limit $%d offset $%d", sortColumns[filter.Sort], order, order, len(args)+1, len(args)+2)
+	args = append(args, filter.PerPage, (filter.Page-1)*filter.PerPage)
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []*User{}
+
+	for rows.Next() {
+		var user User
+		err := rows.Scan(
+			&user.ID,
+			&user.Email,
+			&user.FirstName,
+			&user.LastName,
+			&user.Password,
+			&user.Active,
+			&user.Role,
+			&user.CreatedAt,
+			&user.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		users = append(users, &user)
+	}
+
+	page := &UserPage{
+		Users:      users,
+		Page:       filter.Page,
+		PerPage:    filter.PerPage,
+		Total:      total,
+		TotalPages: (total + filter.PerPage - 1) / filter.PerPage,
+	}
+
+	return page, rows.Err()
+}
+
+// escapeLike escapes the characters ilike treats specially
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
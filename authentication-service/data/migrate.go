@@ -0,0 +1,324 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrationTimeout bounds one run of the migrations; schema changes on a big table can
+// take far longer than an ordinary query
+const migrationTimeout = 5 * time.Minute
+
+// migrationLock is the key of the advisory lock held while migrating, so that replicas
+// starting together don't run the same migration twice
+const migrationLock = 727_001
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationName matches the files in migrations: 0001_create_users.up.sql
+var migrationName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// irreversibleMarker starts the down file of a migration that must never be undone
+const irreversibleMarker = "-- irreversible"
+
+// ErrIrreversible is returned by MigrateDown when it would have to undo a migration
+// that can't be undone
+var ErrIrreversible = errors.New("migration can't be undone")
+
+// Migration is one versioned change to the schema and the SQL that undoes it.
+type Migration struct {
+	Version int    `json:"version"`
+	Name    string `json:"name"`
+	Up      string `json:"-"`
+	Down    string `json:"-"`
+	// Irreversible migrations have a down file that starts with "-- irreversible" and
+	// says why; rolling back past them is refused
+	Irreversible bool `json:"irreversible,omitempty"`
+}
+
+// MigrationState is a migration and when it was applied, if it has been.
+type MigrationState struct {
+	Migration
+	AppliedAt *time.Time `json:"applied_at,omitempty"`
+	// Unknown is set for versions the database has but this build doesn't ship
+	Unknown bool `json:"unknown,omitempty"`
+}
+
+// Migrations returns the migrations embedded in the service, oldest first
+func Migrations() ([]Migration, error) {
+	return parseMigrations(migrationFiles)
+}
+
+// parseMigrations reads the migrations in the migrations directory of fsys
+func parseMigrations(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		m := migrationName.FindStringSubmatch(entry.Name())
+		if m == nil {
+			return nil, fmt.Errorf("migration %s: name must look like 0001_name.up.sql", entry.Name())
+		}
+
+		version, _ := strconv.Atoi(m[1])
+		body, err := fs.ReadFile(fsys, "migrations/"+entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = migration
+		} else if migration.Name != m[2] {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, migration.Name, m[2])
+		}
+
+		if m[3] == "up" {
+			migration.Up = string(body)
+		} else {
+			migration.Down = string(body)
+			migration.Irreversible = strings.HasPrefix(strings.TrimSpace(migration.Down), irreversibleMarker)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if strings.TrimSpace(migration.Up) == "" || strings.TrimSpace(migration.Down) == "" {
+			return nil, fmt.Errorf("migration %d_%s needs both an up and a down file", migration.Version, migration.Name)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	return migrations, nil
+}
+
+// withMigrationLock runs fn on a connection holding the migration lock, after making
+// sure the table that records applied migrations exists
+func withMigrationLock(fn func(ctx context.Context, conn *sql.Conn) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), migrationTimeout)
+	defer cancel()
+
+	// advisory locks belong to a session, so everything has to happen on one connection
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, `select pg_advisory_lock($1)`, migrationLock)
+	if err != nil {
+		return err
+	}
+	defer conn.ExecContext(context.Background(), `select pg_advisory_unlock($1)`, migrationLock)
+
+	_, err = conn.ExecContext(ctx, `create table if not exists schema_migrations (
+		version integer primary key,
+		name varchar(255) not null,
+		applied_at timestamp not null
+	)`)
+	if err != nil {
+		return err
+	}
+
+	return fn(ctx, conn)
+}
+
+// queryer is a *sql.DB or a *sql.Conn
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// appliedMigrations returns when each applied version was applied, and its name
+func appliedMigrations(ctx context.Context, conn queryer) (map[int]MigrationState, error) {
+	rows, err := conn.QueryContext(ctx, `select version, name, applied_at from schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]MigrationState)
+	for rows.Next() {
+		var state MigrationState
+		var at time.Time
+		err := rows.Scan(&state.Version, &state.Name, &at)
+		if err != nil {
+			return nil, err
+		}
+		state.AppliedAt = &at
+		applied[state.Version] = state
+	}
+
+	return applied, rows.Err()
+}
+
+// runMigration runs one migration step and records it in a single transaction, so that
+// a failing migration leaves nothing half done
+func runMigration(ctx context.Context, conn *sql.Conn, stmt, record string, args ...any) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, stmt)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, record, args...)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// MigrateUp applies every migration that hasn't been applied yet, oldest first, and
+// returns the ones it applied
+func MigrateUp() ([]Migration, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+	err = withMigrationLock(func(ctx context.Context, conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range migrations {
+			if _, ok := applied[m.Version]; ok {
+				continue
+			}
+
+			err := runMigration(ctx, conn, m.Up,
+				`insert into schema_migrations (version, name, applied_at) values ($1, $2, $3)`,
+				m.Version, m.Name, time.Now())
+			if err != nil {
+				return fmt.Errorf("migration %d_%s: %w", m.Version, m.Name, err)
+			}
+			done = append(done, m)
+		}
+
+		return nil
+	})
+
+	return done, err
+}
+
+// MigrateDown undoes the latest steps applied migrations, newest first, and returns the
+// ones it undid. If any of them is irreversible nothing is undone.
+func MigrateDown(steps int) ([]Migration, error) {
+	if steps < 1 {
+		return nil, errors.New("steps must be at least 1")
+	}
+
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+	err = withMigrationLock(func(ctx context.Context, conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		known := make(map[int]bool, len(migrations))
+		for _, m := range migrations {
+			known[m.Version] = true
+		}
+		for version, state := range applied {
+			if !known[version] {
+				return fmt.Errorf("migration %d_%s was applied by a newer build and can't be undone by this one", version, state.Name)
+			}
+		}
+
+		var plan []Migration
+		for i := len(migrations) - 1; i >= 0 && len(plan) < steps; i-- {
+			if _, ok := applied[migrations[i].Version]; ok {
+				plan = append(plan, migrations[i])
+			}
+		}
+		for _, m := range plan {
+			if m.Irreversible {
+				return fmt.Errorf("%w: %d_%s; its down file says why", ErrIrreversible, m.Version, m.Name)
+			}
+		}
+
+		for _, m := range plan {
+			err := runMigration(ctx, conn, m.Down, `delete from schema_migrations where version = $1`, m.Version)
+			if err != nil {
+				return fmt.Errorf("migration %d_%s: %w", m.Version, m.Name, err)
+			}
+			done = append(done, m)
+		}
+
+		return nil
+	})
+
+	return done, err
+}
+
+// MigrationStatus lists every migration, known to this build or applied to the
+// database, and whether it has been applied. It only reads: it takes no lock and, on a
+// database that has never been migrated, reports everything as pending.
+func MigrationStatus() ([]MigrationState, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var table sql.NullString
+	err = db.QueryRowContext(ctx, `select to_regclass('schema_migrations')::text`).Scan(&table)
+	if err != nil {
+		return nil, err
+	}
+
+	applied := make(map[int]MigrationState)
+	if table.Valid {
+		applied, err = appliedMigrations(ctx, db)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var states []MigrationState
+	for _, m := range migrations {
+		state := MigrationState{Migration: m}
+		if a, ok := applied[m.Version]; ok {
+			state.AppliedAt = a.AppliedAt
+			delete(applied, m.Version)
+		}
+		states = append(states, state)
+	}
+
+	for _, a := range applied {
+		a.Unknown = true
+		states = append(states, a)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Version < states[j].Version })
+
+	return states, nil
+}
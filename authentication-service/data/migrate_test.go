@@ -0,0 +1,92 @@
+package data
+
+import (
+	"testing"
+	"testing/fstest"
+)
+
+func TestParseMigrations(t *testing.T) {
+	tests := []struct {
+		name         string
+		files        map[string]string
+		versions     []int
+		irreversible []bool
+		wantErr      bool
+	}{
+		{
+			name: "sorted by version",
+			files: map[string]string{
+				"0002_add_role.up.sql":       "alter table users add column role text;",
+				"0002_add_role.down.sql":     "alter table users drop column role;",
+				"0001_create_users.up.sql":   "create table users (id serial);",
+				"0001_create_users.down.sql": "-- irreversible: the baseline\n",
+			},
+			versions:     []int{1, 2},
+			irreversible: []bool{true, false},
+		},
+		{
+			name:     "marker after leading blank lines",
+			files:    map[string]string{"0001_a.up.sql": "select 1;", "0001_a.down.sql": "\n\n-- irreversible\n"},
+			versions: []int{1}, irreversible: []bool{true},
+		},
+		{
+			name:     "other comments don't make it irreversible",
+			files:    map[string]string{"0001_a.up.sql": "select 1;", "0001_a.down.sql": "-- undo\nselect 1;"},
+			versions: []int{1}, irreversible: []bool{false},
+		},
+		{name: "missing down file", files: map[string]string{"0001_a.up.sql": "select 1;"}, wantErr: true},
+		{name: "empty down file", files: map[string]string{"0001_a.up.sql": "select 1;", "0001_a.down.sql": "  \n"}, wantErr: true},
+		{name: "bad file name", files: map[string]string{"create_users.sql": "select 1;"}, wantErr: true},
+		{
+			name:    "one version with two names",
+			files:   map[string]string{"0001_a.up.sql": "select 1;", "0001_b.down.sql": "select 1;"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := fstest.MapFS{}
+			for name, body := range tt.files {
+				fsys["migrations/"+name] = &fstest.MapFile{Data: []byte(body)}
+			}
+
+			migrations, err := parseMigrations(fsys)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseMigrations = %v, want an error", migrations)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(migrations) != len(tt.versions) {
+				t.Fatalf("got %d migrations, want %d", len(migrations), len(tt.versions))
+			}
+			for i, m := range migrations {
+				if m.Version != tt.versions[i] || m.Irreversible != tt.irreversible[i] {
+					t.Errorf("migration %d = %d_%s irreversible %v, want version %d irreversible %v",
+						i, m.Version, m.Name, m.Irreversible, tt.versions[i], tt.irreversible[i])
+				}
+			}
+		})
+	}
+}
+
+func TestEmbeddedMigrations(t *testing.T) {
+	migrations, err := Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(migrations) == 0 || migrations[0].Version != 1 || !migrations[0].Irreversible {
+		t.Fatalf("the baseline migration must come first and be irreversible: %+v", migrations)
+	}
+	for _, m := range migrations[1:] {
+		if m.Irreversible {
+			t.Errorf("%d_%s is marked irreversible", m.Version, m.Name)
+		}
+	}
+}
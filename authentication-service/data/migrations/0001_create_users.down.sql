@@ -0,0 +1,2 @@
+-- irreversible: the users table predates the migrations and holds every account, so
+-- the baseline is never rolled back; drop the table by hand if that is really meant.
@@ -0,0 +1,11 @@
+-- The users table predates the migrations, so this leaves an existing one alone.
+create table if not exists users (
+    id serial primary key,
+    email varchar(255) not null unique,
+    first_name varchar(255) not null default '',
+    last_name varchar(255) not null default '',
+    password varchar(60) not null,
+    user_active integer not null default 0,
+    created_at timestamp not null default now(),
+    updated_at timestamp not null default now()
+);
@@ -0,0 +1 @@
+alter table users add column if not exists user_role varchar(20) not null default 'user';
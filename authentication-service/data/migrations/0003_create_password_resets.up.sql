@@ -0,0 +1,10 @@
+create table if not exists password_resets (
+    id serial primary key,
+    user_id integer not null references users (id) on delete cascade,
+    token_hash char(64) not null unique,
+    expires_at timestamp not null,
+    used_at timestamp,
+    created_at timestamp not null
+);
+
+create index if not exists password_resets_user_id_idx on password_resets (user_id);
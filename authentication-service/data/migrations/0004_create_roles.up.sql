@@ -0,0 +1,46 @@
+-- Roles group permissions. A user has the role in users.user_role plus any assigned
+-- in user_roles.
+create table if not exists roles (
+    id serial primary key,
+    name varchar(50) not null unique,
+    description varchar(255) not null default '',
+    created_at timestamp not null default now()
+);
+
+-- A permission allows an action on a resource; '*' matches any.
+create table if not exists permissions (
+    id serial primary key,
+    action varchar(100) not null,
+    resource varchar(255) not null default '*',
+    unique (action, resource)
+);
+
+create table if not exists role_permissions (
+    role_id integer not null references roles (id) on delete cascade,
+    permission_id integer not null references permissions (id) on delete cascade,
+    primary key (role_id, permission_id)
+);
+
+create table if not exists user_roles (
+    user_id integer not null references users (id) on delete cascade,
+    role_id integer not null references roles (id) on delete cascade,
+    primary key (user_id, role_id)
+);
+
+insert into roles (name, description) values
+    ('user', 'Every account'),
+    ('admin', 'Manages users and roles; may do anything')
+on conflict (name) do nothing;
+
+insert into permissions (action, resource) values
+    ('*', '*'),
+    ('log', '*'),
+    ('mail', '*')
+on conflict (action, resource) do nothing;
+
+insert into role_permissions (role_id, permission_id)
+select r.id, p.id
+from roles r, permissions p
+where (r.name = 'admin' and p.action = '*' and p.resource = '*')
+   or (r.name = 'user' and p.action in ('log', 'mail') and p.resource = '*')
+on conflict do nothing;
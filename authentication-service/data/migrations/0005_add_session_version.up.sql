@@ -0,0 +1,3 @@
+-- Tokens carry the session version they were issued under. Bumping it ends every
+-- session the user has, across every broker.
+alter table users add column if not exists session_version integer not null default 1;
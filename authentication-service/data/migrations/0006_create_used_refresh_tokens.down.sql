@@ -0,0 +1 @@
+drop table if exists used_refresh_tokens;
@@ -0,0 +1,10 @@
+-- Refresh tokens can be exchanged once. Every broker records the IDs of the ones it
+-- exchanged here, until they expire, so a token can't be used again on another broker.
+create table if not exists used_refresh_tokens (
+    token_id varchar(64) primary key,
+    user_id integer not null references users (id) on delete cascade,
+    expires_at timestamp not null,
+    used_at timestamp not null
+);
+
+create index if not exists used_refresh_tokens_expires_at_idx on used_refresh_tokens (expires_at);
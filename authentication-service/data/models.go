@@ -20,7 +20,9 @@ func New(dbPool *sql.DB) Models {
 	db = dbPool
 
 	return Models{
-		User: User{},
+		User:  User{},
+		Reset: PasswordReset{},
+		Role:  Role{},
 	}
 }
 
@@ -28,9 +30,17 @@ func New(dbPool *sql.DB) Models {
 // in this type is available to us throughout the application, anywhere that the
 // app variable is used, provided that the model is also added in the New function.
 type Models struct {
-	User User
+	User  User
+	Reset PasswordReset
+	Role  Role
 }
 
+// Roles a user can have.
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
 // User is the structure which holds one user from the database.
 type User struct {
 	ID        int       `json:"id"`
@@ -39,6 +49,7 @@ type User struct {
 	LastName  string    `json:"last_name,omitempty"`
 	Password  string    `json:"-"`
 	Active    int       `json:"active"`
+	Role      string    `json:"role"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 }
@@ -48,7 +59,7 @@ func (u *User) GetAll() ([]*User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	query := `select id, email, first_name, last_name, password, user_active, created_at, updated_at
+	query := `select id, email, first_name, last_name, password, user_active, user_role, created_at, updated_at
 	from users order by last_name`
 
 	rows, err := db.QueryContext(ctx, query)
@@ -68,6 +79,7 @@ func (u *User) GetAll() ([]*User, error) {
 			&user.LastName,
 			&user.Password,
 			&user.Active,
+			&user.Role,
 			&user.CreatedAt,
 			&user.UpdatedAt,
 		)
@@ -87,7 +99,7 @@ func (u *User) GetByEmail(email string) (*User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	query := `select id, email, first_name, last_name, password, user_active, created_at, updated_at from users where email = $1`
+	query := `select id, email, first_name, last_name, password, user_active, user_role, created_at, updated_at from users where email = $1`
 
 	var user User
 	row := db.QueryRowContext(ctx, query, email)
@@ -99,6 +111,7 @@ func (u *User) GetByEmail(email string) (*User, error) {
 		&user.LastName,
 		&user.Password,
 		&user.Active,
+		&user.Role,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 	)
@@ -115,7 +128,7 @@ func (u *User) GetOne(id int) (*User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	query := `select id, email, first_name, last_name, password, user_active, created_at, updated_at from users where id = $1`
+	query := `select id, email, first_name, last_name, password, user_active, user_role, created_at, updated_at from users where id = $1`
 
 	var user User
 	row := db.QueryRowContext(ctx, query, id)
@@ -127,6 +140,7 @@ func (u *User) GetOne(id int) (*User, error) {
 		&user.LastName,
 		&user.Password,
 		&user.Active,
+		&user.Role,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 	)
@@ -149,8 +163,9 @@ func (u *User) Update() error {
 		first_name = $2,
 		last_name = $3,
 		user_active = $4,
-		updated_at = $5
-		where id = $6
+		user_role = $5,
+		updated_at = $6
+		where id = $7
 	`
 
 	_, err := db.ExecContext(ctx, stmt,
@@ -158,6 +173,7 @@ func (u *User) Update() error {
 		u.FirstName,
 		u.LastName,
 		u.Active,
+		u.Role,
 		time.Now(),
 		u.ID,
 	)
@@ -209,9 +225,13 @@ func (u *User) Insert(user User) (int, error) {
 		return 0, err
 	}
 
+	if user.Role == "" {
+		user.Role = RoleUser
+	}
+
 	var newID int
-	stmt := `insert into users (email, first_name, last_name, password, user_active, created_at, updated_at)
-		values ($1, $2, $3, $4, $5, $6, $7) returning id`
+	stmt := `insert into users (email, first_name, last_name, password, user_active, user_role, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8) returning id`
 
 	err = db.QueryRowContext(ctx, stmt,
 		user.Email,
@@ -219,6 +239,7 @@ func (u *User) Insert(user User) (int, error) {
 		user.LastName,
 		hashedPassword,
 		user.Active,
+		user.Role,
 		time.Now(),
 		time.Now(),
 	).Scan(&newID)
@@ -230,7 +251,8 @@ func (u *User) Insert(user User) (int, error) {
 	return newID, nil
 }
 
-// ResetPassword is the method we will use to change a user's password.
+// ResetPassword is the method we will use to change a user's password. It also ends
+// every session the user had, so a stolen password stops working everywhere.
 func (u *User) ResetPassword(password string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
@@ -240,8 +262,9 @@ func (u *User) ResetPassword(password string) error {
 		return err
 	}
 
-	stmt := `update users set password = $1 where id = $2`
-	_, err = db.ExecContext(ctx, stmt, hashedPassword, u.ID)
+	stmt := `update users set password = $1, updated_at = $2, session_version = session_version + 1
+		where id = $3`
+	_, err = db.ExecContext(ctx, stmt, hashedPassword, time.Now(), u.ID)
 	if err != nil {
 		return err
 	}
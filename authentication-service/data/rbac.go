@@ -0,0 +1,299 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Any matches every action or resource in a permission
+const Any = "*"
+
+// Admins are the users whose roles allow ActionAdmin on ResourceAuth. The admin role
+// allows everything, so it makes its holders admins; other roles can too.
+const (
+	ActionAdmin  = "admin"
+	ResourceAuth = "auth"
+)
+
+// Errors returned by the role methods.
+var (
+	ErrUnknownRole = errors.New("unknown role")
+	ErrBuiltinRole = errors.New("built-in roles can't be deleted")
+)
+
+// Permission allows an action on a resource. Either may be Any.
+type Permission struct {
+	Action   string `json:"action"`
+	Resource string `json:"resource"`
+}
+
+// Allows reports whether p covers action on resource
+func (p Permission) Allows(action, resource string) bool {
+	return (p.Action == Any || p.Action == action) && (p.Resource == Any || p.Resource == resource)
+}
+
+// Role is a named set of permissions that can be given to users.
+type Role struct {
+	ID          int          `json:"id"`
+	Name        string       `json:"name"`
+	Description string       `json:"description"`
+	Permissions []Permission `json:"permissions"`
+	CreatedAt   time.Time    `json:"created_at"`
+}
+
+// Builtin reports whether the role is one users.user_role can hold, which the
+// service relies on
+func (r *Role) Builtin() bool {
+	return r.Name == RoleUser || r.Name == RoleAdmin
+}
+
+// GetAll returns every role with its permissions, sorted by name
+func (r *Role) GetAll() ([]*Role, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select r.id, r.name, r.description, r.created_at, p.action, p.resource
+	from roles r
+	left join role_permissions rp on rp.role_id = r.id
+	left join permissions p on p.id = rp.permission_id
+	order by r.name, p.action, p.resource`
+
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var roles []*Role
+	for rows.Next() {
+		var role Role
+		var action, resource sql.NullString
+		err := rows.Scan(&role.ID, &role.Name, &role.Description, &role.CreatedAt, &action, &resource)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(roles) == 0 || roles[len(roles)-1].ID != role.ID {
+			role.Permissions = []Permission{}
+			roles = append(roles, &role)
+		}
+		if action.Valid {
+			last := roles[len(roles)-1]
+			last.Permissions = append(last.Permissions, Permission{Action: action.String, Resource: resource.String})
+		}
+	}
+
+	return roles, rows.Err()
+}
+
+// GetByName returns one role with its permissions
+func (r *Role) GetByName(name string) (*Role, error) {
+	roles, err := r.GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, role := range roles {
+		if role.Name == name {
+			return role, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w %q", ErrUnknownRole, name)
+}
+
+// Save creates role, or updates the description of the role with its name, and sets
+// its permissions to exactly role.Permissions
+func (r *Role) Save(role Role) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var roleID int
+	stmt := `insert into roles (name, description, created_at) values ($1, $2, $3)
+		on conflict (name) do update set description = excluded.description
+		returning id`
+
+	err = tx.QueryRowContext(ctx, stmt, role.Name, role.Description, time.Now()).Scan(&roleID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from role_permissions where role_id = $1`, roleID)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range role.Permissions {
+		var permissionID int
+		stmt := `insert into permissions (action, resource) values ($1, $2)
+			on conflict (action, resource) do update set action = excluded.action
+			returning id`
+
+		err = tx.QueryRowContext(ctx, stmt, p.Action, p.Resource).Scan(&permissionID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `insert into role_permissions (role_id, permission_id) values ($1, $2)
+			on conflict do nothing`, roleID, permissionID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// DeleteByName deletes a role, taking it away from every user who had it
+func (r *Role) DeleteByName(name string) error {
+	if (&Role{Name: name}).Builtin() {
+		return ErrBuiltinRole
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	res, err := db.ExecContext(ctx, `delete from roles where name = $1`, name)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("%w %q", ErrUnknownRole, name)
+	}
+
+	return nil
+}
+
+// userRoleIDs selects the ids of the roles a user has: the one in users.user_role and
+// those assigned in user_roles. The user's id is $1.
+const userRoleIDs = `select r.id from roles r join users u on u.user_role = r.name where u.id = $1
+	union
+	select role_id from user_roles where user_id = $1`
+
+// Roles returns the names of every role the user has, sorted
+func (u *User) Roles() ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, `select name from roles where id in (`+userRoleIDs+`) order by name`, u.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []string{}
+	for rows.Next() {
+		var name string
+		err := rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, name)
+	}
+
+	return roles, rows.Err()
+}
+
+// Permissions returns every permission the user has through their roles
+func (u *User) Permissions() ([]Permission, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select distinct p.action, p.resource
+	from permissions p
+	join role_permissions rp on rp.permission_id = p.id
+	where rp.role_id in (` + userRoleIDs + `)
+	order by p.action, p.resource`
+
+	rows, err := db.QueryContext(ctx, query, u.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := []Permission{}
+	for rows.Next() {
+		var p Permission
+		err := rows.Scan(&p.Action, &p.Resource)
+		if err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, p)
+	}
+
+	return permissions, rows.Err()
+}
+
+// Can reports whether any of the user's roles allows action on resource
+func (u *User) Can(action, resource string) (bool, error) {
+	permissions, err := u.Permissions()
+	if err != nil {
+		return false, err
+	}
+
+	for _, p := range permissions {
+		if p.Allows(action, resource) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// SetRoles replaces the roles assigned to the user in user_roles with names. The role
+// in users.user_role is kept either way.
+func (u *User) SetRoles(names []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	names = append([]string(nil), names...)
+	sort.Strings(names)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `delete from user_roles where user_id = $1`, u.ID)
+	if err != nil {
+		return err
+	}
+
+	for i, name := range names {
+		if i > 0 && names[i-1] == name {
+			continue
+		}
+
+		res, err := tx.ExecContext(ctx, `insert into user_roles (user_id, role_id)
+			select $1, id from roles where name = $2`, u.ID, name)
+		if err != nil {
+			return err
+		}
+
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("%w %q", ErrUnknownRole, name)
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,139 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrResetInvalid is returned for a reset token that is unknown, expired or used
+var ErrResetInvalid = errors.New("invalid or expired reset token")
+
+// PasswordReset is a single-use token that lets a user choose a new password. Only a
+// hash of the token is stored, so the table can't be used to take over accounts.
+type PasswordReset struct {
+	ID        int        `json:"id"`
+	UserID    int        `json:"user_id"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// hashResetToken returns what is stored for raw
+func hashResetToken(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+// Create issues a reset token for userID that is valid for ttl and returns it. Any
+// token issued to the user before stops working.
+func (p *PasswordReset) Create(userID int, ttl time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	raw := base64.RawURLEncoding.EncodeToString(b)
+
+	now := time.Now()
+
+	// clear out tokens nobody can use anymore
+	_, err = db.ExecContext(ctx, `delete from password_resets where expires_at < $1`, now)
+	if err != nil {
+		return "", err
+	}
+
+	err = p.InvalidateAll(userID)
+	if err != nil {
+		return "", err
+	}
+
+	stmt := `insert into password_resets (user_id, token_hash, expires_at, created_at)
+		values ($1, $2, $3, $4)`
+
+	_, err = db.ExecContext(ctx, stmt, userID, hashResetToken(raw), now.Add(ttl), now)
+	if err != nil {
+		return "", err
+	}
+
+	return raw, nil
+}
+
+// Redeem sets password for the user raw was issued to and returns their ID. In one
+// transaction it uses up raw and every other reset token of the user, and moves the user
+// to a new session version, so a token is only spent when the password changes and can
+// only be redeemed once, even by concurrent requests.
+func (p *PasswordReset) Redeem(raw, password string) (int, error) {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 12)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+
+	stmt := `update password_resets set used_at = $1
+		where token_hash = $2 and used_at is null and expires_at > $1
+		returning user_id`
+
+	var userID int
+	err = tx.QueryRowContext(ctx, stmt, now, hashResetToken(raw)).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrResetInvalid
+	} else if err != nil {
+		return 0, err
+	}
+
+	stmt = `update users set password = $1, updated_at = $2, session_version = session_version + 1
+		where id = $3`
+	res, err := tx.ExecContext(ctx, stmt, hashedPassword, now, userID)
+	if err != nil {
+		return 0, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return 0, err
+	} else if n == 0 {
+		return 0, ErrResetInvalid
+	}
+
+	_, err = tx.ExecContext(ctx, `update password_resets set used_at = $1 where user_id = $2 and used_at is null`, now, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+
+	return userID, nil
+}
+
+// InvalidateAll marks every unused reset token of userID as used
+func (p *PasswordReset) InvalidateAll(userID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update password_resets set used_at = $1 where user_id = $2 and used_at is null`
+
+	_, err := db.ExecContext(ctx, stmt, time.Now(), userID)
+	return err
+}
@@ -0,0 +1,87 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrRefreshUsed is returned for a refresh token that has already been exchanged
+var ErrRefreshUsed = errors.New("refresh token has already been used")
+
+// Session is what a token is checked against: tokens issued under an older Version, or
+// to a user who is no longer active, are refused.
+type Session struct {
+	UserID  int  `json:"user_id"`
+	Version int  `json:"version"`
+	Active  bool `json:"active"`
+}
+
+// GetSession returns the session state of the user with id
+func (u *User) GetSession(id int) (*Session, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, session_version, user_active = 1 from users where id = $1`
+
+	var s Session
+	err := db.QueryRowContext(ctx, query, id).Scan(&s.UserID, &s.Version, &s.Active)
+	if err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+// RevokeSessions ends every session the user has by moving them to a new session
+// version, and returns their session state
+func (u *User) RevokeSessions() (*Session, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update users set session_version = session_version + 1 where id = $1
+		returning id, session_version, user_active = 1`
+
+	var s Session
+	err := db.QueryRowContext(ctx, stmt, u.ID).Scan(&s.UserID, &s.Version, &s.Active)
+	if err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+// UseRefreshToken records that the user exchanged the refresh token with ID tokenID,
+// which is valid until expires. It returns ErrRefreshUsed if the token was exchanged
+// before, even by a concurrent request.
+func (u *User) UseRefreshToken(tokenID string, expires time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	now := time.Now()
+
+	// an expired token is refused anyway, so there is no need to remember it
+	_, err := db.ExecContext(ctx, `delete from used_refresh_tokens where expires_at < $1`, now)
+	if err != nil {
+		return err
+	}
+
+	stmt := `insert into used_refresh_tokens (token_id, user_id, expires_at, used_at)
+		values ($1, $2, $3, $4)
+		on conflict (token_id) do nothing`
+
+	res, err := db.ExecContext(ctx, stmt, tokenID, u.ID, expires, now)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrRefreshUsed
+	}
+
+	return nil
+}
@@ -0,0 +1,222 @@
+// Package apikey manages the API keys machine clients use to call the broker.
+//
+// A key is shown to its owner once, when it is created; the broker only keeps a
+// SHA-256 hash of its secret. Keys look like "gmk_<id>_<secret>": the ID finds the
+// stored key, the secret proves the caller holds it. Each key carries scopes, such as
+// "mail:send", that say which actions it may run.
+package apikey
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Scopes a key can be granted.
+const (
+	ScopeMailSend = "mail:send"
+	ScopeLogWrite = "log:write"
+	ScopeLogRead  = "log:read"
+	// ScopeEventsRead lets a key watch the event stream
+	ScopeEventsRead = "events:read"
+)
+
+// Scopes lists every scope a key can be granted
+var Scopes = []string{ScopeMailSend, ScopeLogWrite, ScopeLogRead, ScopeEventsRead}
+
+// prefix starts every key, so that leaked keys are easy to recognise
+const prefix = "gmk_"
+
+// touchInterval is how stale LastUsedAt may get before a use is written to the store,
+// so that busy keys don't cost a write on every request
+const touchInterval = time.Minute
+
+var (
+	// ErrNotFound is returned when a store has no key with the requested ID.
+	ErrNotFound = errors.New("api key not found")
+	// ErrInvalid is returned for a key that is malformed, unknown or doesn't match.
+	ErrInvalid = errors.New("invalid api key")
+	// ErrRevoked is returned for a key that has been revoked.
+	ErrRevoked = errors.New("api key has been revoked")
+)
+
+// Key is a stored API key. The secret itself is never stored, only its hash.
+type Key struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Hash       string     `json:"hash,omitempty"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// Revoked reports whether the key has been revoked
+func (k Key) Revoked() bool {
+	return k.RevokedAt != nil
+}
+
+// Public returns the key without its hash, for showing to clients
+func (k Key) Public() Key {
+	k.Hash = ""
+	return k
+}
+
+// Store persists keys. Implementations must be safe for concurrent use.
+type Store interface {
+	Create(key Key) error
+	Get(id string) (Key, error)
+	List() ([]Key, error)
+	Update(key Key) error
+	// Touch sets LastUsedAt of the key with the given ID to at, and nothing else, in
+	// one step. Revoked keys are left alone, so a use can't race a revocation.
+	Touch(id string, at time.Time) error
+}
+
+// Manager creates, verifies and revokes keys held in a Store.
+type Manager struct {
+	store Store
+	now   func() time.Time
+}
+
+// NewManager returns a manager that keeps keys in store
+func NewManager(store Store) *Manager {
+	return &Manager{store: store, now: time.Now}
+}
+
+// Create stores a new key called name with the given scopes. It returns the stored key
+// and the full secret, which can't be recovered afterwards.
+func (m *Manager) Create(name string, scopes []string) (Key, string, error) {
+	if strings.TrimSpace(name) == "" {
+		return Key{}, "", errors.New("an api key needs a name")
+	}
+	for _, s := range scopes {
+		if !slices.Contains(Scopes, s) {
+			return Key{}, "", errors.New("unknown scope " + s)
+		}
+	}
+
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return Key{}, "", err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return Key{}, "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(secret)
+
+	scopes = slices.Clone(scopes)
+	slices.Sort(scopes)
+
+	key := Key{
+		ID:        hex.EncodeToString(id),
+		Name:      name,
+		Hash:      hash(encoded),
+		Scopes:    slices.Compact(scopes),
+		CreatedAt: m.now().UTC(),
+	}
+
+	err := m.store.Create(key)
+	if err != nil {
+		return Key{}, "", err
+	}
+
+	return key.Public(), prefix + key.ID + "_" + encoded, nil
+}
+
+// Verify checks a key presented by a client and returns it. It also records that the
+// key has been used.
+func (m *Manager) Verify(raw string) (Key, error) {
+	rest, ok := strings.CutPrefix(raw, prefix)
+	if !ok {
+		return Key{}, ErrInvalid
+	}
+	id, secret, ok := strings.Cut(rest, "_")
+	if !ok || id == "" || secret == "" {
+		return Key{}, ErrInvalid
+	}
+
+	key, err := m.store.Get(id)
+	if errors.Is(err, ErrNotFound) {
+		return Key{}, ErrInvalid
+	} else if err != nil {
+		return Key{}, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hash(secret)), []byte(key.Hash)) != 1 {
+		return Key{}, ErrInvalid
+	}
+	if key.Revoked() {
+		return Key{}, ErrRevoked
+	}
+
+	now := m.now().UTC()
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) >= touchInterval {
+		key.LastUsedAt = &now
+		// failing to record the use is no reason to turn the caller away
+		_ = m.store.Touch(key.ID, now)
+	}
+
+	return key.Public(), nil
+}
+
+// Lookup returns the key with the given ID, for work done on behalf of a key that was
+// verified earlier, such as a queued job. It doesn't record a use.
+func (m *Manager) Lookup(id string) (Key, error) {
+	key, err := m.store.Get(id)
+	if err != nil {
+		return Key{}, err
+	}
+	if key.Revoked() {
+		return Key{}, ErrRevoked
+	}
+
+	return key.Public(), nil
+}
+
+// List returns every key, revoked ones included, oldest first
+func (m *Manager) List() ([]Key, error) {
+	keys, err := m.store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	slices.SortFunc(keys, func(a, b Key) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	for i := range keys {
+		keys[i] = keys[i].Public()
+	}
+
+	return keys, nil
+}
+
+// Revoke stops the key with the given ID from being accepted. Revoking a key twice
+// keeps the time it was first revoked.
+func (m *Manager) Revoke(id string) (Key, error) {
+	key, err := m.store.Get(id)
+	if err != nil {
+		return Key{}, err
+	}
+
+	if !key.Revoked() {
+		now := m.now().UTC()
+		key.RevokedAt = &now
+		err = m.store.Update(key)
+		if err != nil {
+			return Key{}, err
+		}
+	}
+
+	return key.Public(), nil
+}
+
+func hash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
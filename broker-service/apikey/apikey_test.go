@@ -0,0 +1,305 @@
+package apikey
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCreate(t *testing.T) {
+	tests := []struct {
+		name    string
+		keyName string
+		scopes  []string
+		want    []string
+		wantErr bool
+	}{
+		{name: "scopes sorted and deduplicated", keyName: "ci", scopes: []string{ScopeMailSend, ScopeLogWrite, ScopeMailSend}, want: []string{ScopeLogWrite, ScopeMailSend}},
+		{name: "no scopes", keyName: "ci", want: []string{}},
+		{name: "unknown scope", keyName: "ci", scopes: []string{"admin"}, wantErr: true},
+		{name: "blank name", keyName: "  ", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewManager(NewMemoryStore())
+
+			key, raw, err := m.Create(tt.keyName, tt.scopes)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("Create succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !strings.HasPrefix(raw, prefix+key.ID+"_") {
+				t.Errorf("key %q doesn't start with its prefix and ID", raw)
+			}
+			if key.Hash != "" {
+				t.Error("Create returned the hash")
+			}
+			if strings.Join(key.Scopes, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("scopes = %v, want %v", key.Scopes, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	m := NewManager(NewMemoryStore())
+
+	key, raw, err := m.Create("ci", []string{ScopeMailSend})
+	if err != nil {
+		t.Fatal(err)
+	}
+	revokedKey, revokedRaw, err := m.Create("old", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = m.Revoke(revokedKey.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		raw  string
+		want error
+	}{
+		{name: "valid", raw: raw},
+		{name: "no prefix", raw: strings.TrimPrefix(raw, prefix), want: ErrInvalid},
+		{name: "no secret", raw: prefix + key.ID + "_", want: ErrInvalid},
+		{name: "wrong secret", raw: prefix + key.ID + "_nope", want: ErrInvalid},
+		{name: "unknown id", raw: prefix + "0000000000000000_" + strings.Split(raw, "_")[2], want: ErrInvalid},
+		{name: "revoked", raw: revokedRaw, want: ErrRevoked},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := m.Verify(tt.raw)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("Verify err = %v, want %v", err, tt.want)
+			}
+			if err == nil && (got.ID != key.ID || got.Hash != "") {
+				t.Errorf("Verify = %+v", got)
+			}
+		})
+	}
+}
+
+func TestVerifyRecordsUse(t *testing.T) {
+	store := NewMemoryStore()
+	m := NewManager(store)
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	m.now = func() time.Time { return now }
+
+	key, raw, err := m.Create("ci", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		after time.Duration
+		want  time.Time
+	}{
+		{after: 0, want: now},
+		{after: 30 * time.Second, want: now},
+		{after: 2 * time.Minute, want: now.Add(2 * time.Minute)},
+	}
+
+	start := now
+	for i, s := range steps {
+		now = start.Add(s.after)
+		_, err := m.Verify(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stored, err := store.Get(key.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.LastUsedAt == nil || !stored.LastUsedAt.Equal(s.want) {
+			t.Errorf("step %d: LastUsedAt = %v, want %s", i, stored.LastUsedAt, s.want)
+		}
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	m := NewManager(NewMemoryStore())
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	m.now = func() time.Time { return now }
+
+	key, _, err := m.Create("ci", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := m.Revoke(key.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !first.Revoked() || !first.RevokedAt.Equal(now) {
+		t.Fatalf("RevokedAt = %v, want %s", first.RevokedAt, now)
+	}
+
+	// revoking again keeps the first time
+	now = now.Add(time.Hour)
+	second, err := m.Revoke(key.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !second.RevokedAt.Equal(*first.RevokedAt) {
+		t.Errorf("second revoke moved RevokedAt to %s", second.RevokedAt)
+	}
+
+	_, err = m.Revoke("missing")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("Revoke of an unknown key: err = %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestTouchKeepsRevocation(t *testing.T) {
+	stores := map[string]func(t *testing.T) Store{
+		"memory": func(t *testing.T) Store { return NewMemoryStore() },
+		"bolt": func(t *testing.T) Store {
+			s, err := OpenBoltStore(filepath.Join(t.TempDir(), "keys.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { s.Close() })
+			return s
+		},
+	}
+
+	for name, open := range stores {
+		t.Run(name, func(t *testing.T) {
+			store := open(t)
+			m := NewManager(store)
+
+			key, raw, err := m.Create("ci", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = m.Revoke(key.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// a use that read the key before it was revoked must not undo the revocation
+			err = store.Touch(key.ID, time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = m.Verify(raw)
+			if !errors.Is(err, ErrRevoked) {
+				t.Errorf("Verify after Touch: err = %v, want %v", err, ErrRevoked)
+			}
+		})
+	}
+}
+
+func TestList(t *testing.T) {
+	m := NewManager(NewMemoryStore())
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	m.now = func() time.Time { return now }
+
+	for _, name := range []string{"first", "second", "third"} {
+		key, _, err := m.Create(name, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name == "second" {
+			m.Revoke(key.ID)
+		}
+		now = now.Add(time.Minute)
+	}
+
+	keys, err := m.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, k := range keys {
+		names = append(names, k.Name)
+		if k.Hash != "" {
+			t.Errorf("List returned the hash of %s", k.Name)
+		}
+	}
+	if got := strings.Join(names, ","); got != "first,second,third" {
+		t.Errorf("List = %s, want every key oldest first", got)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	store := NewMemoryStore()
+	m := NewManager(store)
+
+	key, _, err := m.Create("ci", []string{ScopeLogRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := m.Lookup(key.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Hash != "" || len(got.Scopes) != 1 {
+		t.Errorf("Lookup = %+v", got)
+	}
+	// a lookup isn't a use of the key by its client
+	if stored, _ := store.Get(key.ID); stored.LastUsedAt != nil {
+		t.Errorf("Lookup recorded a use at %s", stored.LastUsedAt)
+	}
+
+	m.Revoke(key.ID)
+	if _, err := m.Lookup(key.ID); !errors.Is(err, ErrRevoked) {
+		t.Errorf("Lookup of a revoked key: err = %v, want %v", err, ErrRevoked)
+	}
+	if _, err := m.Lookup("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Lookup of an unknown key: err = %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestBoltStoreSurvivesReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.db")
+
+	s, err := OpenBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, raw, err := NewManager(s).Create("ci", []string{ScopeMailSend})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s, err = OpenBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	got, err := NewManager(s).Verify(raw)
+	if err != nil {
+		t.Fatalf("Verify after reopening: %v", err)
+	}
+	if got.ID != key.ID || got.Scopes[0] != ScopeMailSend {
+		t.Errorf("Verify = %+v", got)
+	}
+
+	err = s.Update(Key{ID: "missing"})
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("Update of an unknown key: err = %v, want %v", err, ErrNotFound)
+	}
+}
@@ -0,0 +1,196 @@
+package apikey
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// MemoryStore keeps keys in memory. Keys are lost when the broker restarts, so it only
+// suits local development and tests.
+type MemoryStore struct {
+	mu   sync.RWMutex
+	keys map[string]Key
+}
+
+// NewMemoryStore returns an empty store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{keys: make(map[string]Key)}
+}
+
+func (s *MemoryStore) Create(key Key) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.keys[key.ID] = key
+
+	return nil
+}
+
+func (s *MemoryStore) Get(id string) (Key, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	key, ok := s.keys[id]
+	if !ok {
+		return Key{}, ErrNotFound
+	}
+
+	return key, nil
+}
+
+func (s *MemoryStore) List() ([]Key, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := make([]Key, 0, len(s.keys))
+	for _, key := range s.keys {
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+func (s *MemoryStore) Update(key Key) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.keys[key.ID]; !ok {
+		return ErrNotFound
+	}
+	s.keys[key.ID] = key
+
+	return nil
+}
+
+func (s *MemoryStore) Touch(id string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.keys[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if !key.Revoked() {
+		key.LastUsedAt = &at
+		s.keys[id] = key
+	}
+
+	return nil
+}
+
+var keysBucket = []byte("api_keys")
+
+// BoltStore keeps keys in a local BoltDB file, so they survive restarts.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// OpenBoltStore opens, or creates, the key file at path
+func OpenBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(keysBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) Create(key Key) error {
+	return s.put(key, false)
+}
+
+func (s *BoltStore) Get(id string) (Key, error) {
+	var key Key
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(keysBucket).Get([]byte(id))
+		if data == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(data, &key)
+	})
+
+	return key, err
+}
+
+func (s *BoltStore) List() ([]Key, error) {
+	var keys []Key
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(keysBucket).ForEach(func(_, data []byte) error {
+			var key Key
+			err := json.Unmarshal(data, &key)
+			if err != nil {
+				return err
+			}
+			keys = append(keys, key)
+			return nil
+		})
+	})
+
+	return keys, err
+}
+
+func (s *BoltStore) Update(key Key) error {
+	return s.put(key, true)
+}
+
+func (s *BoltStore) Touch(id string, at time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(keysBucket)
+
+		data := b.Get([]byte(id))
+		if data == nil {
+			return ErrNotFound
+		}
+
+		var key Key
+		err := json.Unmarshal(data, &key)
+		if err != nil {
+			return err
+		}
+		if key.Revoked() {
+			return nil
+		}
+
+		key.LastUsedAt = &at
+		data, err = json.Marshal(key)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(id), data)
+	})
+}
+
+// put writes key; when exists is set the key must already be stored
+func (s *BoltStore) put(key Key, exists bool) error {
+	data, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(keysBucket)
+		if exists && b.Get([]byte(key.ID)) == nil {
+			return ErrNotFound
+		}
+		return b.Put([]byte(key.ID), data)
+	})
+}
+
+// Close closes the key file
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
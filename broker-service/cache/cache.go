@@ -0,0 +1,172 @@
+// Package cache keeps the results of read actions for a while and coalesces identical
+// calls that are in flight at the same time.
+//
+// Entries are grouped by action, so that a write can make every cached result of the
+// actions it affects stale at once. The cache lives in the broker's memory; each
+// broker replica has its own.
+package cache
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// DefaultMaxEntries is how many results a cache holds before it stops storing new ones
+const DefaultMaxEntries = 10000
+
+// Outcomes of Do.
+const (
+	// Hit means the value came from the cache
+	Hit = "hit"
+	// Miss means fn was called to produce the value
+	Miss = "miss"
+	// Shared means the value came from a call another caller had in flight
+	Shared = "shared"
+)
+
+type entry struct {
+	value   any
+	expires time.Time
+}
+
+// Cache holds values per action and key until they expire or are invalidated.
+type Cache struct {
+	maxEntries int
+	group      singleflight.Group
+
+	mu      sync.Mutex
+	entries map[string]map[string]entry
+	size    int
+	// generations counts invalidations per action, so that a call that started
+	// before an invalidation doesn't store its now stale result
+	generations map[string]uint64
+	lastPrune   time.Time
+}
+
+// New returns an empty cache that holds up to maxEntries values
+func New(maxEntries int) *Cache {
+	if maxEntries <= 0 {
+		maxEntries = DefaultMaxEntries
+	}
+
+	return &Cache{
+		maxEntries:  maxEntries,
+		entries:     make(map[string]map[string]entry),
+		generations: make(map[string]uint64),
+	}
+}
+
+// Do returns the value cached for key under action if there is a fresh one. Otherwise
+// it calls fn, sharing the call with every caller that asks for the same key while it
+// runs, and caches the value for ttl if fn says it may be stored. Errors are shared but
+// never cached. Do also reports where the value came from: Hit, Miss or Shared.
+func (c *Cache) Do(action, key string, ttl time.Duration, fn func() (value any, store bool, err error)) (any, string, error) {
+	if value, ok := c.get(action, key); ok {
+		return value, Hit, nil
+	}
+
+	c.mu.Lock()
+	gen := c.generations[action]
+	c.mu.Unlock()
+
+	// callers that arrive after an invalidation don't join a call started before it
+	flight := action + "\x00" + strconv.FormatUint(gen, 10) + "\x00" + key
+	value, err, shared := c.group.Do(flight, func() (any, error) {
+		value, store, err := fn()
+		if err == nil && store {
+			c.set(action, key, value, ttl, gen)
+		}
+		return value, err
+	})
+
+	outcome := Miss
+	if shared {
+		outcome = Shared
+	}
+
+	return value, outcome, err
+}
+
+// Invalidate drops every value cached for the given actions
+func (c *Cache) Invalidate(actions ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, action := range actions {
+		c.generations[action]++
+		c.size -= len(c.entries[action])
+		delete(c.entries, action)
+	}
+}
+
+// Len returns the number of values held, including any that have expired but not yet
+// been pruned
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.size
+}
+
+func (c *Cache) get(action, key string) (any, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[action][key]
+	if !ok || time.Now().After(e.expires) {
+		return nil, false
+	}
+
+	return e.value, true
+}
+
+// set stores value unless action has been invalidated since gen was read
+func (c *Cache) set(action, key string, value any, ttl time.Duration, gen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.generations[action] != gen {
+		return
+	}
+
+	c.prune()
+
+	byKey, ok := c.entries[action]
+	if !ok {
+		byKey = make(map[string]entry)
+		c.entries[action] = byKey
+	}
+	if _, exists := byKey[key]; !exists {
+		// a full cache only means more calls downstream, so just skip storing
+		if c.size >= c.maxEntries {
+			return
+		}
+		c.size++
+	}
+
+	byKey[key] = entry{value: value, expires: time.Now().Add(ttl)}
+}
+
+// prune removes expired values, at most once a minute. c.mu must be held.
+func (c *Cache) prune() {
+	if time.Since(c.lastPrune) < time.Minute {
+		return
+	}
+	c.lastPrune = time.Now()
+
+	now := time.Now()
+	for action, byKey := range c.entries {
+		for key, e := range byKey {
+			if now.After(e.expires) {
+				delete(byKey, key)
+				c.size--
+			}
+		}
+		if len(byKey) == 0 {
+			delete(c.entries, action)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package cache
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDo(t *testing.T) {
+	tests := []struct {
+		name     string
+		ttl      time.Duration
+		store    bool
+		err      error
+		wait     time.Duration
+		outcomes []string
+	}{
+		{name: "second call is a hit", ttl: time.Minute, store: true, outcomes: []string{Miss, Hit}},
+		{name: "expired value is fetched again", ttl: time.Millisecond, store: true, wait: 5 * time.Millisecond, outcomes: []string{Miss, Miss}},
+		{name: "value fn won't store is fetched again", ttl: time.Minute, store: false, outcomes: []string{Miss, Miss}},
+		{name: "errors aren't cached", ttl: time.Minute, store: true, err: errors.New("down"), outcomes: []string{Miss, Miss}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New(0)
+			calls := 0
+			fn := func() (any, bool, error) {
+				calls++
+				return calls, tt.store, tt.err
+			}
+
+			for i, want := range tt.outcomes {
+				if i > 0 {
+					time.Sleep(tt.wait)
+				}
+
+				_, outcome, err := c.Do("logs", "k", tt.ttl, fn)
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("call %d: err = %v, want %v", i, err, tt.err)
+				}
+				if outcome != want {
+					t.Errorf("call %d: outcome = %s, want %s", i, outcome, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDoCoalesces(t *testing.T) {
+	c := New(0)
+
+	var calls atomic.Int32
+	release := make(chan struct{})
+	fn := func() (any, bool, error) {
+		calls.Add(1)
+		<-release
+		return "entries", true, nil
+	}
+
+	const callers = 5
+	outcomes := make(chan string, callers)
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, outcome, err := c.Do("logs", "k", time.Minute, fn)
+			if err != nil || value != "entries" {
+				t.Errorf("Do = %v, %v", value, err)
+			}
+			outcomes <- outcome
+		}()
+	}
+
+	// let every caller join the call in flight before it returns
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(outcomes)
+
+	if n := calls.Load(); n != 1 {
+		t.Errorf("fn called %d times, want 1", n)
+	}
+
+	counts := map[string]int{}
+	for outcome := range outcomes {
+		counts[outcome]++
+	}
+	if counts[Hit] != 0 || counts[Miss]+counts[Shared] != callers || counts[Shared] == 0 {
+		t.Errorf("outcomes = %v, want the call shared", counts)
+	}
+}
+
+func TestInvalidate(t *testing.T) {
+	c := New(0)
+	fn := func() (any, bool, error) { return "entries", true, nil }
+
+	c.Do("logs", "k", time.Minute, fn)
+	c.Do("jobs", "k", time.Minute, fn)
+	c.Invalidate("logs")
+
+	if _, outcome, _ := c.Do("logs", "k", time.Minute, fn); outcome != Miss {
+		t.Errorf("logs after Invalidate: outcome = %s, want %s", outcome, Miss)
+	}
+	if _, outcome, _ := c.Do("jobs", "k", time.Minute, fn); outcome != Hit {
+		t.Errorf("other action after Invalidate: outcome = %s, want %s", outcome, Hit)
+	}
+}
+
+func TestInvalidateDuringCall(t *testing.T) {
+	c := New(0)
+
+	// the call started before the write must not store what it read
+	c.Do("logs", "k", time.Minute, func() (any, bool, error) {
+		c.Invalidate("logs")
+		return "stale", true, nil
+	})
+
+	if c.Len() != 0 {
+		t.Fatalf("Len = %d, want 0", c.Len())
+	}
+	if _, outcome, _ := c.Do("logs", "k", time.Minute, func() (any, bool, error) { return "fresh", true, nil }); outcome != Miss {
+		t.Errorf("outcome = %s, want %s", outcome, Miss)
+	}
+}
+
+func TestMaxEntries(t *testing.T) {
+	c := New(2)
+	fn := func() (any, bool, error) { return "entries", true, nil }
+
+	for _, key := range []string{"a", "b", "c"} {
+		c.Do("logs", key, time.Minute, fn)
+	}
+
+	if c.Len() != 2 {
+		t.Errorf("Len = %d, want 2", c.Len())
+	}
+}
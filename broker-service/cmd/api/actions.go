@@ -0,0 +1,304 @@
+package main
+
+import (
+	"broker/apikey"
+	"broker/discovery"
+	"broker/event"
+	"broker/outbound"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Transports an action can use to reach its downstream service.
+const (
+	TransportHTTP = "http"
+	TransportRPC  = "rpc"
+	TransportGRPC = "grpc"
+	TransportAMQP = "amqp"
+)
+
+// Action describes one thing a client can ask the broker to do through /handle.
+//
+// Field is the top-level key of the request body that holds the action's
+// payload; it defaults to the action name, so {"action": "mail", "mail": {...}}
+// works without any extra configuration.
+type Action struct {
+	Name      string  `json:"name"`
+	Service   string  `json:"service"`
+	Transport string  `json:"transport"`
+	Field     string  `json:"field"`
+	Schema    *Schema `json:"schema"`
+	// Protected actions need a valid bearer access token or API key
+	Protected bool `json:"protected"`
+	// Scope is what an API key must be granted to run the action; actions without
+	// one can't be run with an API key
+	Scope string `json:"scope,omitempty"`
+	// CacheTTL makes a read action cacheable: successful results are kept this long
+	// per caller and payload, and identical calls in flight at once are made only once
+	CacheTTL time.Duration `json:"-"`
+	// Invalidates names the read actions whose cached results go stale when this
+	// action succeeds
+	Invalidates []string `json:"invalidates,omitempty"`
+
+	decode func(raw json.RawMessage) (any, error)
+	handle func(ctx context.Context, payload any) (responsePayload, error)
+}
+
+// ActionRegistry holds every action the broker knows how to dispatch.
+type ActionRegistry struct {
+	mu      sync.RWMutex
+	actions map[string]*Action
+}
+
+// NewActionRegistry returns an empty registry
+func NewActionRegistry() *ActionRegistry {
+	return &ActionRegistry{
+		actions: make(map[string]*Action),
+	}
+}
+
+// RegisterAction adds an action to the registry. The payload type T is used both to
+// decode the request body and to describe the action's schema to clients.
+func RegisterAction[T any](r *ActionRegistry, a Action, fn func(ctx context.Context, payload T) (responsePayload, error)) {
+	if a.Field == "" {
+		a.Field = a.Name
+	}
+
+	a.Schema = schemaFor(reflect.TypeOf((*T)(nil)).Elem())
+
+	a.decode = func(raw json.RawMessage) (any, error) {
+		var payload T
+		if len(raw) == 0 {
+			return payload, nil
+		}
+
+		err := json.Unmarshal(raw, &payload)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %q payload: %w", a.Field, err)
+		}
+
+		return payload, nil
+	}
+
+	a.handle = func(ctx context.Context, payload any) (responsePayload, error) {
+		return fn(ctx, payload.(T))
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.actions[a.Name] = &a
+}
+
+// Lookup returns the action registered under name
+func (r *ActionRegistry) Lookup(name string) (*Action, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	a, ok := r.actions[name]
+	return a, ok
+}
+
+// Names returns the names of all registered actions, sorted
+func (r *ActionRegistry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	names := make([]string, 0, len(r.actions))
+	for name := range r.actions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// All returns every registered action, sorted by name
+func (r *ActionRegistry) All() []*Action {
+	names := r.Names()
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	actions := make([]*Action, 0, len(names))
+	for _, name := range names {
+		actions = append(actions, r.actions[name])
+	}
+
+	return actions
+}
+
+// actionError carries the HTTP status an action wants to report alongside its error,
+// and optionally extra data for the client.
+type actionError struct {
+	Status int
+	Err    error
+	Data   any
+}
+
+func (e *actionError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *actionError) Unwrap() error {
+	return e.Err
+}
+
+// newActionError wraps err so that the dispatcher reports it with status
+func newActionError(status int, err error) error {
+	return &actionError{Status: status, Err: err}
+}
+
+// errorStatus returns the HTTP status to use for err, defaulting to 500
+func errorStatus(err error) int {
+	var ae *actionError
+	if errors.As(err, &ae) {
+		return ae.Status
+	}
+
+	return http.StatusInternalServerError
+}
+
+// errorResponse turns err into the status and body to send back to the client
+func errorResponse(err error) (int, responsePayload) {
+	payload := responsePayload{
+		Error:   true,
+		Message: err.Error(),
+	}
+
+	var ae *actionError
+	if errors.As(err, &ae) {
+		payload.Data = ae.Data
+	}
+
+	return errorStatus(err), payload
+}
+
+// remoteError reports a failed downstream call. An open circuit breaker, a service
+// with no endpoints or a dropped RabbitMQ connection becomes a 503 carrying the
+// original message; any other failure is reported as fallback.
+func remoteError(err error, fallback error) error {
+	if errors.Is(err, outbound.ErrCircuitOpen) || errors.Is(err, discovery.ErrNoEndpoints) || errors.Is(err, event.ErrNotConnected) {
+		return newActionError(http.StatusServiceUnavailable, err)
+	}
+
+	return fallback
+}
+
+// registerActions wires up the actions the broker ships with
+func (app *App) registerActions() {
+	RegisterAction(app.Actions, Action{
+		Name:      "auth",
+		Service:   "auth-service",
+		Transport: TransportHTTP,
+	}, app.Authenticate)
+
+	RegisterAction(app.Actions, Action{
+		Name:        "log",
+		Service:     "logger-service",
+		Transport:   app.LogTransports[0],
+		Scope:       apikey.ScopeLogWrite,
+		Invalidates: []string{"logs"},
+	}, app.LogEntry)
+
+	RegisterAction(app.Actions, Action{
+		Name:      "logs",
+		Service:   "logger-service",
+		Transport: TransportHTTP,
+		Protected: true,
+		Scope:     apikey.ScopeLogRead,
+		CacheTTL:  logsCacheTTL,
+	}, app.ReadLogs)
+
+	RegisterAction(app.Actions, Action{
+		Name:      "mail",
+		Service:   "mailer-service",
+		Transport: TransportHTTP,
+		Protected: true,
+		Scope:     apikey.ScopeMailSend,
+	}, app.SendEmail)
+}
+
+// resolve finds the action named in p and decodes its payload
+func (app *App) resolve(p RequestPayload) (*Action, any, error) {
+	action, ok := app.Actions.Lookup(p.Action)
+	if !ok {
+		return nil, nil, &actionError{
+			Status: http.StatusBadRequest,
+			Err:    fmt.Errorf("unknown action: %s", p.Action),
+			Data: map[string]any{
+				"available": app.Actions.Names(),
+			},
+		}
+	}
+
+	raw := p.Params[action.Field]
+	if errs := action.Schema.Validate(action.Field, raw); len(errs) > 0 {
+		return nil, nil, &actionError{
+			Status: http.StatusBadRequest,
+			Err:    fmt.Errorf("invalid %q payload", action.Field),
+			Data: map[string]any{
+				"errors": errs,
+			},
+		}
+	}
+
+	payload, err := action.decode(raw)
+	if err != nil {
+		return nil, nil, newActionError(http.StatusBadRequest, err)
+	}
+
+	return action, payload, nil
+}
+
+// dispatch runs the action named in p and returns the status and body to send back.
+func (app *App) dispatch(ctx context.Context, p RequestPayload) (status int, res responsePayload) {
+	action, payload, err := app.resolve(p)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	ctx, span := startActionSpan(ctx, action)
+	done := app.Metrics.TrackAction(action.Name)
+	started := time.Now()
+	defer func() {
+		done(status)
+		endSpan(span, status, res)
+		app.publishResult(action, status, res, started)
+	}()
+
+	err = app.authorize(ctx, action)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	err = app.checkLimits(ctx, action)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	res, err = app.runAction(ctx, action, payload)
+	if err != nil {
+		span.RecordError(err)
+		return errorResponse(err)
+	}
+
+	return http.StatusAccepted, res
+}
+
+// ListActions returns the action registry so that clients can discover what the broker can do
+func (app *App) ListActions(w http.ResponseWriter, r *http.Request) {
+	payload := responsePayload{
+		Error:   false,
+		Message: "available actions",
+		Data:    app.Actions.All(),
+	}
+
+	_ = app.WriteJSON(w, http.StatusOK, payload)
+}
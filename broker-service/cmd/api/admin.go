@@ -0,0 +1,156 @@
+package main
+
+import (
+	"broker/apikey"
+	"broker/event"
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Ready reports whether the broker can serve requests. It answers 503 while the
+// RabbitMQ connection is down, so that load balancers stop sending traffic until the
+// connection has been re-established.
+func (app *App) Ready(w http.ResponseWriter, r *http.Request) {
+	rabbit := app.Rabbit.Status()
+
+	status := http.StatusOK
+	payload := responsePayload{
+		Error:   false,
+		Message: "ready",
+		Data: map[string]any{
+			"rabbitmq": rabbit,
+		},
+	}
+	if app.Outbox != nil {
+		payload.Data.(map[string]any)["outbox_pending"] = app.Outbox.Len()
+		payload.Data.(map[string]any)["outbox_dead"] = app.Outbox.Dead()
+	}
+	if !rabbit.Connected {
+		status = http.StatusServiceUnavailable
+		payload.Error = true
+		payload.Message = "not ready: " + event.ErrNotConnected.Error()
+	}
+
+	_ = app.WriteJSON(w, status, payload)
+}
+
+// ListBreakers reports the circuit breaker state of every downstream service
+func (app *App) ListBreakers(w http.ResponseWriter, r *http.Request) {
+	payload := responsePayload{
+		Error:   false,
+		Message: "circuit breakers",
+		Data:    app.Outbound.Breakers(),
+	}
+
+	_ = app.WriteJSON(w, http.StatusOK, payload)
+}
+
+// ListPools reports the connections held to the logger over net/rpc and gRPC
+func (app *App) ListPools(w http.ResponseWriter, r *http.Request) {
+	payload := responsePayload{
+		Error:   false,
+		Message: "connection pools",
+		Data: map[string]any{
+			"rpc":  app.LogRPC.Status(),
+			"grpc": app.LogGRPC.Status(),
+		},
+	}
+
+	_ = app.WriteJSON(w, http.StatusOK, payload)
+}
+
+// createKeyRequest is the body of POST /admin/keys
+type createKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+// CreateKey issues a new API key. The key itself is only ever returned here.
+func (app *App) CreateKey(w http.ResponseWriter, r *http.Request) {
+	var requestPayload createKeyRequest
+
+	err := app.ReadJSON(w, r, &requestPayload)
+	if err != nil {
+		app.ErrorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	key, secret, err := app.Keys.Create(requestPayload.Name, requestPayload.Scopes)
+	if err != nil {
+		app.ErrorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	payload := responsePayload{
+		Error:   false,
+		Message: "api key created; store it now, it won't be shown again",
+		Data: map[string]any{
+			"key":     secret,
+			"api_key": key,
+		},
+	}
+
+	_ = app.WriteJSON(w, http.StatusCreated, payload)
+}
+
+// ListKeys lists every API key, without their secrets
+func (app *App) ListKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := app.Keys.List()
+	if err != nil {
+		app.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	payload := responsePayload{
+		Error:   false,
+		Message: "api keys",
+		Data:    keys,
+	}
+
+	_ = app.WriteJSON(w, http.StatusOK, payload)
+}
+
+// RevokeKey stops an API key from being accepted
+func (app *App) RevokeKey(w http.ResponseWriter, r *http.Request) {
+	key, err := app.Keys.Revoke(chi.URLParam(r, "id"))
+	if errors.Is(err, apikey.ErrNotFound) {
+		app.ErrorJSON(w, err, http.StatusNotFound)
+		return
+	} else if err != nil {
+		app.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	payload := responsePayload{
+		Error:   false,
+		Message: "api key revoked",
+		Data:    key,
+	}
+
+	_ = app.WriteJSON(w, http.StatusOK, payload)
+}
+
+// RevokeSessions invalidates every access and refresh token issued to a user so far,
+// so that they have to log in again. The auth service does the same by itself when a
+// password is reset.
+func (app *App) RevokeSessions(w http.ResponseWriter, r *http.Request) {
+	subject := chi.URLParam(r, "subject")
+
+	err := app.Sessions.Revoke(r.Context(), subject)
+	if errors.Is(err, errUnknownUser) {
+		app.ErrorJSON(w, err, http.StatusNotFound)
+		return
+	} else if err != nil {
+		app.ErrorJSON(w, err, http.StatusBadGateway)
+		return
+	}
+
+	payload := responsePayload{
+		Error:   false,
+		Message: "sessions revoked for " + subject,
+	}
+
+	_ = app.WriteJSON(w, http.StatusOK, payload)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"broker/apikey"
+	"broker/discovery"
+	"broker/outbound"
+	"broker/token"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Kinds of identity.
+const (
+	IdentityUser   = "user"
+	IdentityAPIKey = "api-key"
+)
+
+// apiKeyHeader carries the API key of a machine client
+const apiKeyHeader = "X-API-Key"
+
+// Identity is the authenticated caller of a request.
+type Identity struct {
+	Kind    string `json:"kind"`
+	Subject string `json:"sub"`
+	Email   string `json:"email,omitempty"`
+	// Scopes limits what an API key may do; users aren't limited by scope
+	Scopes []string `json:"scopes,omitempty"`
+	// Version is the session version of the token a user authenticated with
+	Version int `json:"ver,omitempty"`
+}
+
+type identityKey struct{}
+
+// withIdentity returns a copy of ctx carrying id
+func withIdentity(ctx context.Context, id Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// identityFrom returns the caller stored in ctx, if any
+func identityFrom(ctx context.Context) (Identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(Identity)
+	return id, ok
+}
+
+// authenticate is middleware that verifies an API key or a bearer access token when one
+// is sent and stores the caller's identity in the request context. Requests without
+// either pass through anonymously; protected actions reject them in authorize.
+func (app *App) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if raw := r.Header.Get(apiKeyHeader); raw != "" {
+			key, err := app.Keys.Verify(strings.TrimSpace(raw))
+			if errors.Is(err, apikey.ErrInvalid) || errors.Is(err, apikey.ErrRevoked) {
+				app.ErrorJSON(w, err, http.StatusUnauthorized)
+				return
+			} else if err != nil {
+				app.ErrorJSON(w, err, http.StatusInternalServerError)
+				return
+			}
+
+			ctx := withIdentity(r.Context(), Identity{Kind: IdentityAPIKey, Subject: key.ID, Scopes: key.Scopes})
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+
+		header := r.Header.Get("Authorization")
+		if header == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		raw, ok := strings.CutPrefix(header, "Bearer ")
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_request"`)
+			app.ErrorJSON(w, errors.New("authorization header must be a bearer token"), http.StatusUnauthorized)
+			return
+		}
+
+		claims, err := app.Tokens.Verify(r.Context(), strings.TrimSpace(raw), token.TypeAccess)
+		if errors.Is(err, token.ErrUnavailable) {
+			app.ErrorJSON(w, err, http.StatusServiceUnavailable)
+			return
+		} else if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			app.ErrorJSON(w, err, http.StatusUnauthorized)
+			return
+		}
+
+		ctx := withIdentity(r.Context(), Identity{Kind: IdentityUser, Subject: claims.Subject, Email: claims.Email, Version: claims.Version})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// authorize checks that the caller in ctx may run action. API keys may only run
+// actions that declare a scope, and only if the key was granted it.
+func (app *App) authorize(ctx context.Context, action *Action) error {
+	id, ok := identityFrom(ctx)
+
+	if ok && id.Kind == IdentityAPIKey {
+		if action.Scope == "" {
+			return newActionError(http.StatusForbidden, fmt.Errorf("action %s can't be run with an api key", action.Name))
+		}
+		if !slices.Contains(id.Scopes, action.Scope) {
+			return newActionError(http.StatusForbidden, fmt.Errorf("api key lacks the %s scope", action.Scope))
+		}
+		return nil
+	}
+
+	if action.Protected && !ok {
+		return newActionError(http.StatusUnauthorized, fmt.Errorf("action %s requires a bearer token", action.Name))
+	}
+
+	if action.Protected && app.CheckPolicy {
+		return app.checkPolicy(ctx, id, action)
+	}
+
+	return nil
+}
+
+// checkPolicy asks the auth service whether the user may run action on its service
+func (app *App) checkPolicy(ctx context.Context, id Identity, action *Action) error {
+	body, err := json.Marshal(map[string]string{
+		"subject":  id.Subject,
+		"action":   action.Name,
+		"resource": action.Service,
+	})
+	if err != nil {
+		return err
+	}
+
+	response, err := app.Outbound.Do(ctx, outbound.Request{
+		Service:    discovery.Auth,
+		Method:     "POST",
+		Path:       "/authorize",
+		Body:       body,
+		Header:     http.Header{"Authorization": {"Bearer " + app.ServiceToken}},
+		Idempotent: true,
+	})
+	if err != nil {
+		return remoteError(err, newActionError(http.StatusBadGateway, errors.New("could not check permissions")))
+	}
+	defer response.Body.Close()
+
+	var decision struct {
+		Data struct {
+			Allowed bool `json:"allowed"`
+		} `json:"data"`
+	}
+	if response.StatusCode != http.StatusOK || json.NewDecoder(response.Body).Decode(&decision) != nil {
+		return newActionError(http.StatusBadGateway, errors.New("could not check permissions"))
+	}
+
+	if !decision.Data.Allowed {
+		return newActionError(http.StatusForbidden, fmt.Errorf("not allowed to run %s", action.Name))
+	}
+
+	return nil
+}
+
+// requireAdmin is middleware that only lets through requests carrying the admin token
+// from ADMIN_TOKEN as a bearer token. Without ADMIN_TOKEN the routes it guards are off.
+func (app *App) requireAdmin(next http.Handler) http.Handler {
+	return app.requireBearer("admin", []string{os.Getenv("ADMIN_TOKEN")}, next)
+}
+
+// requireMetrics is middleware for /metrics: Prometheus scrapes with METRICS_TOKEN as a
+// bearer token, so that it doesn't need the admin token, which is accepted too
+func (app *App) requireMetrics(next http.Handler) http.Handler {
+	return app.requireBearer("metrics", []string{os.Getenv("METRICS_TOKEN"), os.Getenv("ADMIN_TOKEN")}, next)
+}
+
+// requireBearer only lets through requests whose bearer token is one of tokens. Empty
+// tokens are ignored; with none left the routes it guards are off.
+func (app *App) requireBearer(realm string, tokens []string, next http.Handler) http.Handler {
+	var accepted [][]byte
+	for _, t := range tokens {
+		if t != "" {
+			accepted = append(accepted, []byte(t))
+		}
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(accepted) == 0 {
+			app.ErrorJSON(w, fmt.Errorf("%s endpoints are disabled; no token is configured", realm), http.StatusForbidden)
+			return
+		}
+
+		if !bearerMatches(r, accepted) {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm=%q`, realm))
+			app.ErrorJSON(w, fmt.Errorf("%s token required", realm), http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// bearerMatches reports whether the bearer token of r is one of tokens
+func bearerMatches(r *http.Request, tokens [][]byte) bool {
+	raw, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	given := []byte(strings.TrimSpace(raw))
+
+	// compare against every token so the time taken doesn't tell which one is close
+	match := 0
+	for _, t := range tokens {
+		match |= subtle.ConstantTimeCompare(given, t)
+	}
+
+	return match == 1
+}
+
+// RefreshToken exchanges a refresh token for a new access and refresh token
+func (app *App) RefreshToken(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	err := app.ReadJSON(w, r, &requestPayload)
+	if err != nil {
+		app.ErrorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	pair, err := app.Tokens.Refresh(r.Context(), requestPayload.RefreshToken)
+	if errors.Is(err, token.ErrUnavailable) {
+		app.ErrorJSON(w, err, http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		app.ErrorJSON(w, err, http.StatusUnauthorized)
+		return
+	}
+
+	payload := responsePayload{
+		Error:   false,
+		Message: "token refreshed",
+		Data:    pair,
+	}
+
+	app.WriteJSON(w, http.StatusOK, payload)
+}
+
+// JWKS publishes the public key tokens are signed with, for services that verify them
+func (app *App) JWKS(w http.ResponseWriter, r *http.Request) {
+	app.WriteJSON(w, http.StatusOK, app.Tokens.JWKS())
+}
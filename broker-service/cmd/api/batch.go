@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+const (
+	// maxBatchSize caps the number of items in one /handle/batch request
+	maxBatchSize = 50
+	// batchConcurrency caps how many items of one batch run at the same time
+	batchConcurrency = 8
+)
+
+// BatchRequest is the body of a /handle/batch request.
+type BatchRequest struct {
+	Items []RequestPayload `json:"items"`
+	// Sequential runs the items one after another, in order, instead of concurrently
+	Sequential bool `json:"sequential"`
+	// StopOnFailure skips the remaining items once one has failed. Items of a
+	// concurrent batch that are already running are cancelled.
+	StopOnFailure bool `json:"stop_on_failure"`
+}
+
+// batchResult is the outcome of one item of a batch
+type batchResult struct {
+	Index   int    `json:"index"`
+	Action  string `json:"action"`
+	Status  int    `json:"status"`
+	Skipped bool   `json:"skipped,omitempty"`
+	responsePayload
+}
+
+// HandleBatch runs several actions in one request and returns one result per item
+func (app *App) HandleBatch(w http.ResponseWriter, r *http.Request) {
+	var batch BatchRequest
+
+	err := app.ReadJSON(w, r, &batch)
+	if err != nil {
+		app.ErrorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if len(batch.Items) == 0 {
+		app.ErrorJSON(w, errors.New("batch must contain at least one item"), http.StatusBadRequest)
+		return
+	}
+	if len(batch.Items) > maxBatchSize {
+		app.ErrorJSON(w, fmt.Errorf("batch must not contain more than %d items", maxBatchSize), http.StatusBadRequest)
+		return
+	}
+
+	var results []batchResult
+	if batch.Sequential {
+		results = app.runSequential(r.Context(), batch)
+	} else {
+		results = app.runConcurrent(r.Context(), batch)
+	}
+
+	failed := 0
+	for _, res := range results {
+		if res.Error {
+			failed++
+		}
+	}
+
+	payload := responsePayload{
+		Error:   failed > 0,
+		Message: fmt.Sprintf("%d of %d actions succeeded", len(results)-failed, len(results)),
+		Data:    results,
+	}
+
+	app.WriteJSON(w, http.StatusOK, payload)
+}
+
+func (app *App) runSequential(ctx context.Context, batch BatchRequest) []batchResult {
+	results := make([]batchResult, len(batch.Items))
+
+	stopped := false
+	for i, item := range batch.Items {
+		if stopped || ctx.Err() != nil {
+			results[i] = skippedResult(ctx, i, item)
+			continue
+		}
+
+		results[i] = app.runItem(ctx, i, item)
+		if results[i].Error && batch.StopOnFailure {
+			stopped = true
+		}
+	}
+
+	return results
+}
+
+func (app *App) runConcurrent(parent context.Context, batch BatchRequest) []batchResult {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	results := make([]batchResult, len(batch.Items))
+	sem := make(chan struct{}, batchConcurrency)
+
+	var wg sync.WaitGroup
+	for i, item := range batch.Items {
+		wg.Add(1)
+		go func(i int, item RequestPayload) {
+			defer wg.Done()
+
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				results[i] = skippedResult(parent, i, item)
+				return
+			}
+
+			// a failure may have stopped the batch while this item waited for a slot
+			if ctx.Err() != nil {
+				results[i] = skippedResult(parent, i, item)
+				return
+			}
+
+			results[i] = app.runItem(ctx, i, item)
+			if results[i].Error && batch.StopOnFailure {
+				cancel()
+			}
+		}(i, item)
+	}
+	wg.Wait()
+
+	return results
+}
+
+func (app *App) runItem(ctx context.Context, i int, item RequestPayload) batchResult {
+	var status int
+	var payload responsePayload
+	if item.Async {
+		status, payload = app.enqueue(ctx, item)
+	} else {
+		status, payload = app.dispatch(ctx, item)
+	}
+
+	return batchResult{
+		Index:           i,
+		Action:          item.Action,
+		Status:          status,
+		responsePayload: payload,
+	}
+}
+
+// skippedResult is the result of an item that never ran, because an earlier item failed
+// or, when ctx is done, because the request was cancelled
+func skippedResult(ctx context.Context, i int, item RequestPayload) batchResult {
+	res := batchResult{
+		Index:   i,
+		Action:  item.Action,
+		Status:  http.StatusFailedDependency,
+		Skipped: true,
+		responsePayload: responsePayload{
+			Error:   true,
+			Message: "skipped after an earlier item failed",
+		},
+	}
+
+	if err := ctx.Err(); err != nil {
+		res.Status = http.StatusServiceUnavailable
+		res.Message = "skipped because the request was cancelled: " + err.Error()
+	}
+
+	return res
+}
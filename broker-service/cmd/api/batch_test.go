@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestBatchSkippedItems(t *testing.T) {
+	app := &App{Actions: NewActionRegistry()}
+
+	// neither action exists, so every item that runs fails without reaching a service
+	batch := BatchRequest{
+		Items:         []RequestPayload{{Action: "first"}, {Action: "second"}, {Action: "third"}},
+		StopOnFailure: true,
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name       string
+		ctx        context.Context
+		sequential bool
+		// ran is how many items run before the rest are skipped
+		ran        int
+		wantStatus int
+		wantPrefix string
+	}{
+		{name: "sequential after a failure", ctx: context.Background(), sequential: true, ran: 1, wantStatus: http.StatusFailedDependency, wantPrefix: "skipped after an earlier item failed"},
+		{name: "sequential after the client went away", ctx: cancelled, sequential: true, wantStatus: http.StatusServiceUnavailable, wantPrefix: "skipped because the request was cancelled"},
+		{name: "concurrent after the client went away", ctx: cancelled, wantStatus: http.StatusServiceUnavailable, wantPrefix: "skipped because the request was cancelled"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := batch
+			b.Sequential = tt.sequential
+
+			var results []batchResult
+			if tt.sequential {
+				results = app.runSequential(tt.ctx, b)
+			} else {
+				results = app.runConcurrent(tt.ctx, b)
+			}
+
+			for i, res := range results {
+				if i < tt.ran {
+					if res.Skipped || res.Status != http.StatusBadRequest {
+						t.Errorf("item %d = %+v, want it run and failed", i, res)
+					}
+					continue
+				}
+				if !res.Skipped || res.Status != tt.wantStatus || !strings.HasPrefix(res.Message, tt.wantPrefix) {
+					t.Errorf("item %d = %+v, want it skipped with %d %q", i, res, tt.wantStatus, tt.wantPrefix)
+				}
+			}
+		})
+	}
+}
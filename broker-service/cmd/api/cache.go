@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// newCacheResults counts how read actions were served: from the cache, by a call
+// shared with other callers, or by a call of their own
+func newCacheResults() *prometheus.CounterVec {
+	return prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "broker",
+		Name:      "action_cache_total",
+		Help:      "Runs of cacheable actions, by action and whether they were a hit, a miss or shared.",
+	}, []string{"action", "outcome"})
+}
+
+// runAction calls the action's handler. Results of read actions, those with a CacheTTL,
+// are served from the cache while fresh, and identical calls made at the same time
+// reach the downstream service only once. A write that succeeds makes the cached
+// results of the actions it Invalidates stale.
+func (app *App) runAction(ctx context.Context, action *Action, payload any) (responsePayload, error) {
+	if action.CacheTTL <= 0 {
+		res, err := action.handle(ctx, payload)
+		if err == nil && !res.Error && len(action.Invalidates) > 0 {
+			app.Cache.Invalidate(action.Invalidates...)
+		}
+		return res, err
+	}
+
+	key, err := cacheKey(ctx, payload)
+	if err != nil {
+		return action.handle(ctx, payload)
+	}
+
+	// a shared call answers every caller waiting on it, so the one that happened to
+	// start it mustn't be able to cancel it; the outbound timeouts still apply
+	shared := context.WithoutCancel(ctx)
+
+	value, outcome, err := app.Cache.Do(action.Name, key, action.CacheTTL, func() (any, bool, error) {
+		res, err := action.handle(shared, payload)
+		return res, err == nil && !res.Error, err
+	})
+	app.CacheResults.WithLabelValues(action.Name, outcome).Inc()
+	if err != nil {
+		return responsePayload{}, err
+	}
+
+	return value.(responsePayload), nil
+}
+
+// cacheKey identifies a call by the caller and the payload, so that one caller never
+// gets a result fetched for another
+func cacheKey(ctx context.Context, payload any) (string, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(append([]byte(clientKey(ctx)+"\x00"), data...))
+	return hex.EncodeToString(sum[:]), nil
+}
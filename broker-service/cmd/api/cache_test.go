@@ -0,0 +1,62 @@
+package main
+
+import (
+	"broker/cache"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRunActionCachesUntilInvalidated(t *testing.T) {
+	app := &App{
+		Actions:      NewActionRegistry(),
+		Cache:        cache.New(0),
+		CacheResults: newCacheResults(),
+	}
+
+	reads := 0
+	RegisterAction(app.Actions, Action{Name: "logs", CacheTTL: time.Minute}, func(ctx context.Context, p LogsPayload) (responsePayload, error) {
+		reads++
+		return responsePayload{Message: "log entries", Data: reads}, nil
+	})
+	RegisterAction(app.Actions, Action{Name: "log", Invalidates: []string{"logs"}}, func(ctx context.Context, p LogPayload) (responsePayload, error) {
+		return responsePayload{Message: "logged"}, nil
+	})
+
+	logs, _ := app.Actions.Lookup("logs")
+	log, _ := app.Actions.Lookup("log")
+
+	steps := []struct {
+		name    string
+		action  *Action
+		payload any
+		reads   int
+	}{
+		{name: "first read goes downstream", action: logs, payload: LogsPayload{Name: "auth"}, reads: 1},
+		{name: "same read is a hit", action: logs, payload: LogsPayload{Name: "auth"}, reads: 1},
+		{name: "another payload is a miss", action: logs, payload: LogsPayload{Name: "mail"}, reads: 2},
+		{name: "a write invalidates", action: log, payload: LogPayload{Name: "auth", Data: "x"}, reads: 2},
+		{name: "read after the write goes downstream", action: logs, payload: LogsPayload{Name: "auth"}, reads: 3},
+	}
+
+	for _, step := range steps {
+		_, err := app.runAction(context.Background(), step.action, step.payload)
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if reads != step.reads {
+			t.Fatalf("%s: %d downstream reads, want %d", step.name, reads, step.reads)
+		}
+	}
+}
+
+func TestCacheKeyPerCaller(t *testing.T) {
+	alice := withIdentity(context.Background(), Identity{Kind: IdentityUser, Subject: "1"})
+	bob := withIdentity(context.Background(), Identity{Kind: IdentityUser, Subject: "2"})
+
+	a, _ := cacheKey(alice, LogsPayload{Name: "auth"})
+	b, _ := cacheKey(bob, LogsPayload{Name: "auth"})
+	if a == b {
+		t.Error("two callers share a cache key")
+	}
+}
@@ -1,43 +1,109 @@
 package main
 
 import (
-	"broker/event"
+	"broker/discovery"
 	"broker/logs"
-	"bytes"
+	"broker/outbound"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
-	"net/rpc"
+	"net/url"
+	"shared/cloudevent"
+	"strconv"
 	"time"
 
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
+	"go.opentelemetry.io/otel/codes"
 )
 
+// RequestPayload is the body of a /handle request. Action names the registered action
+// to run; every other top-level key is kept in Params so that each action can decode
+// its own payload (for example "auth", "log" or "mail"). Async queues the action and
+// returns a job ID instead of waiting for the result.
 type RequestPayload struct {
-	Action string      `json:"action"`
-	Auth   AuthPayload `json:"auth,omitempty"`
-	Log    LogPayload  `json:"log,omitempty"`
-	Mail   MailPayload `json:"mail,omitempty"`
+	Action string                     `json:"action"`
+	Async  bool                       `json:"async,omitempty"`
+	Params map[string]json.RawMessage `json:"-"`
+}
+
+// UnmarshalJSON splits the action name from the action-specific payloads
+func (p *RequestPayload) UnmarshalJSON(b []byte) error {
+	var raw map[string]json.RawMessage
+	err := json.Unmarshal(b, &raw)
+	if err != nil {
+		return err
+	}
+
+	p.Action = ""
+	if action, ok := raw["action"]; ok {
+		err = json.Unmarshal(action, &p.Action)
+		if err != nil {
+			return err
+		}
+		delete(raw, "action")
+	}
+
+	p.Async = false
+	if async, ok := raw["async"]; ok {
+		err = json.Unmarshal(async, &p.Async)
+		if err != nil {
+			return err
+		}
+		delete(raw, "async")
+	}
+
+	p.Params = raw
+
+	return nil
+}
+
+// MarshalJSON writes the payload back out in the same shape it was received in
+func (p RequestPayload) MarshalJSON() ([]byte, error) {
+	out := make(map[string]json.RawMessage, len(p.Params)+1)
+	for k, v := range p.Params {
+		out[k] = v
+	}
+
+	action, err := json.Marshal(p.Action)
+	if err != nil {
+		return nil, err
+	}
+	out["action"] = action
+
+	if p.Async {
+		out["async"] = json.RawMessage("true")
+	}
+
+	return json.Marshal(out)
 }
 
 type MailPayload struct {
-	From    string `json:"from"`
-	To      string `json:"to"`
-	Subject string `json:"subject"`
-	Message string `json:"message"`
+	From    string `json:"from" validate:"email"`
+	To      string `json:"to" validate:"required,email"`
+	Subject string `json:"subject" validate:"required,max=255"`
+	Message string `json:"message" validate:"required"`
 }
 
 type AuthPayload struct {
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	Email    string `json:"email" validate:"required,email"`
+	Password string `json:"password" validate:"required"`
+}
+
+// logsCacheTTL is how long a logs read is served from the cache
+const logsCacheTTL = 10 * time.Second
+
+// LogsPayload asks for the latest log entries, optionally only those logged under Name
+type LogsPayload struct {
+	Name  string `json:"name,omitempty" validate:"max=255"`
+	Limit int    `json:"limit,omitempty"`
 }
 
 type LogPayload struct {
-	Name string `json:"name"`
-	Data string `json:"data"`
+	Name string `json:"name" validate:"required,max=255"`
+	Data string `json:"data" validate:"required"`
+	// Transport optionally overrides the configured log transport for this entry
+	Transport string `json:"transport,omitempty" validate:"oneof=rpc grpc http amqp"`
 }
 
 func (app *App) Broker(w http.ResponseWriter, r *http.Request) {
@@ -58,140 +124,182 @@ func (app *App) HandleSubmission(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	switch requestPayload.Action {
-	case "auth":
-		app.Authenticate(w, requestPayload.Auth)
-	case "log":
-		app.logItemViaRPC(w, requestPayload.Log)
-	case "mail":
-		app.SendEmail(w, requestPayload.Mail)
-	default:
-		app.ErrorJSON(w, fmt.Errorf("unknown action: %s", requestPayload.Action), http.StatusBadRequest)
+	if requestPayload.Async {
+		status, payload := app.enqueue(r.Context(), requestPayload)
+		app.writeResult(w, status, payload)
 		return
 	}
 
+	status, payload := app.dispatch(r.Context(), requestPayload)
+	app.writeResult(w, status, payload)
 }
 
-func (app *App) Authenticate(w http.ResponseWriter, a AuthPayload) {
+func (app *App) Authenticate(ctx context.Context, a AuthPayload) (responsePayload, error) {
 
 	// create some json we'll send to the auth microservice
 	jsonData, err := json.MarshalIndent(a, "", "\t")
 	if err != nil {
-		app.ErrorJSON(w, errors.New("could not marshal json"), http.StatusInternalServerError)
-		return
+		return responsePayload{}, errors.New("could not marshal json")
 	}
 
-	//call the auth service
-	url := "http://auth-service:8080/auth"
-
-	request, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
-	if err != nil {
-		app.ErrorJSON(w, errors.New("could not send post req"), http.StatusInternalServerError)
-		return
-	}
-	client := &http.Client{}
-	response, err := client.Do(request)
+	//call the auth service; checking credentials has no side effects, so it may be retried
+	response, err := app.Outbound.Do(ctx, outbound.Request{
+		Service:    discovery.Auth,
+		Method:     "POST",
+		Path:       "/auth",
+		Body:       jsonData,
+		Idempotent: true,
+	})
 	if err != nil {
-		app.ErrorJSON(w, errors.New("error with from remote response"), http.StatusInternalServerError)
-		return
+		return responsePayload{}, remoteError(err, errors.New("error with from remote response"))
 	}
 	defer response.Body.Close()
 
 	//make sure the response is correct status code
 	if response.StatusCode == http.StatusUnauthorized {
-		app.ErrorJSON(w, errors.New("invalid credentials"), http.StatusUnauthorized)
-		return
+		return responsePayload{}, newActionError(http.StatusUnauthorized, errors.New("invalid credentials"))
+	} else if response.StatusCode == http.StatusForbidden {
+		return responsePayload{}, newActionError(http.StatusForbidden, errors.New("account is not active"))
 	} else if response.StatusCode != http.StatusAccepted {
-		app.ErrorJSON(w, fmt.Errorf("unexpected status code: %d", response.StatusCode), http.StatusInternalServerError)
-		return
+		return responsePayload{}, fmt.Errorf("unexpected status code: %d", response.StatusCode)
 	}
 
 	//create var to read response.Body into
-	var jsonFromRemote responsePayload
+	var jsonFromRemote struct {
+		Error   bool            `json:"error"`
+		Message string          `json:"message"`
+		Data    json.RawMessage `json:"data,omitempty"`
+	}
 
 	//read the response body
 	err = json.NewDecoder(response.Body).Decode(&jsonFromRemote)
 	if err != nil {
-		app.ErrorJSON(w, errors.New("error decoding remote response"), http.StatusInternalServerError)
-		return
+		return responsePayload{}, errors.New("error decoding remote response")
 	}
 
 	if jsonFromRemote.Error {
-		app.ErrorJSON(w, errors.New(jsonFromRemote.Message), http.StatusUnauthorized)
-		return
+		return responsePayload{}, newActionError(http.StatusUnauthorized, errors.New(jsonFromRemote.Message))
+	}
+
+	var user struct {
+		ID             int    `json:"id"`
+		Email          string `json:"email"`
+		SessionVersion int    `json:"session_version"`
+	}
+	err = json.Unmarshal(jsonFromRemote.Data, &user)
+	if err != nil {
+		return responsePayload{}, errors.New("error decoding remote user")
+	}
+
+	//issue tokens the client can use for protected actions
+	tokens, err := app.Tokens.Issue(strconv.Itoa(user.ID), user.Email, user.SessionVersion)
+	if err != nil {
+		return responsePayload{}, errors.New("could not issue tokens")
 	}
 
 	var payload responsePayload
-	payload.Data = jsonFromRemote.Data
+	payload.Data = map[string]any{
+		"user":   jsonFromRemote.Data,
+		"tokens": tokens,
+	}
 	payload.Error = false
 	payload.Message = fmt.Sprintf("Authenticated user %s", a.Email)
-	app.WriteJSON(w, http.StatusAccepted, payload)
+	return payload, nil
 
 }
 
-func (app *App) Log(w http.ResponseWriter, l LogPayload) {
+func (app *App) Log(ctx context.Context, l LogPayload) (responsePayload, error) {
 	// create some json we'll send to the log microservice
+	l.Transport = ""
 	jsonData, err := json.MarshalIndent(l, "", "\t")
 	if err != nil {
-		app.ErrorJSON(w, errors.New("could not marshal json"), http.StatusInternalServerError)
-		return
+		return responsePayload{}, errors.New("could not marshal json")
 	}
 
 	//call the log service
-	url := "http://logger-service:8080/log"
-
-	request, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
-	if err != nil {
-		app.ErrorJSON(w, errors.New("could not send post req"), http.StatusInternalServerError)
-		return
-	}
-	client := &http.Client{}
-	response, err := client.Do(request)
+	response, err := app.Outbound.Do(ctx, outbound.Request{
+		Service: discovery.Logger,
+		Method:  "POST",
+		Path:    "/log",
+		Body:    jsonData,
+	})
 	if err != nil {
-		app.ErrorJSON(w, errors.New("error with from remote response"), http.StatusInternalServerError)
-		return
+		return responsePayload{}, remoteError(err, errors.New("error with from remote response"))
 	}
 	defer response.Body.Close()
 
 	//make sure the response is correct status code
 	if response.StatusCode != http.StatusAccepted {
-		app.ErrorJSON(w, fmt.Errorf("unexpected status code: %d", response.StatusCode), http.StatusInternalServerError)
-		return
+		return responsePayload{}, fmt.Errorf("unexpected status code: %d", response.StatusCode)
 	}
 
 	var payload responsePayload
 	payload.Error = false
 	payload.Message = fmt.Sprintf("Logged data: %s", l.Data)
-	app.WriteJSON(w, http.StatusAccepted, payload)
+	return payload, nil
 }
 
-func (app *App) SendEmail(w http.ResponseWriter, msg MailPayload) {
-	jsonData, _ := json.MarshalIndent(msg, "", "\t")
+// ReadLogs fetches the latest log entries from the logger. Identical reads are served
+// from the cache for logsCacheTTL, or until a log action succeeds.
+func (app *App) ReadLogs(ctx context.Context, p LogsPayload) (responsePayload, error) {
+	query := url.Values{}
+	if p.Name != "" {
+		query.Set("name", p.Name)
+	}
+	if p.Limit > 0 {
+		query.Set("limit", strconv.Itoa(p.Limit))
+	}
 
-	// call the mail service
-	mailServiceURL := "http://mailer-service:8080/send"
+	response, err := app.Outbound.Do(ctx, outbound.Request{
+		Service:    discovery.Logger,
+		Method:     "GET",
+		Path:       "/logs?" + query.Encode(),
+		Header:     http.Header{"Authorization": {"Bearer " + app.ServiceToken}},
+		Idempotent: true,
+	})
+	if err != nil {
+		return responsePayload{}, remoteError(err, errors.New("error with from remote response"))
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return responsePayload{}, fmt.Errorf("unexpected status code: %d", response.StatusCode)
+	}
 
-	// post to mail service
-	request, err := http.NewRequest("POST", mailServiceURL, bytes.NewBuffer(jsonData))
+	var jsonFromRemote struct {
+		Data json.RawMessage `json:"data"`
+	}
+	err = json.NewDecoder(response.Body).Decode(&jsonFromRemote)
 	if err != nil {
-		app.ErrorJSON(w, err)
-		return
+		return responsePayload{}, errors.New("error decoding remote response")
 	}
 
-	request.Header.Set("Content-Type", "application/json")
+	var payload responsePayload
+	payload.Error = false
+	payload.Message = "log entries"
+	payload.Data = jsonFromRemote.Data
+	return payload, nil
+}
 
-	client := &http.Client{}
-	response, err := client.Do(request)
+func (app *App) SendEmail(ctx context.Context, msg MailPayload) (responsePayload, error) {
+	jsonData, _ := json.MarshalIndent(msg, "", "\t")
+
+	// post to mail service; sending mail is not idempotent, so it is never retried
+	response, err := app.Outbound.Do(ctx, outbound.Request{
+		Service: discovery.Mailer,
+		Method:  "POST",
+		Path:    "/send",
+		Body:    jsonData,
+		Header:  http.Header{"Content-Type": {"application/json"}},
+	})
 	if err != nil {
-		app.ErrorJSON(w, err)
-		return
+		return responsePayload{}, remoteError(err, newActionError(http.StatusBadRequest, err))
 	}
 	defer response.Body.Close()
 
 	// make sure we get back the right status code
 	if response.StatusCode != http.StatusAccepted {
-		app.ErrorJSON(w, errors.New("error calling mail service"))
-		return
+		return responsePayload{}, newActionError(http.StatusBadRequest, errors.New("error calling mail service"))
 	}
 
 	// send back json
@@ -199,67 +307,70 @@ func (app *App) SendEmail(w http.ResponseWriter, msg MailPayload) {
 	payload.Error = false
 	payload.Message = "Message sent to " + msg.To
 
-	app.WriteJSON(w, http.StatusAccepted, payload)
+	return payload, nil
 
 }
 
 // logEventViaRabbit logs an event using the logger-service. It makes the call by pushing the data to RabbitMQ.
-func (app *App) logEventViaRabbit(w http.ResponseWriter, l LogPayload) {
-	err := app.pushToQueue(l.Name, l.Data)
+func (app *App) logEventViaRabbit(ctx context.Context, l LogPayload) (responsePayload, error) {
+	err := app.pushToQueue(ctx, l.Name, l.Data)
 	if err != nil {
-		app.ErrorJSON(w, err)
-		return
+		return responsePayload{}, remoteError(err, newActionError(http.StatusBadRequest, err))
 	}
 
 	var payload responsePayload
 	payload.Error = false
 	payload.Message = "logged via RabbitMQ"
 
-	app.WriteJSON(w, http.StatusAccepted, payload)
+	return payload, nil
 }
 
 // pushToQueue pushes a message into RabbitMQ
-func (app *App) pushToQueue(name, msg string) error {
-	emitter, err := event.NewEventEmitter(app.Rabbit)
-	if err != nil {
-		return err
-	}
-
+func (app *App) pushToQueue(ctx context.Context, name, msg string) error {
 	payload := LogPayload{
 		Name: name,
 		Data: msg,
 	}
 
-	j, _ := json.MarshalIndent(&payload, "", "\t")
-	err = emitter.Push(string(j), "log.INFO")
+	e, err := cloudevent.New(eventSource, cloudevent.TypeLog, payload)
 	if err != nil {
 		return err
 	}
-	return nil
+
+	done := app.Metrics.TrackDownstream("rabbitmq", TransportAMQP)
+	err = app.Emitter.Push(ctx, e, "log.INFO")
+	done(err)
+
+	return err
 }
 
 type RPCPayload struct {
 	Name string
 	Data string
+	// TraceContext carries the caller's trace, since net/rpc has no headers to put it in
+	TraceContext map[string]string
 }
 
-func (app *App) logItemViaRPC(w http.ResponseWriter, l LogPayload) {
-	client, err := rpc.Dial("tcp", "logger-service:5001")
-	if err != nil {
-		app.ErrorJSON(w, err)
-		return
-	}
-
-	rpcPayload := RPCPayload{
-		Name: l.Name,
-		Data: l.Data,
-	}
-
+func (app *App) logItemViaRPC(ctx context.Context, l LogPayload) (responsePayload, error) {
 	var result string
-	err = client.Call("RPCServer.LogInfo", rpcPayload, &result)
+	err := app.Outbound.Call(ctx, discovery.LoggerRPC, TransportRPC, false, func(ctx context.Context, ep discovery.Endpoint) error {
+		ctx, span := startRPCSpan(ctx, ep.Host(), "RPCServer", "LogInfo")
+		defer span.End()
+
+		rpcPayload := RPCPayload{
+			Name:         l.Name,
+			Data:         l.Data,
+			TraceContext: traceCarrier(ctx),
+		}
+
+		err := app.LogRPC.Call(ctx, ep.Host(), "RPCServer.LogInfo", rpcPayload, &result)
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+		}
+		return err
+	})
 	if err != nil {
-		app.ErrorJSON(w, err)
-		return
+		return responsePayload{}, remoteError(err, newActionError(http.StatusBadRequest, err))
 	}
 
 	payload := responsePayload{
@@ -267,9 +378,39 @@ func (app *App) logItemViaRPC(w http.ResponseWriter, l LogPayload) {
 		Message: result,
 	}
 
-	app.WriteJSON(w, http.StatusAccepted, payload)
+	return payload, nil
 }
 
+func (app *App) logItemViaGRPC(ctx context.Context, l LogPayload) (responsePayload, error) {
+	err := app.Outbound.Call(ctx, discovery.LoggerGRPC, TransportGRPC, false, func(ctx context.Context, ep discovery.Endpoint) error {
+		conn, err := app.LogGRPC.Conn(ep.Host())
+		if err != nil {
+			return err
+		}
+
+		c := logs.NewLogServiceClient(conn)
+
+		_, err = c.WriteLog(ctx, &logs.LogRequest{
+			LogEntry: &logs.Log{
+				Name: l.Name,
+				Data: l.Data,
+			},
+		})
+		return err
+	})
+	if err != nil {
+		return responsePayload{}, remoteError(err, newActionError(http.StatusBadRequest, err))
+	}
+
+	var payload responsePayload
+	payload.Error = false
+	payload.Message = "logged"
+
+	return payload, nil
+}
+
+// LogViaGRPC is kept for clients that still post to /log-grpc. New clients should send
+// {"action": "log", "log": {"transport": "grpc", ...}} to /handle instead.
 func (app *App) LogViaGRPC(w http.ResponseWriter, r *http.Request) {
 	var requestPayload RequestPayload
 
@@ -279,31 +420,18 @@ func (app *App) LogViaGRPC(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	conn, err := grpc.Dial("logger-service:50001", grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
+	var l LogPayload
+	err = json.Unmarshal(requestPayload.Params["log"], &l)
 	if err != nil {
 		app.ErrorJSON(w, err)
 		return
 	}
-	defer conn.Close()
 
-	c := logs.NewLogServiceClient(conn)
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
-
-	_, err = c.WriteLog(ctx, &logs.LogRequest{
-		LogEntry: &logs.Log{
-			Name: requestPayload.Log.Name,
-			Data: requestPayload.Log.Data,
-		},
-	})
+	payload, err := app.logItemViaGRPC(r.Context(), l)
 	if err != nil {
-		app.ErrorJSON(w, err)
+		app.ErrorJSON(w, err, errorStatus(err))
 		return
 	}
 
-	var payload responsePayload
-	payload.Error = false
-	payload.Message = "logged"
-
 	app.WriteJSON(w, http.StatusAccepted, payload)
 }
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestRequestPayloadRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		in     string
+		action string
+		async  bool
+		params []string
+	}{
+		{name: "action only", in: `{"action":"logs"}`, action: "logs"},
+		{name: "with payload", in: `{"action":"mail","mail":{"to":"a@example.com"}}`, action: "mail", params: []string{"mail"}},
+		{name: "async", in: `{"action":"log","async":true,"log":{"name":"n","data":"d"}}`, action: "log", async: true, params: []string{"log"}},
+		{name: "async false is dropped", in: `{"action":"log","async":false}`, action: "log"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var p RequestPayload
+			err := json.Unmarshal([]byte(tt.in), &p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.Action != tt.action || p.Async != tt.async || len(p.Params) != len(tt.params) {
+				t.Fatalf("Unmarshal = %+v", p)
+			}
+			for _, name := range tt.params {
+				if _, ok := p.Params[name]; !ok {
+					t.Errorf("Params is missing %q", name)
+				}
+			}
+
+			out, err := json.Marshal(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var again RequestPayload
+			err = json.Unmarshal(out, &again)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if again.Action != p.Action || again.Async != p.Async || len(again.Params) != len(p.Params) {
+				t.Fatalf("round trip = %+v, want %+v", again, p)
+			}
+			for name, raw := range p.Params {
+				if string(again.Params[name]) != string(raw) {
+					t.Errorf("Params[%q] = %s, want %s", name, again.Params[name], raw)
+				}
+			}
+		})
+	}
+}
+
+func TestRequestPayloadUnmarshalErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+	}{
+		{name: "not an object", in: `[]`},
+		{name: "action not a string", in: `{"action":1}`},
+		{name: "async not a boolean", in: `{"action":"log","async":"yes"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var p RequestPayload
+			if err := json.Unmarshal([]byte(tt.in), &p); err == nil {
+				t.Errorf("Unmarshal = %+v, want an error", p)
+			}
+		})
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"broker/apikey"
+	"broker/event"
+	"broker/jobs"
+	"broker/token"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"shared/cloudevent"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	// jobQueue is the durable queue async actions wait in until a broker runs them
+	jobQueue = "broker_jobs"
+	// jobTopicPrefix is prepended to the action name to form the routing key of a job
+	jobTopicPrefix = "job."
+	// jobPrefetch is how many jobs one broker runs at the same time
+	jobPrefetch = 10
+	// jobTimeout bounds how long a single job may run
+	jobTimeout = 2 * time.Minute
+)
+
+// jobMessage is what the broker publishes to RabbitMQ for an async action. Anyone who
+// can publish to the exchange can write one, so it names the caller that queued the job
+// without vouching for them: the worker looks the caller up again before running it.
+type jobMessage struct {
+	JobID   string         `json:"job_id"`
+	Request RequestPayload `json:"request"`
+	Caller  jobCaller      `json:"caller"`
+}
+
+// jobCaller refers to the caller that queued a job: an API key by its ID, or a user by
+// their ID and the session version of the token they used
+type jobCaller struct {
+	Kind    string `json:"kind"`
+	Subject string `json:"sub"`
+	Version int    `json:"ver,omitempty"`
+}
+
+// jobAccepted is returned to the client when an async action has been queued
+type jobAccepted struct {
+	JobID     string `json:"job_id"`
+	Status    string `json:"status"`
+	StatusURL string `json:"status_url"`
+}
+
+// enqueue validates p, records a pending job owned by the caller and publishes it to
+// RabbitMQ. Results can hold tokens, so anonymous callers can't queue jobs.
+func (app *App) enqueue(ctx context.Context, p RequestPayload) (int, responsePayload) {
+	id, ok := identityFrom(ctx)
+	if !ok {
+		return errorResponse(newActionError(http.StatusUnauthorized, errors.New("async actions require an API key or a bearer token")))
+	}
+
+	action, _, err := app.resolve(p)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	err = app.authorize(ctx, action)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	err = app.checkLimits(ctx, action)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	job, err := jobs.New(p.Action, jobOwner(id))
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	err = app.Jobs.Create(job)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	p.Async = false
+	msg := jobMessage{
+		JobID:   job.ID,
+		Request: p,
+		Caller:  jobCaller{Kind: id.Kind, Subject: id.Subject, Version: id.Version},
+	}
+
+	err = app.publishJob(ctx, msg, jobTopicPrefix+p.Action)
+	if err != nil {
+		app.finishJob(job, http.StatusServiceUnavailable, responsePayload{
+			Error:   true,
+			Message: "could not queue job: " + err.Error(),
+		})
+		return errorResponse(newActionError(http.StatusServiceUnavailable, fmt.Errorf("could not queue job: %w", err)))
+	}
+
+	return http.StatusAccepted, responsePayload{
+		Error:   false,
+		Message: fmt.Sprintf("%s queued", p.Action),
+		Data: jobAccepted{
+			JobID:     job.ID,
+			Status:    job.Status,
+			StatusURL: "/jobs/" + job.ID,
+		},
+	}
+}
+
+// publishJob pushes a job onto the exchange through the event emitter
+func (app *App) publishJob(ctx context.Context, msg jobMessage, topic string) error {
+	e, err := cloudevent.New(eventSource, cloudevent.TypeJob, msg)
+	if err != nil {
+		return err
+	}
+	e.Subject = msg.JobID
+
+	done := app.Metrics.TrackDownstream("rabbitmq", TransportAMQP)
+	err = app.Emitter.Push(ctx, e, topic)
+	done(err)
+
+	return err
+}
+
+// runJobWorker consumes queued jobs and runs them. If the RabbitMQ connection drops it
+// waits for it to come back and starts consuming again. It blocks until ctx is done and
+// the jobs already running have finished.
+func (app *App) runJobWorker(ctx context.Context) {
+	for {
+		err := app.Rabbit.WaitReady(ctx)
+		if err != nil {
+			return
+		}
+
+		consumer, err := event.NewConsumer(app.Rabbit)
+		if err == nil {
+			err = consumer.Consume(ctx, jobQueue, []string{jobTopicPrefix + "#"}, jobPrefetch, app.handleJob)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		log.Println("job worker stopped, restarting:", err)
+
+		// don't spin if the connection is up but consuming keeps failing
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// handleJob runs one queued action and stores its outcome. ctx carries the trace of the
+// request that queued it.
+func (app *App) handleJob(ctx context.Context, e cloudevent.Envelope) error {
+	// events published before the envelope existed have no type
+	if e.Type != "" && e.Type != cloudevent.TypeJob {
+		return fmt.Errorf("unexpected event type %q on the job queue", e.Type)
+	}
+
+	var msg jobMessage
+	err := e.Decode(&msg)
+	if err != nil {
+		return fmt.Errorf("malformed job: %w", err)
+	}
+
+	job, err := app.Jobs.Get(msg.JobID)
+	if err != nil {
+		// the job may belong to a broker that has since restarted; run it anyway
+		job = jobs.Job{ID: msg.JobID, Action: msg.Request.Action, Owner: msg.Caller.owner(), Status: jobs.StatusPending, CreatedAt: time.Now()}
+		err = app.Jobs.Create(job)
+		if err != nil {
+			return err
+		}
+	} else if job.Owner != msg.Caller.owner() {
+		return fmt.Errorf("job %s was queued by another caller", job.ID)
+	}
+
+	if job.Done() {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, jobTimeout)
+	defer cancel()
+
+	id, err := app.lookupCaller(ctx, msg.Caller)
+	if err != nil {
+		status, payload := errorResponse(err)
+		app.finishJob(job, status, payload)
+		return nil
+	}
+
+	ctx = withIdentity(ctx, id)
+	ctx = withLimitsChecked(ctx)
+
+	status, payload := app.dispatch(ctx, msg.Request)
+	app.finishJob(job, status, payload)
+
+	return nil
+}
+
+// lookupCaller resolves the caller of a job to who they are now: the key's current
+// scopes, or a user whose sessions haven't been revoked since the job was queued
+func (app *App) lookupCaller(ctx context.Context, c jobCaller) (Identity, error) {
+	switch c.Kind {
+	case IdentityAPIKey:
+		key, err := app.Keys.Lookup(c.Subject)
+		if errors.Is(err, apikey.ErrNotFound) || errors.Is(err, apikey.ErrRevoked) {
+			return Identity{}, newActionError(http.StatusUnauthorized, apikey.ErrRevoked)
+		} else if err != nil {
+			return Identity{}, err
+		}
+
+		return Identity{Kind: IdentityAPIKey, Subject: key.ID, Scopes: key.Scopes}, nil
+
+	case IdentityUser:
+		current, err := app.Sessions.Version(ctx, c.Subject)
+		if err == nil && c.Version < current {
+			err = token.ErrRevoked
+		}
+		if errors.Is(err, token.ErrRevoked) {
+			return Identity{}, newActionError(http.StatusUnauthorized, token.ErrRevoked)
+		} else if err != nil {
+			return Identity{}, newActionError(http.StatusServiceUnavailable, token.ErrUnavailable)
+		}
+
+		return Identity{Kind: IdentityUser, Subject: c.Subject, Version: c.Version}, nil
+
+	default:
+		return Identity{}, newActionError(http.StatusUnauthorized, fmt.Errorf("unknown caller kind %q", c.Kind))
+	}
+}
+
+// finishJob records the result of a job
+func (app *App) finishJob(job jobs.Job, status int, payload responsePayload) {
+	job.Status = jobs.StatusSucceeded
+	if payload.Error {
+		job.Status = jobs.StatusFailed
+	}
+	job.HTTPStatus = status
+
+	result, err := json.Marshal(payload)
+	if err == nil {
+		job.Result = result
+	}
+
+	err = app.Jobs.Update(job)
+	if err != nil {
+		log.Printf("could not update job %s: %s", job.ID, err)
+	}
+}
+
+// jobOwner is what a job records about the caller that queued it
+func jobOwner(id Identity) string {
+	return id.Kind + ":" + id.Subject
+}
+
+func (c jobCaller) owner() string {
+	return c.Kind + ":" + c.Subject
+}
+
+// GetJob returns the status, and once finished the result, of an async action. Only the
+// caller that queued the job can read it; to anyone else it doesn't exist.
+func (app *App) GetJob(w http.ResponseWriter, r *http.Request) {
+	id, ok := identityFrom(r.Context())
+	if !ok {
+		app.ErrorJSON(w, errors.New("an API key or a bearer token is required"), http.StatusUnauthorized)
+		return
+	}
+
+	job, err := app.Jobs.Get(chi.URLParam(r, "id"))
+	if err == nil && job.Owner != jobOwner(id) {
+		err = jobs.ErrNotFound
+	}
+	if errors.Is(err, jobs.ErrNotFound) {
+		app.ErrorJSON(w, err, http.StatusNotFound)
+		return
+	} else if err != nil {
+		app.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	payload := responsePayload{
+		Error:   false,
+		Message: fmt.Sprintf("job %s", job.Status),
+		Data:    job,
+	}
+
+	app.WriteJSON(w, http.StatusOK, payload)
+}
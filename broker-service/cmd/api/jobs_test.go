@@ -0,0 +1,189 @@
+package main
+
+import (
+	"broker/apikey"
+	"broker/discovery"
+	"broker/jobs"
+	"broker/outbound"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"shared/cloudevent"
+	"testing"
+	"time"
+)
+
+// authSource sends every service to one test server
+type authSource string
+
+func (s authSource) Endpoints(service string) ([]string, error) {
+	return []string{string(s)}, nil
+}
+
+// newJobApp returns an app whose auth service reports session version 2 for user 1
+// and doesn't know any other user
+func newJobApp(t *testing.T) *App {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/sessions/1" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"data": {"version": 2, "active": true}}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	registry, err := discovery.NewRegistry(authSource(srv.URL), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := outbound.NewClient(registry, outbound.Policy{Timeout: time.Second}, nil)
+
+	return &App{
+		Jobs:     jobs.NewMemoryStore(time.Hour),
+		Keys:     apikey.NewManager(apikey.NewMemoryStore()),
+		Sessions: authSessions{outbound: client, serviceToken: "test"},
+	}
+}
+
+func TestLookupCaller(t *testing.T) {
+	app := newJobApp(t)
+
+	key, _, err := app.Keys.Create("ci", []string{apikey.ScopeLogWrite})
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked, _, err := app.Keys.Create("old", []string{apikey.ScopeMailSend})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.Keys.Revoke(revoked.ID)
+
+	tests := []struct {
+		name       string
+		caller     jobCaller
+		wantStatus int
+		wantScopes []string
+	}{
+		{name: "api key", caller: jobCaller{Kind: IdentityAPIKey, Subject: key.ID}, wantScopes: []string{apikey.ScopeLogWrite}},
+		{name: "revoked api key", caller: jobCaller{Kind: IdentityAPIKey, Subject: revoked.ID}, wantStatus: http.StatusUnauthorized},
+		{name: "unknown api key", caller: jobCaller{Kind: IdentityAPIKey, Subject: "0000"}, wantStatus: http.StatusUnauthorized},
+		{name: "user with a current session", caller: jobCaller{Kind: IdentityUser, Subject: "1", Version: 2}},
+		{name: "user whose sessions were revoked since", caller: jobCaller{Kind: IdentityUser, Subject: "1", Version: 1}, wantStatus: http.StatusUnauthorized},
+		{name: "unknown user", caller: jobCaller{Kind: IdentityUser, Subject: "7", Version: 1}, wantStatus: http.StatusUnauthorized},
+		{name: "no caller", caller: jobCaller{}, wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := app.lookupCaller(context.Background(), tt.caller)
+			if tt.wantStatus != 0 {
+				if status := errorStatus(err); err == nil || status != tt.wantStatus {
+					t.Fatalf("lookupCaller = %+v, %v; want status %d", id, err, tt.wantStatus)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if id.Kind != tt.caller.Kind || id.Subject != tt.caller.Subject || len(id.Scopes) != len(tt.wantScopes) {
+				t.Errorf("identity = %+v", id)
+			}
+		})
+	}
+}
+
+func TestLookupCallerAuthUnavailable(t *testing.T) {
+	app := newJobApp(t)
+	registry, err := discovery.NewRegistry(authSource("127.0.0.1:1"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.Sessions.outbound = outbound.NewClient(registry, outbound.Policy{Timeout: time.Second}, nil)
+
+	_, err = app.lookupCaller(context.Background(), jobCaller{Kind: IdentityUser, Subject: "1", Version: 2})
+	if status := errorStatus(err); status != http.StatusServiceUnavailable {
+		t.Errorf("lookupCaller: %v (status %d), want a 503", err, status)
+	}
+}
+
+// jobEvent wraps a raw job message the way it arrives from RabbitMQ
+func jobEvent(t *testing.T, msg string) cloudevent.Envelope {
+	t.Helper()
+
+	e, err := cloudevent.New(eventSource, cloudevent.TypeJob, json.RawMessage(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return e
+}
+
+func TestHandleJobIgnoresClaimedScopes(t *testing.T) {
+	app := newJobApp(t)
+
+	key, _, err := app.Keys.Create("ci", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.Keys.Revoke(key.ID)
+
+	// the message claims a full identity, as jobs used to carry; only the reference counts
+	msg := `{"job_id": "j1", "request": {"action": "mail"},
+		"caller": {"kind": "api-key", "sub": "` + key.ID + `"},
+		"identity": {"kind": "api-key", "sub": "` + key.ID + `", "scopes": ["mail:send"]}}`
+
+	err = app.handleJob(context.Background(), jobEvent(t, msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job, err := app.Jobs.Get("j1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != jobs.StatusFailed || job.HTTPStatus != http.StatusUnauthorized {
+		t.Errorf("job = %+v, want it failed with a 401", job)
+	}
+	if job.Owner != IdentityAPIKey+":"+key.ID {
+		t.Errorf("owner = %q", job.Owner)
+	}
+}
+
+func TestHandleJobForAnotherCallersJob(t *testing.T) {
+	app := newJobApp(t)
+
+	job, err := jobs.New("mail", IdentityUser+":1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.Jobs.Create(job)
+
+	msg := `{"job_id": "` + job.ID + `", "request": {"action": "mail"}, "caller": {"kind": "user", "sub": "2", "ver": 1}}`
+	err = app.handleJob(context.Background(), jobEvent(t, msg))
+	if err == nil {
+		t.Fatal("a message naming another caller ran the job")
+	}
+
+	got, _ := app.Jobs.Get(job.ID)
+	if got.Status != jobs.StatusPending {
+		t.Errorf("job = %+v, want it left pending", got)
+	}
+}
+
+func TestHandleJobWrongType(t *testing.T) {
+	app := newJobApp(t)
+
+	e, err := cloudevent.New(eventSource, cloudevent.TypeLog, map[string]string{"name": "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = app.handleJob(context.Background(), e)
+	if err == nil {
+		t.Error("handleJob ran a log event as a job")
+	}
+}
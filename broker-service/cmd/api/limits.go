@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+type clientIPKey struct{}
+
+// trackClient is middleware that records the caller's IP address in the request
+// context, for clients that don't identify themselves any other way
+func (app *App) trackClient(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+
+		ctx := context.WithValue(r.Context(), clientIPKey{}, ip)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// clientKey identifies the caller in ctx for rate limiting: the authenticated subject
+// if there is one, otherwise the IP address the request came from
+func clientKey(ctx context.Context) string {
+	if id, ok := identityFrom(ctx); ok {
+		return id.Kind + ":" + id.Subject
+	}
+
+	if ip, ok := ctx.Value(clientIPKey{}).(string); ok {
+		return "ip:" + ip
+	}
+
+	return "anonymous"
+}
+
+type limitsCheckedKey struct{}
+
+// withLimitsChecked marks ctx as belonging to work that has already been counted against
+// the caller's limits, such as a queued job that was checked when it was accepted
+func withLimitsChecked(ctx context.Context) context.Context {
+	return context.WithValue(ctx, limitsCheckedKey{}, true)
+}
+
+// retryInfo is returned as data with a 429, and becomes the Retry-After header
+type retryInfo struct {
+	RetryAfter int `json:"retry_after"`
+}
+
+// checkLimits counts one run of action against the caller's rate limit and quota
+func (app *App) checkLimits(ctx context.Context, action *Action) error {
+	if checked, _ := ctx.Value(limitsCheckedKey{}).(bool); checked {
+		return nil
+	}
+
+	decision, err := app.Limiter.Allow(ctx, clientKey(ctx), action.Name)
+	if err != nil {
+		// a broken limiter store shouldn't take the broker down with it
+		log.Println("rate limiter:", err)
+		return nil
+	}
+
+	if !decision.Allowed {
+		return &actionError{
+			Status: http.StatusTooManyRequests,
+			Err:    errors.New(decision.Reason),
+			Data:   retryInfo{RetryAfter: int(math.Ceil(decision.RetryAfter.Seconds()))},
+		}
+	}
+
+	return nil
+}
+
+// writeResult sends the result of an action, adding Retry-After when the caller was limited
+func (app *App) writeResult(w http.ResponseWriter, status int, payload responsePayload) {
+	if ri, ok := payload.Data.(retryInfo); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(ri.RetryAfter))
+	}
+
+	app.WriteJSON(w, status, payload)
+}
+
+// Quotas reports how much of each daily quota the caller has used today
+func (app *App) Quotas(w http.ResponseWriter, r *http.Request) {
+	client := clientKey(r.Context())
+
+	quotas, err := app.Limiter.Quotas(r.Context(), client, app.Actions.Names())
+	if err != nil {
+		app.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	payload := responsePayload{
+		Error:   false,
+		Message: fmt.Sprintf("quotas for %s", client),
+		Data:    quotas,
+	}
+
+	app.WriteJSON(w, http.StatusOK, payload)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// defaultLogTransports is the order log transports are tried in when LOG_TRANSPORTS is unset
+var defaultLogTransports = []string{TransportRPC, TransportGRPC, TransportHTTP, TransportAMQP}
+
+// logTransportFunc writes one entry to the logger over a particular transport
+type logTransportFunc func(ctx context.Context, l LogPayload) (responsePayload, error)
+
+// logTransports maps transport names to the functions that use them
+func (app *App) logTransports() map[string]logTransportFunc {
+	return map[string]logTransportFunc{
+		TransportHTTP: app.Log,
+		TransportRPC:  app.logItemViaRPC,
+		TransportGRPC: app.logItemViaGRPC,
+		TransportAMQP: app.logEventViaRabbit,
+	}
+}
+
+// parseLogTransports reads a comma-separated transport order, e.g. "grpc,rpc,amqp".
+// An empty string yields the default order.
+func parseLogTransports(s string) ([]string, error) {
+	if strings.TrimSpace(s) == "" {
+		return defaultLogTransports, nil
+	}
+
+	var order []string
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !validLogTransport(name) {
+			return nil, fmt.Errorf("unknown log transport %q", name)
+		}
+		if !seen[name] {
+			seen[name] = true
+			order = append(order, name)
+		}
+	}
+
+	return order, nil
+}
+
+func validLogTransport(name string) bool {
+	for _, t := range defaultLogTransports {
+		if t == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// logAttempt records a transport that failed before the entry was delivered
+type logAttempt struct {
+	Transport string `json:"transport"`
+	Error     string `json:"error"`
+}
+
+// logResult is the data returned by the log action
+type logResult struct {
+	Transport string       `json:"transport"`
+	Fallbacks []logAttempt `json:"fallbacks,omitempty"`
+}
+
+// LogEntry is the "log" action. It tries the configured transports in order, starting
+// with the one named in the payload if there is one, and reports which transport
+// delivered the entry.
+func (app *App) LogEntry(ctx context.Context, l LogPayload) (responsePayload, error) {
+	order := app.LogTransports
+	if l.Transport != "" {
+		preferred := strings.ToLower(l.Transport)
+		if !validLogTransport(preferred) {
+			return responsePayload{}, newActionError(http.StatusBadRequest,
+				fmt.Errorf("unknown log transport %q, expected one of %s", l.Transport, strings.Join(defaultLogTransports, ", ")))
+		}
+
+		order = []string{preferred}
+		for _, t := range app.LogTransports {
+			if t != preferred {
+				order = append(order, t)
+			}
+		}
+	}
+
+	transports := app.logTransports()
+
+	var attempts []logAttempt
+	var err error
+	for _, name := range order {
+		var payload responsePayload
+		payload, err = transports[name](ctx, l)
+		if err == nil {
+			payload.Data = logResult{Transport: name, Fallbacks: attempts}
+			return payload, nil
+		}
+
+		if ctx.Err() != nil {
+			return responsePayload{}, err
+		}
+
+		log.Printf("log transport %s failed, trying the next one: %s", name, err)
+		attempts = append(attempts, logAttempt{Transport: name, Error: err.Error()})
+	}
+
+	return responsePayload{}, newActionError(errorStatus(err), fmt.Errorf("could not log entry over any transport: %w", err))
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"broker/apikey"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// openAPIDoc is an OpenAPI 3 document
+type openAPIDoc struct {
+	OpenAPI    string                           `json:"openapi"`
+	Info       openAPIInfo                      `json:"info"`
+	Paths      map[string]map[string]*operation `json:"paths"`
+	Components openAPIComponents                `json:"components"`
+}
+
+type openAPIInfo struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+type openAPIComponents struct {
+	Schemas         map[string]*Schema        `json:"schemas"`
+	SecuritySchemes map[string]securityScheme `json:"securitySchemes"`
+}
+
+type securityScheme struct {
+	Type         string `json:"type"`
+	Scheme       string `json:"scheme,omitempty"`
+	BearerFormat string `json:"bearerFormat,omitempty"`
+	In           string `json:"in,omitempty"`
+	Name         string `json:"name,omitempty"`
+}
+
+type operation struct {
+	Summary     string                `json:"summary"`
+	OperationID string                `json:"operationId"`
+	Parameters  []parameter           `json:"parameters,omitempty"`
+	RequestBody *requestBody          `json:"requestBody,omitempty"`
+	Responses   map[string]response   `json:"responses"`
+	Security    []map[string][]string `json:"security,omitempty"`
+}
+
+type parameter struct {
+	Name     string  `json:"name"`
+	In       string  `json:"in"`
+	Required bool    `json:"required"`
+	Schema   *Schema `json:"schema"`
+}
+
+type requestBody struct {
+	Required bool                 `json:"required"`
+	Content  map[string]mediaType `json:"content"`
+}
+
+type response struct {
+	Description string               `json:"description"`
+	Content     map[string]mediaType `json:"content,omitempty"`
+}
+
+type mediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+// routeDoc describes a route for the OpenAPI document
+type routeDoc struct {
+	summary string
+	body    *Schema
+	// responses maps status codes to descriptions; every response has a JSON body
+	responses map[string]string
+	// bearer marks routes that read a bearer token or API key
+	bearer bool
+	// admin marks routes that need the admin token
+	admin bool
+	// keyOrAdmin marks routes that need an API key or the admin token
+	keyOrAdmin bool
+}
+
+func ref(name string) *Schema {
+	return &Schema{Ref: "#/components/schemas/" + name}
+}
+
+func jsonContent(s *Schema) map[string]mediaType {
+	return map[string]mediaType{"application/json": {Schema: s}}
+}
+
+// routeDocs documents the broker's routes, keyed by method and route pattern
+func (app *App) routeDocs() map[string]routeDoc {
+	return map[string]routeDoc{
+		"POST /": {summary: "Check that the broker is up"},
+		"POST /handle": {
+			summary: "Run an action",
+			body:    ref("HandleRequest"),
+			responses: map[string]string{
+				"202": "The action ran, or was queued when async is set",
+				"400": "Unknown action or invalid payload; data.errors lists the fields at fault",
+				"401": "The action needs a bearer token",
+				"429": "Rate limit or daily quota exceeded",
+				"503": "The downstream service is unavailable",
+			},
+			bearer: true,
+		},
+		"POST /handle/batch": {
+			summary: "Run several actions in one request",
+			body:    ref("BatchRequest"),
+			responses: map[string]string{
+				"200": "One result per item",
+				"400": "Malformed batch",
+			},
+			bearer: true,
+		},
+		"GET /quotas": {summary: "Show the caller's rate limit and daily quota usage", bearer: true},
+		"POST /token/refresh": {
+			summary: "Exchange a refresh token for a new token pair",
+			body: &Schema{
+				Type:       "object",
+				Properties: map[string]*Schema{"refresh_token": {Type: "string"}},
+				Required:   []string{"refresh_token"},
+			},
+			responses: map[string]string{"200": "A new token pair", "401": "The refresh token is invalid, expired, used or revoked", "503": "The auth service can't be asked about the user's sessions"},
+		},
+		"GET /.well-known/jwks.json": {summary: "Public keys for verifying broker-issued tokens"},
+		"GET /jobs/{id}": {
+			summary:   "Status and result of an async action, for the caller that queued it",
+			bearer:    true,
+			responses: map[string]string{"200": "The job", "401": "No API key or bearer token", "404": "No such job, or it belongs to someone else"},
+		},
+		"GET /actions":   {summary: "List the actions /handle can run, with their payload schemas"},
+		"POST /log-grpc": {summary: "Write a log entry over gRPC (deprecated, use the log action)", body: ref("HandleRequest")},
+		"GET /events": {
+			summary:    "Stream action results and live log events as Server-Sent Events; filter with ?topic=log.ERROR,action.*. Needs an events:read API key or the admin token",
+			keyOrAdmin: true,
+			responses:  map[string]string{"200": "A text/event-stream of JSON messages", "403": "No access to the stream, or origin not allowed"},
+		},
+		"GET /events/ws": {
+			summary:    "The same stream as /events, over a WebSocket",
+			keyOrAdmin: true,
+			responses:  map[string]string{"101": "Switching to the WebSocket protocol", "403": "No access to the stream, or origin not allowed"},
+		},
+		"GET /health/ready":   {summary: "Readiness, including the RabbitMQ connection", responses: map[string]string{"200": "Ready", "503": "Not ready"}},
+		"GET /metrics":        {summary: "Prometheus metrics; takes METRICS_TOKEN or the admin token", admin: true},
+		"GET /openapi.json":   {summary: "This document"},
+		"GET /admin/breakers": {summary: "Circuit breaker state per downstream service", admin: true},
+		"GET /admin/pools":    {summary: "Connections held to the logger", admin: true},
+		"POST /admin/keys": {
+			summary: "Create an API key; the key is only shown in this response",
+			body: &Schema{
+				Type: "object",
+				Properties: map[string]*Schema{
+					"name":   {Type: "string"},
+					"scopes": {Type: "array", Items: &Schema{Type: "string", Enum: apikey.Scopes}},
+				},
+				Required: []string{"name"},
+			},
+			responses: map[string]string{"201": "The new key", "400": "Missing name or unknown scope", "401": "Admin token required"},
+			admin:     true,
+		},
+		"GET /admin/keys":         {summary: "List API keys, without their secrets", admin: true},
+		"DELETE /admin/keys/{id}": {summary: "Revoke an API key", responses: map[string]string{"200": "The revoked key", "404": "No such key"}, admin: true},
+		"DELETE /admin/sessions/{subject}": {
+			summary:   "Revoke every token issued to a user so far, on every broker",
+			responses: map[string]string{"200": "Sessions revoked", "404": "No such user", "502": "The auth service could not be reached"},
+			admin:     true,
+		},
+	}
+}
+
+// openAPI builds the document from the router and the action registry, so that it
+// always matches what the broker actually serves
+func (app *App) openAPI() openAPIDoc {
+	doc := openAPIDoc{
+		OpenAPI: "3.0.3",
+		Info: openAPIInfo{
+			Title:       "Broker Service",
+			Version:     "1.0.0",
+			Description: "Single point of entry to the go-micro services.",
+		},
+		Paths: make(map[string]map[string]*operation),
+		Components: openAPIComponents{
+			Schemas: app.openAPISchemas(),
+			SecuritySchemes: map[string]securityScheme{
+				"bearer": {Type: "http", Scheme: "bearer", BearerFormat: "JWT"},
+				"apiKey": {Type: "apiKey", In: "header", Name: apiKeyHeader},
+				"admin":  {Type: "http", Scheme: "bearer"},
+			},
+		},
+	}
+
+	docs := app.routeDocs()
+
+	routes, ok := app.routes().(chi.Routes)
+	if !ok {
+		return doc
+	}
+
+	_ = chi.Walk(routes, func(method, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+		route = strings.TrimSuffix(route, "/*")
+		if route != "/" {
+			route = strings.TrimSuffix(route, "/")
+		}
+
+		d, ok := docs[method+" "+route]
+		if !ok {
+			// routes mounted with Handle answer every method; only list the documented one
+			if documented(docs, route) {
+				return nil
+			}
+			d = routeDoc{summary: method + " " + route}
+		}
+
+		op := &operation{
+			Summary:     d.summary,
+			OperationID: operationID(method, route),
+			Responses:   make(map[string]response),
+		}
+
+		for _, name := range pathParams(route) {
+			op.Parameters = append(op.Parameters, parameter{Name: name, In: "path", Required: true, Schema: &Schema{Type: "string"}})
+		}
+
+		if d.body != nil {
+			op.RequestBody = &requestBody{Required: true, Content: jsonContent(d.body)}
+		}
+
+		if len(d.responses) == 0 {
+			op.Responses["200"] = response{Description: "OK", Content: jsonContent(ref("Response"))}
+		}
+		for code, desc := range d.responses {
+			schema := ref("Response")
+			if code >= "400" {
+				schema = ref("ErrorResponse")
+			}
+			op.Responses[code] = response{Description: desc, Content: jsonContent(schema)}
+		}
+
+		if d.bearer {
+			// the token is optional unless the action is protected
+			op.Security = []map[string][]string{{"bearer": {}}, {"apiKey": {}}, {}}
+		}
+		if d.admin {
+			op.Security = []map[string][]string{{"admin": {}}}
+		}
+		if d.keyOrAdmin {
+			op.Security = []map[string][]string{{"apiKey": {}}, {"admin": {}}}
+		}
+
+		if doc.Paths[route] == nil {
+			doc.Paths[route] = make(map[string]*operation)
+		}
+		doc.Paths[route][strings.ToLower(method)] = op
+
+		return nil
+	})
+
+	return doc
+}
+
+// openAPISchemas returns the shared schemas, including one /handle body per action
+func (app *App) openAPISchemas() map[string]*Schema {
+	schemas := map[string]*Schema{
+		"Response": schemaFor(reflect.TypeOf(responsePayload{})),
+		"ErrorResponse": {
+			Type: "object",
+			Properties: map[string]*Schema{
+				"error":   {Type: "boolean"},
+				"message": {Type: "string"},
+				"data": {
+					Type: "object",
+					Properties: map[string]*Schema{
+						"errors": {Type: "array", Items: ref("FieldError")},
+					},
+				},
+			},
+			Required: []string{"error", "message"},
+		},
+		"FieldError": schemaFor(reflect.TypeOf(FieldError{})),
+		"BatchRequest": {
+			Type: "object",
+			Properties: map[string]*Schema{
+				"items":           {Type: "array", Items: ref("HandleRequest")},
+				"sequential":      {Type: "boolean"},
+				"stop_on_failure": {Type: "boolean"},
+			},
+			Required: []string{"items"},
+		},
+	}
+
+	handle := &Schema{Description: "Body of a /handle request; one variant per action"}
+	for _, a := range app.Actions.All() {
+		name := "Action" + strings.ToUpper(a.Name[:1]) + a.Name[1:]
+		description := "Runs " + a.Name + " on " + a.Service
+		if a.Protected {
+			description += "; needs a bearer token"
+		}
+
+		schemas[name] = &Schema{
+			Type:        "object",
+			Description: description,
+			Properties: map[string]*Schema{
+				"action": {Type: "string", Enum: []string{a.Name}},
+				"async":  {Type: "boolean"},
+				a.Field:  a.Schema,
+			},
+			Required: []string{"action", a.Field},
+		}
+		handle.OneOf = append(handle.OneOf, ref(name))
+	}
+	schemas["HandleRequest"] = handle
+
+	return schemas
+}
+
+// OpenAPI serves the OpenAPI document for the broker
+func (app *App) OpenAPI(w http.ResponseWriter, r *http.Request) {
+	_ = app.WriteJSON(w, http.StatusOK, app.openAPI())
+}
+
+// documented reports whether docs describes route under any method
+func documented(docs map[string]routeDoc, route string) bool {
+	for key := range docs {
+		_, r, _ := strings.Cut(key, " ")
+		if r == route {
+			return true
+		}
+	}
+
+	return false
+}
+
+// operationID turns "GET /jobs/{id}" into "getJobsId"
+func operationID(method, route string) string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(method))
+
+	upper := true
+	for _, r := range route {
+		switch {
+		case r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9':
+			if upper && r >= 'a' && r <= 'z' {
+				r -= 'a' - 'A'
+			}
+			b.WriteRune(r)
+			upper = false
+		default:
+			upper = true
+		}
+	}
+
+	return b.String()
+}
+
+// pathParams returns the names of the {params} in a chi route
+func pathParams(route string) []string {
+	var names []string
+	for _, part := range strings.Split(route, "/") {
+		if strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}") {
+			name, _, _ := strings.Cut(part[1:len(part)-1], ":")
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
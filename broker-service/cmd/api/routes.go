@@ -15,20 +15,75 @@ func (app *App) routes() http.Handler {
 	mux.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   []string{"https://*", "http://*"},
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token", apiKeyHeader},
 		AllowCredentials: true,
 		MaxAge:           300,
 	}))
 
 	mux.Use(middleware.Heartbeat("/ping"))
+	mux.Use(nameSpan)
+	mux.Use(app.Metrics.Middleware)
 
 	//Check if the server is responding with no error
 	mux.Post("/", app.Broker)
 
-	//single point of entry for microservices
-	mux.Post("/handle", app.HandleSubmission)
+	mux.Group(func(mux chi.Router) {
+		mux.Use(app.trackClient)
+		mux.Use(app.authenticate)
+
+		//single point of entry for microservices
+		mux.Post("/handle", app.HandleSubmission)
+
+		//run several actions in one request
+		mux.Post("/handle/batch", app.HandleBatch)
+
+		//how much of each daily quota the caller has left
+		mux.Get("/quotas", app.Quotas)
+
+		//status and result of an async action, for the caller that queued it
+		mux.Get("/jobs/{id}", app.GetJob)
+	})
+
+	//exchange a refresh token for a new token pair
+	mux.Post("/token/refresh", app.RefreshToken)
+
+	//public keys for verifying broker-issued tokens
+	mux.Get("/.well-known/jwks.json", app.JWKS)
+
+	//list the actions /handle can dispatch
+	mux.Get("/actions", app.ListActions)
 
 	mux.Post("/log-grpc", app.LogViaGRPC)
 
+	//live action results and log events, as Server-Sent Events or over a WebSocket, for
+	//events:read API keys and admins
+	mux.Group(func(mux chi.Router) {
+		mux.Use(app.trackClient)
+		mux.Use(app.requireStream)
+		mux.Get("/events", app.Events)
+		mux.Get("/events/ws", app.EventsWS)
+	})
+
+	//readiness, including the RabbitMQ connection
+	mux.Get("/health/ready", app.Ready)
+
+	//OpenAPI document describing every route and action
+	mux.Get("/openapi.json", app.OpenAPI)
+
+	//prometheus metrics, behind METRICS_TOKEN or ADMIN_TOKEN
+	mux.With(app.requireMetrics).Handle("/metrics", app.Metrics.Handler())
+
+	//operational endpoints, API keys for machine clients and session revocation, behind ADMIN_TOKEN
+	mux.Route("/admin", func(mux chi.Router) {
+		mux.Use(app.requireAdmin)
+
+		mux.Get("/breakers", app.ListBreakers)
+		mux.Get("/pools", app.ListPools)
+		mux.Post("/keys", app.CreateKey)
+		mux.Get("/keys", app.ListKeys)
+		mux.Delete("/keys/{id}", app.RevokeKey)
+		mux.Delete("/sessions/{subject}", app.RevokeSessions)
+	})
+
 	return mux
 }
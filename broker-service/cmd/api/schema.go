@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/mail"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Schema is the subset of JSON Schema the broker uses to describe payloads. It doubles
+// as the OpenAPI 3 schema object in /openapi.json and as the rules payloads are
+// validated against.
+type Schema struct {
+	Ref         string             `json:"$ref,omitempty"`
+	Type        string             `json:"type,omitempty"`
+	Format      string             `json:"format,omitempty"`
+	Description string             `json:"description,omitempty"`
+	Properties  map[string]*Schema `json:"properties,omitempty"`
+	Required    []string           `json:"required,omitempty"`
+	Items       *Schema            `json:"items,omitempty"`
+	Enum        []string           `json:"enum,omitempty"`
+	MinLength   *int               `json:"minLength,omitempty"`
+	MaxLength   *int               `json:"maxLength,omitempty"`
+	OneOf       []*Schema          `json:"oneOf,omitempty"`
+}
+
+// FieldError describes one field of a payload that failed validation
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// schemaFor builds a Schema from a Go type, following encoding/json naming rules.
+//
+// Struct fields can add constraints with a validate tag, for example
+// `validate:"required,email,max=255"`:
+//
+//	required   the field must be present; strings must also be non-empty
+//	email      the string must be a bare email address (format: email)
+//	min=N      the string must be at least N characters long
+//	max=N      the string must be at most N characters long
+//	oneof=a b  the string must be one of the space separated values
+func schemaFor(t reflect.Type) *Schema {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Items: schemaFor(t.Elem())}
+	case reflect.Struct:
+		s := &Schema{Type: "object", Properties: make(map[string]*Schema)}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+
+			name := f.Name
+			if tag, ok := f.Tag.Lookup("json"); ok {
+				tagName, _, _ := strings.Cut(tag, ",")
+				if tagName == "-" {
+					continue
+				}
+				if tagName != "" {
+					name = tagName
+				}
+			}
+
+			prop := schemaFor(f.Type)
+			if applyRules(prop, f.Tag.Get("validate")) {
+				s.Required = append(s.Required, name)
+			}
+			s.Properties[name] = prop
+		}
+		return s
+	default:
+		return &Schema{Type: "object"}
+	}
+}
+
+// applyRules adds the constraints in a validate tag to s and reports whether the
+// field is required
+func applyRules(s *Schema, tag string) bool {
+	required := false
+
+	for _, rule := range strings.Split(tag, ",") {
+		name, arg, _ := strings.Cut(rule, "=")
+		switch name {
+		case "required":
+			required = true
+			if s.Type == "string" && s.MinLength == nil {
+				one := 1
+				s.MinLength = &one
+			}
+		case "email":
+			s.Format = "email"
+		case "min":
+			if n, err := strconv.Atoi(arg); err == nil {
+				s.MinLength = &n
+			}
+		case "max":
+			if n, err := strconv.Atoi(arg); err == nil {
+				s.MaxLength = &n
+			}
+		case "oneof":
+			s.Enum = strings.Fields(arg)
+		}
+	}
+
+	return required
+}
+
+// Validate checks raw against the schema and returns every field that doesn't match.
+// path names the value in error messages. A missing value is checked as an empty object.
+func (s *Schema) Validate(path string, raw json.RawMessage) []FieldError {
+	if len(raw) == 0 {
+		raw = json.RawMessage("{}")
+	}
+
+	var v any
+	err := json.Unmarshal(raw, &v)
+	if err != nil {
+		return []FieldError{{Field: path, Message: "must be valid JSON"}}
+	}
+
+	return s.validate(path, v)
+}
+
+func (s *Schema) validate(path string, v any) []FieldError {
+	fail := func(format string, args ...any) []FieldError {
+		return []FieldError{{Field: path, Message: fmt.Sprintf(format, args...)}}
+	}
+
+	switch s.Type {
+	case "object":
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return fail("must be an object")
+		}
+
+		// null is no more an answer to a required field than leaving it out
+		var errs []FieldError
+		for _, name := range s.Required {
+			if value, ok := obj[name]; !ok || value == nil {
+				errs = append(errs, FieldError{Field: join(path, name), Message: "is required"})
+			}
+		}
+
+		names := make([]string, 0, len(s.Properties))
+		for name := range s.Properties {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		for _, name := range names {
+			if value, ok := obj[name]; ok && (value != nil || !slices.Contains(s.Required, name)) {
+				errs = append(errs, s.Properties[name].validate(join(path, name), value)...)
+			}
+		}
+		return errs
+
+	case "array":
+		arr, ok := v.([]any)
+		if !ok {
+			return fail("must be an array")
+		}
+
+		var errs []FieldError
+		for i, item := range arr {
+			errs = append(errs, s.Items.validate(fmt.Sprintf("%s[%d]", path, i), item)...)
+		}
+		return errs
+
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			return fail("must be a string")
+		}
+
+		n := len([]rune(str))
+		if s.MinLength != nil && n < *s.MinLength {
+			if *s.MinLength == 1 {
+				return fail("must not be empty")
+			}
+			return fail("must be at least %d characters", *s.MinLength)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			return fail("must be at most %d characters", *s.MaxLength)
+		}
+		// an optional string left empty is treated as not given
+		if str == "" {
+			return nil
+		}
+		if len(s.Enum) > 0 && !slices.Contains(s.Enum, str) {
+			return fail("must be one of %s", strings.Join(s.Enum, ", "))
+		}
+		if s.Format == "email" {
+			addr, err := mail.ParseAddress(str)
+			if err != nil || addr.Address != str {
+				return fail("must be a valid email address")
+			}
+		}
+		return nil
+
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return fail("must be a boolean")
+		}
+	case "integer":
+		f, ok := v.(float64)
+		if !ok || f != float64(int64(f)) {
+			return fail("must be an integer")
+		}
+	case "number":
+		if _, ok := v.(float64); !ok {
+			return fail("must be a number")
+		}
+	}
+
+	return nil
+}
+
+func join(path, name string) string {
+	if path == "" {
+		return name
+	}
+
+	return path + "." + name
+}
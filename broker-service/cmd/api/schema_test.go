@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSchemaFor(t *testing.T) {
+	s := schemaFor(reflect.TypeOf(MailPayload{}))
+
+	if s.Type != "object" {
+		t.Fatalf("type = %q, want object", s.Type)
+	}
+	if !slices.Equal(s.Required, []string{"to", "subject", "message"}) {
+		t.Errorf("required = %v", s.Required)
+	}
+
+	tests := []struct {
+		field     string
+		format    string
+		minLength int
+		maxLength int
+	}{
+		{field: "from", format: "email"},
+		{field: "to", format: "email", minLength: 1},
+		{field: "subject", minLength: 1, maxLength: 255},
+		{field: "message", minLength: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.field, func(t *testing.T) {
+			prop, ok := s.Properties[tt.field]
+			if !ok {
+				t.Fatal("missing property")
+			}
+			if prop.Type != "string" || prop.Format != tt.format {
+				t.Errorf("type %q format %q, want string %q", prop.Type, prop.Format, tt.format)
+			}
+			if got := intOrZero(prop.MinLength); got != tt.minLength {
+				t.Errorf("minLength = %d, want %d", got, tt.minLength)
+			}
+			if got := intOrZero(prop.MaxLength); got != tt.maxLength {
+				t.Errorf("maxLength = %d, want %d", got, tt.maxLength)
+			}
+		})
+	}
+
+	transport := schemaFor(reflect.TypeOf(LogPayload{})).Properties["transport"]
+	if !slices.Equal(transport.Enum, []string{"rpc", "grpc", "http", "amqp"}) {
+		t.Errorf("transport enum = %v", transport.Enum)
+	}
+}
+
+func intOrZero(n *int) int {
+	if n == nil {
+		return 0
+	}
+
+	return *n
+}
+
+func TestValidate(t *testing.T) {
+	type nested struct {
+		Tags  []string `json:"tags"`
+		Count int      `json:"count"`
+		Quiet bool     `json:"quiet"`
+	}
+
+	tests := []struct {
+		name string
+		typ  any
+		raw  string
+		want []FieldError
+	}{
+		{name: "valid", typ: MailPayload{}, raw: `{"to":"a@example.com","subject":"hi","message":"hello"}`},
+		{name: "missing body", typ: AuthPayload{}, raw: ``, want: []FieldError{
+			{Field: "payload.email", Message: "is required"},
+			{Field: "payload.password", Message: "is required"},
+		}},
+		{name: "null required field", typ: AuthPayload{}, raw: `{"email":null,"password":"x"}`, want: []FieldError{
+			{Field: "payload.email", Message: "is required"},
+		}},
+		{name: "empty required string", typ: AuthPayload{}, raw: `{"email":"a@example.com","password":""}`, want: []FieldError{
+			{Field: "payload.password", Message: "must not be empty"},
+		}},
+		{name: "bad email", typ: AuthPayload{}, raw: `{"email":"Alice <a@example.com>","password":"x"}`, want: []FieldError{
+			{Field: "payload.email", Message: "must be a valid email address"},
+		}},
+		{name: "optional email left empty", typ: MailPayload{}, raw: `{"from":"","to":"a@example.com","subject":"hi","message":"hello"}`},
+		{name: "too long", typ: LogsPayload{}, raw: `{"name":"` + strings.Repeat("x", 256) + `"}`, want: []FieldError{
+			{Field: "payload.name", Message: "must be at most 255 characters"},
+		}},
+		{name: "not one of", typ: LogPayload{}, raw: `{"name":"n","data":"d","transport":"smtp"}`, want: []FieldError{
+			{Field: "payload.transport", Message: "must be one of rpc, grpc, http, amqp"},
+		}},
+		{name: "null optional field of the wrong type", typ: nested{}, raw: `{"tags":null}`, want: []FieldError{
+			{Field: "payload.tags", Message: "must be an array"},
+		}},
+		{name: "wrong types", typ: nested{}, raw: `{"tags":["a",1],"count":1.5,"quiet":"no"}`, want: []FieldError{
+			{Field: "payload.count", Message: "must be an integer"},
+			{Field: "payload.quiet", Message: "must be a boolean"},
+			{Field: "payload.tags[1]", Message: "must be a string"},
+		}},
+		{name: "not an object", typ: AuthPayload{}, raw: `[]`, want: []FieldError{
+			{Field: "payload", Message: "must be an object"},
+		}},
+		{name: "invalid JSON", typ: AuthPayload{}, raw: `{`, want: []FieldError{
+			{Field: "payload", Message: "must be valid JSON"},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := schemaFor(reflect.TypeOf(tt.typ)).Validate("payload", json.RawMessage(tt.raw))
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Validate = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
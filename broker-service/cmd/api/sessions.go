@@ -0,0 +1,125 @@
+package main
+
+import (
+	"broker/discovery"
+	"broker/outbound"
+	"broker/token"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// errUnknownUser is returned when the auth service has no user for a subject
+var errUnknownUser = errors.New("no such user")
+
+// authSessions keeps session versions with the auth service, which stores them in
+// Postgres, so that a revocation holds on every broker and survives restarts
+type authSessions struct {
+	outbound     *outbound.Client
+	serviceToken string
+}
+
+// session asks the auth service about subject's sessions; revoke moves them to a new
+// version first
+func (s authSessions) session(ctx context.Context, subject string, revoke bool) (version int, active bool, err error) {
+	req := outbound.Request{
+		Service:    discovery.Auth,
+		Method:     "GET",
+		Path:       "/sessions/" + url.PathEscape(subject),
+		Header:     http.Header{"Authorization": {"Bearer " + s.serviceToken}},
+		Idempotent: true,
+	}
+	if revoke {
+		req.Method = "POST"
+		req.Path += "/revoke"
+		req.Idempotent = false
+	}
+
+	response, err := s.outbound.Do(ctx, req)
+	if err != nil {
+		return 0, false, err
+	}
+	defer response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusOK:
+	case http.StatusBadRequest, http.StatusNotFound:
+		return 0, false, errUnknownUser
+	default:
+		return 0, false, fmt.Errorf("auth service answered %d", response.StatusCode)
+	}
+
+	var jsonFromRemote struct {
+		Data struct {
+			Version int  `json:"version"`
+			Active  bool `json:"active"`
+		} `json:"data"`
+	}
+	err = json.NewDecoder(response.Body).Decode(&jsonFromRemote)
+	if err != nil {
+		return 0, false, errors.New("error decoding remote response")
+	}
+
+	return jsonFromRemote.Data.Version, jsonFromRemote.Data.Active, nil
+}
+
+// Version returns the current session version of subject, or token.ErrRevoked if the
+// user is gone or no longer active
+func (s authSessions) Version(ctx context.Context, subject string) (int, error) {
+	version, active, err := s.session(ctx, subject, false)
+	if errors.Is(err, errUnknownUser) || err == nil && !active {
+		return 0, token.ErrRevoked
+	}
+
+	return version, err
+}
+
+// Revoke ends every session of subject, so that the tokens issued to them so far are
+// refused by every broker
+func (s authSessions) Revoke(ctx context.Context, subject string) error {
+	_, _, err := s.session(ctx, subject, true)
+	return err
+}
+
+// UseRefresh records with the auth service that the refresh token id of subject has
+// been exchanged, so that no broker exchanges it again. It isn't retried: a retry of a
+// call that got through would find the token used.
+func (s authSessions) UseRefresh(ctx context.Context, subject, id string, expires time.Time) error {
+	body, err := json.Marshal(struct {
+		TokenID   string    `json:"token_id"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}{id, expires})
+	if err != nil {
+		return err
+	}
+
+	response, err := s.outbound.Do(ctx, outbound.Request{
+		Service: discovery.Auth,
+		Method:  "POST",
+		Path:    "/sessions/" + url.PathEscape(subject) + "/refresh",
+		Body:    body,
+		Header: http.Header{
+			"Authorization": {"Bearer " + s.serviceToken},
+			"Content-Type":  {"application/json"},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusConflict:
+		return token.ErrRefreshUsed
+	case http.StatusBadRequest, http.StatusNotFound:
+		return token.ErrRevoked
+	default:
+		return fmt.Errorf("auth service answered %d", response.StatusCode)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"broker/discovery"
+	"broker/outbound"
+	"broker/token"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUseRefresh(t *testing.T) {
+	var mu sync.Mutex
+	used := map[string]bool{}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Method != "POST" || r.URL.Path != "/sessions/1/refresh" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		var body struct {
+			TokenID string `json:"token_id"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+
+		mu.Lock()
+		defer mu.Unlock()
+		if used[body.TokenID] {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		used[body.TokenID] = true
+	}))
+	defer srv.Close()
+
+	registry, err := discovery.NewRegistry(authSource(srv.URL), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := outbound.NewClient(registry, outbound.Policy{Timeout: time.Second}, nil)
+	expires := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name    string
+		subject string
+		id      string
+		want    error
+	}{
+		{name: "first use", subject: "1", id: "a"},
+		{name: "second use", subject: "1", id: "a", want: token.ErrRefreshUsed},
+		{name: "another token", subject: "1", id: "b"},
+		{name: "unknown user", subject: "7", id: "c", want: token.ErrRevoked},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := authSessions{outbound: client, serviceToken: "test"}
+			err := s.UseRefresh(context.Background(), tt.subject, tt.id, expires)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("UseRefresh err = %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	s := authSessions{outbound: client, serviceToken: "wrong"}
+	err = s.UseRefresh(context.Background(), "1", "d", expires)
+	if err == nil || errors.Is(err, token.ErrRefreshUsed) || errors.Is(err, token.ErrRevoked) {
+		t.Errorf("UseRefresh refused by the auth service: err = %v, want another error", err)
+	}
+}
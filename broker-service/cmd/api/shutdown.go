@@ -0,0 +1,108 @@
+package main
+
+import (
+	"broker/event"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// defaultShutdownTimeout is how long the broker waits for in-flight work when it is
+// asked to stop, unless SHUTDOWN_TIMEOUT says otherwise
+const defaultShutdownTimeout = 30 * time.Second
+
+// outboxReplayInterval is how often the outbox is checked for events to replay
+const outboxReplayInterval = 10 * time.Second
+
+// shutdownTimeout reads SHUTDOWN_TIMEOUT, e.g. "45s"
+func shutdownTimeout() (time.Duration, error) {
+	s := os.Getenv("SHUTDOWN_TIMEOUT")
+	if s == "" {
+		return defaultShutdownTimeout, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("SHUTDOWN_TIMEOUT: %w", err)
+	}
+
+	return d, nil
+}
+
+// serve runs srv and the job worker until the process receives SIGINT or SIGTERM, then
+// shuts down in order: stop accepting connections and let in-flight requests finish,
+// stop taking jobs and let running ones finish, then wait for any publishes still on
+// their way to RabbitMQ. All of it has to fit within timeout.
+//
+// serve returns nil after a clean shutdown, and an error if the server failed or the
+// deadline passed with work still in flight.
+func (app *App) serve(srv *http.Server, timeout time.Duration) error {
+	stop, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	workerCtx, stopWorker := context.WithCancel(context.Background())
+	defer stopWorker()
+
+	workerDone := make(chan struct{})
+	go func() {
+		defer close(workerDone)
+		app.runJobWorker(workerCtx)
+	}()
+
+	// relay logs_topic to /events subscribers
+	go app.runEventTail(workerCtx)
+
+	// end open event streams, which would otherwise hold up srv.Shutdown
+	srv.RegisterOnShutdown(app.Stream.Close)
+
+	// replay events stored in the outbox whenever RabbitMQ is reachable
+	if app.Outbox != nil {
+		go app.Emitter.ReplayOutbox(workerCtx, outboxReplayInterval)
+	}
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
+		return fmt.Errorf("server stopped: %w", err)
+	case <-stop.Done():
+	}
+
+	// a second signal kills the process the usual way
+	cancel()
+
+	log.Printf("Shutting down, waiting up to %s for in-flight work\n", timeout)
+
+	ctx, done := context.WithTimeout(context.Background(), timeout)
+	defer done()
+
+	var errs []error
+
+	err := srv.Shutdown(ctx)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("draining requests: %w", err))
+	}
+
+	stopWorker()
+	select {
+	case <-workerDone:
+	case <-ctx.Done():
+		errs = append(errs, fmt.Errorf("draining jobs: %w", ctx.Err()))
+	}
+
+	err = event.Flush(ctx)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("flushing publishes: %w", err))
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"broker/apikey"
+	"broker/event"
+	"broker/stream"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"shared/cloudevent"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// streamPingInterval keeps idle streams from being closed by proxies
+	streamPingInterval = 25 * time.Second
+	// streamWriteTimeout bounds how long a write to a stalled client may block
+	streamWriteTimeout = 10 * time.Second
+)
+
+// Kinds of stream message.
+const (
+	// KindEvent is an event published to logs_topic, as its envelope
+	KindEvent = "event"
+	// KindResult is the outcome of an action, under the topic action.<name>
+	KindResult = "result"
+	// KindDropped tells a subscriber how many messages it missed by falling behind
+	KindDropped = "dropped"
+)
+
+// actionResult is streamed every time an action finishes. It says which action ran, how
+// it ended and how long it took. The response message isn't included, since it can
+// name the caller ("Authenticated user ..."), and neither is what was returned.
+type actionResult struct {
+	Action     string  `json:"action"`
+	Status     int     `json:"status"`
+	Error      bool    `json:"error"`
+	DurationMS float64 `json:"duration_ms"`
+}
+
+// publishResult streams the outcome of a run of action
+func (app *App) publishResult(action *Action, status int, res responsePayload, started time.Time) {
+	app.Stream.Publish(stream.Message{
+		Topic: "action." + action.Name,
+		Kind:  KindResult,
+		Data: actionResult{
+			Action:     action.Name,
+			Status:     status,
+			Error:      res.Error,
+			DurationMS: float64(time.Since(started).Microseconds()) / 1000,
+		},
+	})
+}
+
+// runEventTail relays the events published to logs_topic, by this broker or any other
+// service, to stream subscribers under their routing key. Jobs are left out, since they
+// carry the caller's payload; their outcome is streamed as an action result instead.
+// Like the job worker, it waits for RabbitMQ to come back whenever the connection
+// drops, and returns once ctx is done.
+func (app *App) runEventTail(ctx context.Context) {
+	for {
+		err := app.Rabbit.WaitReady(ctx)
+		if err != nil {
+			return
+		}
+
+		consumer, err := event.NewConsumer(app.Rabbit)
+		if err == nil {
+			err = consumer.Subscribe(ctx, func(_ context.Context, key string, e cloudevent.Envelope) {
+				if e.Type == cloudevent.TypeJob {
+					return
+				}
+				app.Stream.Publish(stream.Message{Topic: key, Kind: KindEvent, Time: e.Time, Data: e})
+			})
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		log.Println("event stream stopped, restarting:", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// streamTopics reads the topic patterns a client asked for. Patterns can be repeated
+// (?topic=log.ERROR&topic=action.*) or comma separated (?topic=log.ERROR,action.*);
+// none means everything.
+func streamTopics(r *http.Request) []string {
+	var topics []string
+	for _, param := range r.URL.Query()["topic"] {
+		for _, t := range strings.Split(param, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				topics = append(topics, t)
+			}
+		}
+	}
+
+	return topics
+}
+
+// Events streams action results and live events as Server-Sent Events. Each message
+// is sent as an SSE event named after its kind, with the JSON message as data.
+func (app *App) Events(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		app.ErrorJSON(w, errors.New("streaming is not supported"), http.StatusInternalServerError)
+		return
+	}
+
+	sub := app.Stream.Subscribe(streamTopics(r))
+	if sub == nil {
+		app.ErrorJSON(w, errors.New("shutting down"), http.StatusServiceUnavailable)
+		return
+	}
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// stop nginx and friends from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "retry: 3000\n\n")
+	flusher.Flush()
+
+	ping := time.NewTicker(streamPingInterval)
+	defer ping.Stop()
+
+	id := 0
+	send := func(m stream.Message) error {
+		data, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		id++
+		_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", id, m.Kind, data)
+		flusher.Flush()
+		return err
+	}
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ping.C:
+			_, err := fmt.Fprint(w, ": ping\n\n")
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		case m, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			if n := sub.Dropped(); n > 0 {
+				err := send(droppedMessage(n))
+				if err != nil {
+					return
+				}
+			}
+			err := send(m)
+			if err != nil {
+				log.Println("event stream:", err)
+				return
+			}
+		}
+	}
+}
+
+// EventsWS streams action results and live events over a WebSocket, one JSON message
+// per text frame. The stream only goes one way; anything the client sends is ignored.
+func (app *App) EventsWS(w http.ResponseWriter, r *http.Request) {
+	sub := app.Stream.Subscribe(streamTopics(r))
+	if sub == nil {
+		app.ErrorJSON(w, errors.New("shutting down"), http.StatusServiceUnavailable)
+		return
+	}
+	defer sub.Close()
+
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 4096,
+		// requireStream has checked the origin already
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already replied to the client
+		return
+	}
+	defer conn.Close()
+
+	// read until the client goes away, so that control frames are handled
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(streamPingInterval)
+	defer ping.Stop()
+
+	send := func(m stream.Message) error {
+		_ = conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+		return conn.WriteJSON(m)
+	}
+
+	for {
+		select {
+		case <-gone:
+			return
+		case <-ping.C:
+			err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(streamWriteTimeout))
+			if err != nil {
+				return
+			}
+		case m, ok := <-sub.C:
+			if !ok {
+				msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "broker shutting down")
+				_ = conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+				return
+			}
+			if n := sub.Dropped(); n > 0 {
+				if send(droppedMessage(n)) != nil {
+					return
+				}
+			}
+			if send(m) != nil {
+				return
+			}
+		}
+	}
+}
+
+// requireStream is middleware for the event stream, which shows what every caller is
+// doing. It lets through the admin token and API keys granted apikey.ScopeEventsRead,
+// and only from browsers on the broker's own origin or one in StreamOrigins.
+func (app *App) requireStream(next http.Handler) http.Handler {
+	adminToken := os.Getenv("ADMIN_TOKEN")
+
+	withKey := app.authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := identityFrom(r.Context())
+		if !ok || id.Kind != IdentityAPIKey || !slices.Contains(id.Scopes, apikey.ScopeEventsRead) {
+			app.ErrorJSON(w, fmt.Errorf("the event stream needs an API key with the %s scope, or the admin token", apikey.ScopeEventsRead), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.streamOriginAllowed(r) {
+			app.ErrorJSON(w, errors.New("origin not allowed"), http.StatusForbidden)
+			return
+		}
+
+		if adminToken != "" && r.Header.Get(apiKeyHeader) == "" && bearerMatches(r, [][]byte{[]byte(adminToken)}) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		withKey.ServeHTTP(w, r)
+	})
+}
+
+// parseOrigins reads STREAM_ORIGINS, a comma separated list of origins such as
+// http://localhost:8080
+func parseOrigins(s string) []string {
+	var origins []string
+	for _, o := range strings.Split(s, ",") {
+		if o = strings.TrimRight(strings.TrimSpace(o), "/"); o != "" {
+			origins = append(origins, o)
+		}
+	}
+
+	return origins
+}
+
+// streamOriginAllowed reports whether a browser on the origin of r may watch the
+// stream. Requests without an Origin don't come from a browser page.
+func (app *App) streamOriginAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+
+	return slices.ContainsFunc(app.StreamOrigins, func(o string) bool { return strings.EqualFold(o, origin) })
+}
+
+func droppedMessage(n int64) stream.Message {
+	return stream.Message{
+		Topic: "stream.dropped",
+		Kind:  KindDropped,
+		Data:  map[string]int64{"count": n},
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "broker"
+
+// nameSpan renames the server span started by otelhttp after the route that matched,
+// so that /jobs/{id} shows up as one operation rather than one per job
+func nameSpan(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r)
+
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			trace.SpanFromContext(r.Context()).SetName(r.Method + " " + rctx.RoutePattern())
+		}
+	})
+}
+
+// startActionSpan starts the span covering one dispatched action
+func startActionSpan(ctx context.Context, action *Action) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, "action "+action.Name, trace.WithAttributes(
+		attribute.String("broker.action", action.Name),
+		attribute.String("broker.service", action.Service),
+		attribute.String("broker.transport", action.Transport),
+	))
+}
+
+// startRPCSpan starts a client span for a net/rpc call to service.method at addr
+func startRPCSpan(ctx context.Context, addr, service, method string) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, service+"."+method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.RPCSystemKey.String("net/rpc"),
+			semconv.RPCService(service),
+			semconv.RPCMethod(method),
+			semconv.ServerAddress(addr),
+		),
+	)
+}
+
+// endSpan records the outcome of a span that ended with an HTTP style status
+func endSpan(span trace.Span, status int, payload responsePayload) {
+	span.SetAttributes(attribute.Int("broker.status", status))
+	if payload.Error {
+		span.SetStatus(codes.Error, payload.Message)
+	}
+	span.End()
+}
+
+// traceCarrier returns the trace context in ctx as a map, for transports such as
+// net/rpc that have no headers of their own
+func traceCarrier(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+
+	return carrier
+}
@@ -0,0 +1,71 @@
+package discovery
+
+import (
+	"sync"
+)
+
+// Balancing strategies.
+const (
+	RoundRobin       = "round-robin"
+	LeastOutstanding = "least-outstanding"
+)
+
+func validStrategy(s string) bool {
+	return s == RoundRobin || s == LeastOutstanding
+}
+
+// balancer spreads calls for one service across its endpoints. It keeps a count of
+// in-flight calls per address so that least-outstanding can pick the idlest endpoint.
+type balancer struct {
+	strategy string
+
+	mu          sync.Mutex
+	next        int
+	outstanding map[string]int
+}
+
+func newBalancer(strategy string) *balancer {
+	return &balancer{
+		strategy:    strategy,
+		outstanding: make(map[string]int),
+	}
+}
+
+// pick chooses one of endpoints and returns a func that marks the call as finished
+func (b *balancer) pick(endpoints []string) (string, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var addr string
+	switch b.strategy {
+	case LeastOutstanding:
+		// start from the round-robin position so that ties are spread evenly
+		start := b.next % len(endpoints)
+		addr = endpoints[start]
+		for i := 1; i < len(endpoints); i++ {
+			candidate := endpoints[(start+i)%len(endpoints)]
+			if b.outstanding[candidate] < b.outstanding[addr] {
+				addr = candidate
+			}
+		}
+	default:
+		addr = endpoints[b.next%len(endpoints)]
+	}
+	b.next++
+	b.outstanding[addr]++
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+
+			b.outstanding[addr]--
+			if b.outstanding[addr] <= 0 {
+				delete(b.outstanding, addr)
+			}
+		})
+	}
+
+	return addr, release
+}
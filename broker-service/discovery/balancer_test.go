@@ -0,0 +1,84 @@
+package discovery
+
+import (
+	"testing"
+)
+
+func TestRoundRobin(t *testing.T) {
+	b := newBalancer(RoundRobin)
+	endpoints := []string{"a:80", "b:80", "c:80"}
+
+	want := []string{"a:80", "b:80", "c:80", "a:80", "b:80"}
+	for i, w := range want {
+		addr, release := b.pick(endpoints)
+		release()
+		if addr != w {
+			t.Errorf("pick %d = %s, want %s", i, addr, w)
+		}
+	}
+}
+
+func TestLeastOutstanding(t *testing.T) {
+	tests := []struct {
+		name string
+		// busy holds the calls left in flight on each address before the pick
+		busy map[string]int
+		want string
+	}{
+		{name: "idlest endpoint", busy: map[string]int{"a:80": 2, "b:80": 1, "c:80": 3}, want: "b:80"},
+		{name: "untouched endpoint", busy: map[string]int{"a:80": 1, "c:80": 1}, want: "b:80"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newBalancer(LeastOutstanding)
+			for addr, n := range tt.busy {
+				b.outstanding[addr] = n
+			}
+
+			addr, release := b.pick([]string{"a:80", "b:80", "c:80"})
+			defer release()
+			if addr != tt.want {
+				t.Errorf("pick = %s, want %s", addr, tt.want)
+			}
+		})
+	}
+}
+
+func TestLeastOutstandingSpreadsTies(t *testing.T) {
+	b := newBalancer(LeastOutstanding)
+	endpoints := []string{"a:80", "b:80"}
+
+	seen := map[string]int{}
+	for i := 0; i < 4; i++ {
+		addr, release := b.pick(endpoints)
+		release()
+		seen[addr]++
+	}
+
+	if seen["a:80"] != 2 || seen["b:80"] != 2 {
+		t.Errorf("picks = %v, want them spread evenly", seen)
+	}
+}
+
+func TestReleaseOnce(t *testing.T) {
+	b := newBalancer(LeastOutstanding)
+	endpoints := []string{"a:80", "b:80"}
+
+	addr, release := b.pick(endpoints)
+	other, keep := b.pick(endpoints)
+	defer keep()
+	if addr == other {
+		t.Fatalf("both picks went to %s", addr)
+	}
+
+	release()
+	release()
+
+	if n := b.outstanding[other]; n != 1 {
+		t.Errorf("a second release changed another endpoint's count to %d", n)
+	}
+	if _, ok := b.outstanding[addr]; ok {
+		t.Errorf("released endpoint %s still counted", addr)
+	}
+}
@@ -0,0 +1,155 @@
+// Package discovery resolves the broker's downstream services to network endpoints.
+//
+// A Registry asks a Source (environment variables, a static file or DNS SRV records)
+// for the endpoints of a service, falls back to built-in defaults when the source has
+// nothing configured, and load balances across the endpoints it finds.
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Well-known service names used by the broker.
+const (
+	Auth       = "auth"
+	Logger     = "logger"
+	LoggerRPC  = "logger-rpc"
+	LoggerGRPC = "logger-grpc"
+	Mailer     = "mailer"
+)
+
+// Defaults are the docker-compose addresses the broker used before discovery was configurable.
+var Defaults = map[string][]string{
+	Auth:       {"http://auth-service:8080"},
+	Logger:     {"http://logger-service:8080"},
+	LoggerRPC:  {"logger-service:5001"},
+	LoggerGRPC: {"logger-service:50001"},
+	Mailer:     {"http://mailer-service:8080"},
+}
+
+// ErrNoEndpoints is returned when a service has no endpoints in the source or the defaults.
+var ErrNoEndpoints = errors.New("no endpoints available")
+
+// Source looks up the endpoints of a service. It returns an empty slice, not an error,
+// when it knows nothing about the service.
+type Source interface {
+	Endpoints(service string) ([]string, error)
+}
+
+// BalancerSource is implemented by sources that can choose a balancing strategy per service.
+type BalancerSource interface {
+	Balancer(service string) string
+}
+
+// Endpoint is one address a service can be reached on.
+type Endpoint struct {
+	Service string
+	Address string
+}
+
+// URL returns the endpoint as an http URL with path appended
+func (e Endpoint) URL(path string) string {
+	addr := strings.TrimSuffix(e.Address, "/")
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+
+	return addr + path
+}
+
+// Host returns the endpoint as host:port, without any scheme
+func (e Endpoint) Host() string {
+	if _, rest, ok := strings.Cut(e.Address, "://"); ok {
+		return strings.TrimSuffix(rest, "/")
+	}
+
+	return e.Address
+}
+
+// Registry resolves services through a Source and balances calls across their endpoints.
+type Registry struct {
+	source   Source
+	defaults map[string][]string
+	strategy string
+
+	mu        sync.Mutex
+	balancers map[string]*balancer
+}
+
+// NewRegistry creates a registry backed by source. strategy is the default balancing
+// strategy; it is used for every service the source doesn't pick one for.
+func NewRegistry(source Source, strategy string) (*Registry, error) {
+	if strategy == "" {
+		strategy = RoundRobin
+	}
+	if !validStrategy(strategy) {
+		return nil, fmt.Errorf("unknown balancer %q", strategy)
+	}
+
+	return &Registry{
+		source:    source,
+		defaults:  Defaults,
+		strategy:  strategy,
+		balancers: make(map[string]*balancer),
+	}, nil
+}
+
+// Resolve returns every endpoint currently known for service
+func (r *Registry) Resolve(service string) ([]string, error) {
+	var endpoints []string
+	if r.source != nil {
+		var err error
+		endpoints, err = r.source.Endpoints(service)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(endpoints) == 0 {
+		endpoints = r.defaults[service]
+	}
+
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("%s: %w", service, ErrNoEndpoints)
+	}
+
+	return endpoints, nil
+}
+
+// Pick chooses an endpoint for one call to service. The caller must call release once
+// the call has finished so that least-outstanding balancing sees accurate counts.
+func (r *Registry) Pick(service string) (ep Endpoint, release func(), err error) {
+	endpoints, err := r.Resolve(service)
+	if err != nil {
+		return Endpoint{}, nil, err
+	}
+
+	b := r.balancer(service)
+	addr, release := b.pick(endpoints)
+
+	return Endpoint{Service: service, Address: addr}, release, nil
+}
+
+// balancer returns the balancer for service, creating it on first use
+func (r *Registry) balancer(service string) *balancer {
+	strategy := r.strategy
+	if bs, ok := r.source.(BalancerSource); ok {
+		if s := bs.Balancer(service); validStrategy(s) {
+			strategy = s
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	b, ok := r.balancers[service]
+	if !ok || b.strategy != strategy {
+		b = newBalancer(strategy)
+		r.balancers[service] = b
+	}
+
+	return b
+}
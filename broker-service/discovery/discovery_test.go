@@ -0,0 +1,124 @@
+package discovery
+
+import (
+	"errors"
+	"testing"
+)
+
+// mapSource serves endpoints and balancers from maps
+type mapSource struct {
+	endpoints map[string][]string
+	balancers map[string]string
+	err       error
+}
+
+func (s *mapSource) Endpoints(service string) ([]string, error) {
+	return s.endpoints[service], s.err
+}
+
+func (s *mapSource) Balancer(service string) string {
+	return s.balancers[service]
+}
+
+func TestEndpoint(t *testing.T) {
+	tests := []struct {
+		address   string
+		url, host string
+	}{
+		{address: "http://auth-service:8080", url: "http://auth-service:8080/authenticate", host: "auth-service:8080"},
+		{address: "https://auth.example.com/", url: "https://auth.example.com/authenticate", host: "auth.example.com"},
+		{address: "auth-service:8080", url: "http://auth-service:8080/authenticate", host: "auth-service:8080"},
+	}
+
+	for _, tt := range tests {
+		ep := Endpoint{Service: Auth, Address: tt.address}
+		if got := ep.URL("/authenticate"); got != tt.url {
+			t.Errorf("URL of %s = %s, want %s", tt.address, got, tt.url)
+		}
+		if got := ep.Host(); got != tt.host {
+			t.Errorf("Host of %s = %s, want %s", tt.address, got, tt.host)
+		}
+	}
+}
+
+func TestNewRegistryStrategy(t *testing.T) {
+	r, err := NewRegistry(nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.strategy != RoundRobin {
+		t.Errorf("default strategy = %s, want %s", r.strategy, RoundRobin)
+	}
+
+	_, err = NewRegistry(nil, "random")
+	if err == nil {
+		t.Error("NewRegistry accepted an unknown strategy")
+	}
+}
+
+func TestResolve(t *testing.T) {
+	source := &mapSource{endpoints: map[string][]string{Auth: {"auth-1:8080", "auth-2:8080"}}}
+	r, err := NewRegistry(source, RoundRobin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.defaults = map[string][]string{Auth: {"auth-default:8080"}, Mailer: {"mailer-default:8080"}}
+
+	got, err := r.Resolve(Auth)
+	if err != nil || len(got) != 2 {
+		t.Errorf("Resolve(auth) = %v, %v; want the source's two endpoints", got, err)
+	}
+
+	// the source knows nothing about the mailer, so the default is used
+	got, err = r.Resolve(Mailer)
+	if err != nil || len(got) != 1 || got[0] != "mailer-default:8080" {
+		t.Errorf("Resolve(mailer) = %v, %v; want the default", got, err)
+	}
+
+	_, err = r.Resolve("billing")
+	if !errors.Is(err, ErrNoEndpoints) {
+		t.Errorf("Resolve(billing): err = %v, want %v", err, ErrNoEndpoints)
+	}
+
+	// a failing source is reported, not papered over with the defaults
+	source.err = errors.New("lookup failed")
+	_, err = r.Resolve(Auth)
+	if !errors.Is(err, source.err) {
+		t.Errorf("Resolve with a failing source: err = %v, want %v", err, source.err)
+	}
+}
+
+func TestPickFollowsSourceBalancer(t *testing.T) {
+	source := &mapSource{
+		endpoints: map[string][]string{Auth: {"a:80", "b:80"}},
+		balancers: map[string]string{Auth: "no-such-strategy"},
+	}
+	r, err := NewRegistry(source, LeastOutstanding)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an unknown strategy from the source falls back to the registry's
+	_, release, err := r.Pick(Auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	if s := r.balancers[Auth].strategy; s != LeastOutstanding {
+		t.Fatalf("strategy = %s, want %s", s, LeastOutstanding)
+	}
+
+	// a changed strategy replaces the balancer
+	source.balancers[Auth] = RoundRobin
+	ep, release, err := r.Pick(Auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	if s := r.balancers[Auth].strategy; s != RoundRobin {
+		t.Errorf("strategy = %s, want %s", s, RoundRobin)
+	}
+	if ep.Service != Auth || ep.Address != "a:80" {
+		t.Errorf("Pick = %+v, want the first endpoint from a fresh balancer", ep)
+	}
+}
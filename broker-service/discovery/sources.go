@@ -0,0 +1,244 @@
+package discovery
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvSource reads endpoints from environment variables. The endpoints of the
+// "logger-rpc" service, for example, come from SERVICE_LOGGER_RPC_ENDPOINTS as a
+// comma-separated list, and its balancer from SERVICE_LOGGER_RPC_BALANCER.
+type EnvSource struct{}
+
+func envKey(service, suffix string) string {
+	name := strings.ToUpper(strings.ReplaceAll(service, "-", "_"))
+	return fmt.Sprintf("SERVICE_%s_%s", name, suffix)
+}
+
+func (EnvSource) Endpoints(service string) ([]string, error) {
+	return splitList(os.Getenv(envKey(service, "ENDPOINTS"))), nil
+}
+
+func (EnvSource) Balancer(service string) string {
+	return os.Getenv(envKey(service, "BALANCER"))
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			out = append(out, item)
+		}
+	}
+
+	return out
+}
+
+// ServiceConfig is the configuration of one service in a FileSource.
+type ServiceConfig struct {
+	Balancer  string   `json:"balancer" yaml:"balancer"`
+	Endpoints []string `json:"endpoints" yaml:"endpoints"`
+}
+
+// fileConfig is the layout of the static discovery file:
+//
+//	services:
+//	  auth:
+//	    balancer: least-outstanding
+//	    endpoints:
+//	      - http://auth-1:8080
+//	      - http://auth-2:8080
+type fileConfig struct {
+	Services map[string]ServiceConfig `json:"services" yaml:"services"`
+}
+
+// FileSource reads endpoints from a YAML or JSON file. The file is checked for changes
+// at most once per interval and reloaded when its modification time moves, so edits
+// take effect without restarting the broker.
+type FileSource struct {
+	path     string
+	interval time.Duration
+
+	mu        sync.RWMutex
+	services  map[string]ServiceConfig
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+// NewFileSource loads path and returns a source that keeps it up to date
+func NewFileSource(path string, interval time.Duration) (*FileSource, error) {
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+
+	f := &FileSource{
+		path:     path,
+		interval: interval,
+	}
+
+	err := f.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (f *FileSource) Endpoints(service string) ([]string, error) {
+	f.reloadIfChanged()
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.services[service].Endpoints, nil
+}
+
+func (f *FileSource) Balancer(service string) string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.services[service].Balancer
+}
+
+// reloadIfChanged re-reads the file when it has been modified since the last load.
+// A file that fails to parse is logged and the previous configuration is kept.
+func (f *FileSource) reloadIfChanged() {
+	f.mu.Lock()
+	if time.Since(f.lastCheck) < f.interval {
+		f.mu.Unlock()
+		return
+	}
+	f.lastCheck = time.Now()
+	modTime := f.modTime
+	f.mu.Unlock()
+
+	info, err := os.Stat(f.path)
+	if err != nil {
+		log.Println("discovery: could not stat", f.path, err)
+		return
+	}
+
+	if !info.ModTime().After(modTime) {
+		return
+	}
+
+	err = f.load()
+	if err != nil {
+		log.Println("discovery: keeping previous configuration:", err)
+		return
+	}
+
+	log.Println("discovery: reloaded", f.path)
+}
+
+func (f *FileSource) load() error {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+
+	b, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+
+	var cfg fileConfig
+	switch strings.ToLower(filepath.Ext(f.path)) {
+	case ".json":
+		err = json.Unmarshal(b, &cfg)
+	default:
+		err = yaml.Unmarshal(b, &cfg)
+	}
+	if err != nil {
+		return fmt.Errorf("parsing %s: %w", f.path, err)
+	}
+
+	for name, svc := range cfg.Services {
+		if svc.Balancer != "" && !validStrategy(svc.Balancer) {
+			return fmt.Errorf("service %s: unknown balancer %q", name, svc.Balancer)
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.services = cfg.Services
+	f.modTime = info.ModTime()
+	f.lastCheck = time.Now()
+
+	return nil
+}
+
+// DNSSource resolves services through DNS SRV records. The service "auth" in domain
+// "svc.local" is looked up as _auth._tcp.svc.local. Answers are cached for ttl.
+type DNSSource struct {
+	domain string
+	ttl    time.Duration
+
+	mu    sync.Mutex
+	cache map[string]dnsEntry
+}
+
+type dnsEntry struct {
+	endpoints []string
+	expires   time.Time
+}
+
+// NewDNSSource returns a source that looks services up in domain
+func NewDNSSource(domain string, ttl time.Duration) *DNSSource {
+	if ttl <= 0 {
+		ttl = 30 * time.Second
+	}
+
+	return &DNSSource{
+		domain: strings.TrimSuffix(domain, "."),
+		ttl:    ttl,
+		cache:  make(map[string]dnsEntry),
+	}
+}
+
+func (d *DNSSource) Endpoints(service string) ([]string, error) {
+	d.mu.Lock()
+	entry, ok := d.cache[service]
+	d.mu.Unlock()
+
+	if ok && time.Now().Before(entry.expires) {
+		return entry.endpoints, nil
+	}
+
+	_, records, err := net.LookupSRV(service, "tcp", d.domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, nil
+		}
+		if ok {
+			// keep serving the last good answer while DNS is unavailable
+			log.Println("discovery: SRV lookup failed, using cached endpoints:", err)
+			return entry.endpoints, nil
+		}
+		return nil, err
+	}
+
+	endpoints := make([]string, 0, len(records))
+	for _, srv := range records {
+		endpoints = append(endpoints, net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), fmt.Sprint(srv.Port)))
+	}
+
+	d.mu.Lock()
+	d.cache[service] = dnsEntry{endpoints: endpoints, expires: time.Now().Add(d.ttl)}
+	d.mu.Unlock()
+
+	return endpoints, nil
+}
@@ -0,0 +1,112 @@
+package discovery
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestEnvSource(t *testing.T) {
+	t.Setenv("SERVICE_LOGGER_RPC_ENDPOINTS", " logger-1:5001, ,logger-2:5001 ")
+	t.Setenv("SERVICE_LOGGER_RPC_BALANCER", LeastOutstanding)
+
+	var s EnvSource
+
+	got, err := s.Endpoints(LoggerRPC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"logger-1:5001", "logger-2:5001"}; !slices.Equal(got, want) {
+		t.Errorf("Endpoints = %q, want %q", got, want)
+	}
+	if b := s.Balancer(LoggerRPC); b != LeastOutstanding {
+		t.Errorf("Balancer = %q, want %q", b, LeastOutstanding)
+	}
+
+	if got, _ := s.Endpoints(Mailer); len(got) != 0 {
+		t.Errorf("Endpoints of an unconfigured service = %q, want none", got)
+	}
+}
+
+func writeFile(t *testing.T, path, content string, modTime time.Time) {
+	t.Helper()
+
+	err := os.WriteFile(path, []byte(content), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chtimes(path, modTime, modTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileSourceFormats(t *testing.T) {
+	files := map[string]string{
+		"services.yaml": "services:\n  auth:\n    balancer: least-outstanding\n    endpoints:\n      - http://auth-1:8080\n",
+		"services.json": `{"services": {"auth": {"balancer": "least-outstanding", "endpoints": ["http://auth-1:8080"]}}}`,
+	}
+
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), name)
+			writeFile(t, path, content, time.Now())
+
+			f, err := NewFileSource(path, time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, _ := f.Endpoints(Auth)
+			if !slices.Equal(got, []string{"http://auth-1:8080"}) || f.Balancer(Auth) != LeastOutstanding {
+				t.Errorf("auth = %q with %q", got, f.Balancer(Auth))
+			}
+		})
+	}
+}
+
+func TestFileSourceRejectsUnknownBalancer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "services.yaml")
+	writeFile(t, path, "services:\n  auth:\n    balancer: random\n", time.Now())
+
+	_, err := NewFileSource(path, time.Minute)
+	if err == nil {
+		t.Error("NewFileSource accepted an unknown balancer")
+	}
+}
+
+func TestFileSourceReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "services.yaml")
+	start := time.Now().Add(-time.Hour)
+	writeFile(t, path, "services:\n  auth:\n    endpoints: [auth-1:8080]\n", start)
+
+	f, err := NewFileSource(path, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	endpoints := func() []string {
+		time.Sleep(2 * time.Millisecond)
+		got, _ := f.Endpoints(Auth)
+		return got
+	}
+
+	writeFile(t, path, "services:\n  auth:\n    endpoints: [auth-2:8080]\n", start.Add(time.Minute))
+	if got := endpoints(); !slices.Equal(got, []string{"auth-2:8080"}) {
+		t.Fatalf("after an edit: %q, want the new endpoint", got)
+	}
+
+	// a broken edit keeps the last good configuration
+	writeFile(t, path, "services: [", start.Add(2*time.Minute))
+	if got := endpoints(); !slices.Equal(got, []string{"auth-2:8080"}) {
+		t.Errorf("after a broken edit: %q, want the previous endpoint", got)
+	}
+
+	// and so does a file that disappears
+	os.Remove(path)
+	if got := endpoints(); !slices.Equal(got, []string{"auth-2:8080"}) {
+		t.Errorf("after the file was removed: %q, want the previous endpoint", got)
+	}
+}
@@ -0,0 +1,91 @@
+package event
+
+import (
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// DefaultChannelPoolSize is how many idle channels an Emitter keeps for reuse
+const DefaultChannelPoolSize = 16
+
+// confirmChannel is a channel in confirm mode together with its returned messages
+type confirmChannel struct {
+	ch      *amqp.Channel
+	returns chan amqp.Return
+}
+
+// channelPool keeps up to size idle confirm-mode channels so that publishing doesn't
+// pay for opening a channel and switching it to confirm mode on every message. It
+// never limits how many channels are in use at once; callers that find the pool empty
+// get a fresh channel, and channels handed back to a full pool are closed.
+type channelPool struct {
+	conn *Connection
+	idle chan *confirmChannel
+}
+
+func newChannelPool(conn *Connection, size int) *channelPool {
+	return &channelPool{
+		conn: conn,
+		idle: make(chan *confirmChannel, size),
+	}
+}
+
+// get returns an idle channel, or opens one if there is none. Channels that died with
+// their connection are thrown away.
+func (p *channelPool) get() (*confirmChannel, error) {
+	for {
+		select {
+		case c := <-p.idle:
+			if c.ch.IsClosed() {
+				continue
+			}
+			return c, nil
+		default:
+			return p.open()
+		}
+	}
+}
+
+func (p *channelPool) open() (*confirmChannel, error) {
+	ch, err := p.conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	err = ch.Confirm(false)
+	if err != nil {
+		ch.Close()
+		return nil, err
+	}
+
+	return &confirmChannel{
+		ch: ch,
+		// one message is in flight per channel at a time, so one slot is enough
+		returns: ch.NotifyReturn(make(chan amqp.Return, 1)),
+	}, nil
+}
+
+// put hands c back. A channel that isn't clean, for instance because a confirmation
+// for it may still arrive, is closed instead of being reused.
+func (p *channelPool) put(c *confirmChannel, clean bool) {
+	if clean && !c.ch.IsClosed() {
+		select {
+		case p.idle <- c:
+			return
+		default:
+		}
+	}
+
+	_ = c.ch.Close()
+}
+
+// close closes every idle channel
+func (p *channelPool) close() {
+	for {
+		select {
+		case c := <-p.idle:
+			_ = c.ch.Close()
+		default:
+			return
+		}
+	}
+}
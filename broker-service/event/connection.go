@@ -0,0 +1,256 @@
+package event
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// ErrNotConnected is returned while the connection to RabbitMQ is down and being re-established
+var ErrNotConnected = errors.New("not connected to RabbitMQ")
+
+const (
+	// dialAttempts bounds how often Dial tries before giving up at startup
+	dialAttempts = 6
+	minBackoff   = time.Second
+	maxBackoff   = 30 * time.Second
+)
+
+// Connection keeps a RabbitMQ connection open for the life of the process. It watches
+// the connection with NotifyClose and, when it drops, reconnects with exponential
+// backoff and re-declares the exchange. Emitters and consumers ask it for a channel
+// each time they need one, so they pick up the new connection without noticing.
+type Connection struct {
+	url string
+
+	mu         sync.RWMutex
+	conn       *amqp.Connection
+	ready      chan struct{} // closed while connected
+	since      time.Time
+	lastErr    error
+	reconnects int
+	closed     bool
+
+	done chan struct{}
+}
+
+// ConnectionStatus describes the connection for the health endpoint.
+type ConnectionStatus struct {
+	Connected  bool      `json:"connected"`
+	Since      time.Time `json:"since"`
+	Reconnects int       `json:"reconnects"`
+	LastError  string    `json:"last_error,omitempty"`
+}
+
+// Dial connects to url, retrying with backoff a few times before giving up, and then
+// keeps the connection alive in the background until Close is called.
+func Dial(url string) (*Connection, error) {
+	c := &Connection{
+		url:   url,
+		ready: make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+
+	var closed <-chan *amqp.Error
+	var err error
+	backoff := minBackoff
+	for attempt := 1; ; attempt++ {
+		closed, err = c.connect()
+		if err == nil {
+			break
+		}
+
+		if attempt == dialAttempts {
+			return nil, err
+		}
+
+		log.Println("RabbitMQ not yet ready...")
+		log.Println("backing off...")
+		time.Sleep(backoff)
+		backoff = nextBackoff(backoff)
+	}
+
+	log.Println("Connected to RabbitMQ!")
+	go c.watch(closed)
+
+	return c, nil
+}
+
+// connect dials RabbitMQ, declares the exchange and marks the connection ready. It
+// returns the channel that is notified when the connection closes, registered before
+// anyone else can use the connection, so that no close goes unnoticed.
+func (c *Connection) connect() (<-chan *amqp.Error, error) {
+	conn, err := amqp.Dial(c.url)
+	if err != nil {
+		c.setError(err)
+		return nil, err
+	}
+
+	closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+
+	ch, err := conn.Channel()
+	if err == nil {
+		err = declareExchange(ch)
+		ch.Close()
+	}
+	if err != nil {
+		conn.Close()
+		c.setError(err)
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		conn.Close()
+		return nil, ErrNotConnected
+	}
+
+	c.conn = conn
+	c.since = time.Now()
+	c.lastErr = nil
+	close(c.ready)
+
+	return closed, nil
+}
+
+// watch waits on closed for the connection to drop and reconnects until Close is called
+func (c *Connection) watch(closed <-chan *amqp.Error) {
+	for {
+		select {
+		case <-c.done:
+			return
+		case amqpErr := <-closed:
+			// a connection closed without an error was closed by a client; if it wasn't
+			// Close, it is as gone as one the server dropped
+			select {
+			case <-c.done:
+				return
+			default:
+			}
+
+			var err error = ErrNotConnected
+			if amqpErr != nil {
+				err = amqpErr
+			}
+			log.Println("Lost connection to RabbitMQ:", err)
+			c.markDown(err)
+		}
+
+		backoff := minBackoff
+		for {
+			select {
+			case <-c.done:
+				return
+			case <-time.After(backoff):
+			}
+
+			var err error
+			closed, err = c.connect()
+			if err == nil {
+				break
+			}
+			log.Printf("Reconnecting to RabbitMQ failed, retrying in %s: %v\n", nextBackoff(backoff), err)
+			backoff = nextBackoff(backoff)
+		}
+
+		log.Println("Reconnected to RabbitMQ")
+	}
+}
+
+func (c *Connection) markDown(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.conn = nil
+	c.ready = make(chan struct{})
+	c.since = time.Now()
+	c.lastErr = err
+	c.reconnects++
+}
+
+func (c *Connection) setError(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lastErr = err
+}
+
+// Channel opens a channel on the current connection, or returns ErrNotConnected if
+// the connection is down
+func (c *Connection) Channel() (*amqp.Channel, error) {
+	c.mu.RLock()
+	conn := c.conn
+	c.mu.RUnlock()
+
+	if conn == nil || conn.IsClosed() {
+		return nil, ErrNotConnected
+	}
+
+	return conn.Channel()
+}
+
+// WaitReady blocks until the connection is up or ctx is done
+func (c *Connection) WaitReady(ctx context.Context) error {
+	c.mu.RLock()
+	ready := c.ready
+	c.mu.RUnlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Status reports whether the connection is up, since when, and how often it has dropped
+func (c *Connection) Status() ConnectionStatus {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	s := ConnectionStatus{
+		Connected:  c.conn != nil && !c.conn.IsClosed(),
+		Since:      c.since,
+		Reconnects: c.reconnects,
+	}
+	if c.lastErr != nil {
+		s.LastError = c.lastErr.Error()
+	}
+
+	return s
+}
+
+// Close stops reconnecting and closes the connection
+func (c *Connection) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	conn := c.conn
+	c.conn = nil
+	c.mu.Unlock()
+
+	if conn == nil {
+		return nil
+	}
+
+	return conn.Close()
+}
+
+func nextBackoff(d time.Duration) time.Duration {
+	d *= 2
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+
+	return d
+}
@@ -2,22 +2,27 @@ package event
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"shared/cloudevent"
+	"sync"
 
 	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/codes"
 )
 
 // Consumer represents a RabbitMQ consumer
 type Consumer struct {
-	conn      *amqp.Connection
+	conn      *Connection
 	queueName string
 }
 
 // NewConsumer creates and sets up a new Consumer
-func NewConsumer(conn *amqp.Connection) (Consumer, error) {
+func NewConsumer(conn *Connection) (Consumer, error) {
 	consumer := Consumer{
 		conn: conn,
 	}
@@ -87,10 +92,22 @@ func (consumer *Consumer) Listen(topics []string) error {
 	go func() {
 		for d := range messages {
 			var payload Payload
-			_ = json.Unmarshal(d.Body, &payload)
+			event, err := cloudevent.Parse(d.Body, d.ContentType)
+			if err == nil {
+				err = event.Decode(&payload)
+			}
+			if err != nil {
+				log.Println("skipping message:", err)
+				continue
+			}
 
-			// Process each message in a separate goroutine
-			go handlePayload(payload)
+			// Process each message in a separate goroutine, continuing the publisher's trace
+			go func(d amqp.Delivery) {
+				ctx, span := startConsumeSpan(d, q.Name)
+				defer span.End()
+
+				handlePayload(ctx, payload)
+			}(d)
 		}
 	}()
 
@@ -100,12 +117,151 @@ func (consumer *Consumer) Listen(topics []string) error {
 	return nil
 }
 
+// Consume binds the durable queue named queue to topics and calls handler with the
+// event in every message, running up to prefetch handlers at a time. A message is
+// acknowledged when its handler returns nil and dropped when it returns an error or
+// doesn't hold a valid envelope. The handler's context carries the trace the
+// publisher started.
+//
+// Consume blocks until ctx is done or the channel is closed. Once ctx is done no new
+// messages are taken, and Consume returns after the handlers already running finish;
+// anything still queued stays in the queue for the next consumer.
+func (consumer *Consumer) Consume(ctx context.Context, queue string, topics []string, prefetch int, handler func(ctx context.Context, event cloudevent.Envelope) error) error {
+	ch, err := consumer.conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	q, err := declareDurableQueue(ch, queue)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range topics {
+		err = ch.QueueBind(q.Name, s, "logs_topic", false, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = ch.Qos(prefetch, 0, false)
+	if err != nil {
+		return err
+	}
+
+	tag := q.Name + "-consumer"
+	messages, err := ch.Consume(q.Name, tag, false, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+
+	// cancelling the consumer closes messages once the server has stopped delivering
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = ch.Cancel(tag, false)
+		case <-stopped:
+		}
+	}()
+
+	var running sync.WaitGroup
+	defer running.Wait()
+
+	log.Printf("Waiting for messages [Exchange, Queue] [logs_topic, %s]\n", q.Name)
+	for d := range messages {
+		running.Add(1)
+		go func(d amqp.Delivery) {
+			defer running.Done()
+
+			ctx, span := startConsumeSpan(d, q.Name)
+			defer span.End()
+
+			event, err := cloudevent.Parse(d.Body, d.ContentType)
+			if err == nil {
+				err = handler(ctx, event)
+			}
+			if err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				log.Println("dropping message:", err)
+				_ = d.Nack(false, false)
+				return
+			}
+			_ = d.Ack(false)
+		}(d)
+	}
+
+	return nil
+}
+
+// Subscribe binds a private queue to StreamExchange and calls handler with the routing
+// key and event of every message published to logs_topic, for watchers that only care about
+// what happens while they are connected. The queue is deleted when the subscription
+// ends, and messages are acknowledged on delivery, so nothing is redelivered; handler
+// should return quickly. Messages without a valid envelope are skipped.
+//
+// Subscribe blocks until ctx is done or the channel is closed.
+func (consumer *Consumer) Subscribe(ctx context.Context, handler func(ctx context.Context, key string, event cloudevent.Envelope)) error {
+	ch, err := consumer.conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	q, err := declareRandomQueue(ch)
+	if err != nil {
+		return err
+	}
+	// the queue is exclusive to the connection, which outlives the subscription
+	defer func() {
+		_, _ = ch.QueueDelete(q.Name, false, false, false)
+	}()
+
+	err = ch.QueueBind(q.Name, "", StreamExchange, false, nil)
+	if err != nil {
+		return err
+	}
+
+	tag := q.Name + "-subscriber"
+	messages, err := ch.Consume(q.Name, tag, true, true, false, false, nil)
+	if err != nil {
+		return err
+	}
+
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = ch.Cancel(tag, false)
+		case <-stopped:
+		}
+	}()
+
+	for d := range messages {
+		event, err := cloudevent.Parse(d.Body, d.ContentType)
+		if err != nil {
+			log.Println("skipping message:", err)
+			continue
+		}
+
+		ctx, span := startConsumeSpan(d, q.Name)
+		handler(ctx, d.RoutingKey, event)
+		span.End()
+	}
+
+	return nil
+}
+
 // handlePayload processes different types of payloads
-func handlePayload(payload Payload) {
+func handlePayload(ctx context.Context, payload Payload) {
 	switch payload.Name {
 	case "log", "event":
 		// Log the payload
-		err := logEvent(payload)
+		err := logEvent(ctx, payload)
 		if err != nil {
 			log.Println(err)
 		}
@@ -115,7 +271,7 @@ func handlePayload(payload Payload) {
 
 	default:
 		// Log any unknown payload types
-		err := logEvent(payload)
+		err := logEvent(ctx, payload)
 		if err != nil {
 			log.Println(err)
 		}
@@ -123,20 +279,20 @@ func handlePayload(payload Payload) {
 }
 
 // logEvent sends the payload to a logging service
-func logEvent(entry Payload) error {
+func logEvent(ctx context.Context, entry Payload) error {
 	jsonData, _ := json.MarshalIndent(entry, "", "\t")
 
 	logServiceURL := "http://logger-service:8080/log"
 
 	// Create a new HTTP request
-	request, err := http.NewRequest("POST", logServiceURL, bytes.NewBuffer(jsonData))
+	request, err := http.NewRequestWithContext(ctx, "POST", logServiceURL, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return err
 	}
 
 	request.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
+	client := &http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)}
 
 	// Send the request
 	response, err := client.Do(request)
@@ -1,60 +1,315 @@
 package event
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"shared/cloudevent"
+	"sync"
+	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
 )
 
+// inFlight counts publishes that have started but not finished, across every Emitter,
+// so that shutdown can wait for them. Unlike a WaitGroup it may be added to while
+// someone is waiting.
+var inFlight = newCounter()
+
+type counter struct {
+	mu   sync.Mutex
+	n    int
+	idle chan struct{} // closed while n is zero
+}
+
+func newCounter() *counter {
+	idle := make(chan struct{})
+	close(idle)
+
+	return &counter{idle: idle}
+}
+
+func (c *counter) add() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.n == 0 {
+		c.idle = make(chan struct{})
+	}
+	c.n++
+}
+
+func (c *counter) done() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.n--
+	if c.n == 0 {
+		close(c.idle)
+	}
+}
+
+// wait returns a channel that is closed once the count is next zero
+func (c *counter) wait() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.idle
+}
+
+// Flush waits until no Push is in progress, or for ctx to be done
+func Flush(ctx context.Context) error {
+	select {
+	case <-inFlight.wait():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// DefaultConfirmTimeout is how long Push waits for RabbitMQ to confirm a message
+const DefaultConfirmTimeout = 5 * time.Second
+
+var (
+	// ErrUnroutable is returned when RabbitMQ returns a message because no queue is bound for its key
+	ErrUnroutable = errors.New("message could not be routed to any queue")
+	// ErrNacked is returned when RabbitMQ refuses to take responsibility for a message
+	ErrNacked = errors.New("message was not acknowledged by RabbitMQ")
+	// ErrConfirmTimeout is returned when no confirmation arrives in time
+	ErrConfirmTimeout = errors.New("timed out waiting for RabbitMQ to confirm the message")
+)
+
+// Emitter publishes events to the logs_topic exchange. Every message is published in
+// confirm mode and as mandatory, so Push only succeeds once RabbitMQ has routed the
+// message to a queue and acknowledged it. With an outbox, messages that could not be
+// confirmed are stored and replayed later instead of being lost.
+//
+// An Emitter is meant to be created once and shared: it keeps a pool of channels and
+// is safe for concurrent use.
 type Emitter struct {
-	connection *amqp.Connection
+	connection     *Connection
+	confirmTimeout time.Duration
+	outbox         *Outbox
+	poolSize       int
+	channels       *channelPool
+}
+
+// EmitterOption configures an Emitter
+type EmitterOption func(*Emitter)
+
+// WithConfirmTimeout sets how long Push waits for a confirmation
+func WithConfirmTimeout(d time.Duration) EmitterOption {
+	return func(e *Emitter) {
+		e.confirmTimeout = d
+	}
+}
+
+// WithChannelPool sets how many idle channels the emitter keeps for reuse. Zero opens
+// a new channel for every message.
+func WithChannelPool(size int) EmitterOption {
+	return func(e *Emitter) {
+		e.poolSize = size
+	}
+}
+
+// WithOutbox makes Push store messages it could not get confirmed in o. A nil outbox
+// leaves the emitter without one.
+func WithOutbox(o *Outbox) EmitterOption {
+	return func(e *Emitter) {
+		e.outbox = o
+	}
 }
 
-func (e *Emitter) setup() error {
-	channel, err := e.connection.Channel()
+// Push publishes event to the exchange with key as its routing key and waits for
+// RabbitMQ to confirm it. The event's ID, type, source and time are copied into the
+// message properties, and the trace in ctx travels with it in the headers.
+//
+// If the message can't be confirmed and the emitter has an outbox, it is stored there
+// and Push returns nil: the message will be delivered at least once, after the fact.
+func (e *Emitter) Push(ctx context.Context, event cloudevent.Envelope, key string) error {
+	inFlight.add()
+	defer inFlight.done()
+
+	ctx, span, headers := startPublishSpan(ctx, "logs_topic", key)
+	defer span.End()
+	span.SetAttributes(semconv.MessagingMessageID(event.ID))
+
+	body, err := json.Marshal(event)
 	if err != nil {
 		return err
 	}
 
-	defer channel.Close()
-	return declareExchange(channel)
+	msg := OutboxMessage{
+		Exchange:    "logs_topic",
+		Key:         key,
+		Body:        body,
+		Headers:     stringHeaders(headers),
+		ContentType: cloudevent.ContentType,
+		MessageID:   event.ID,
+		Type:        event.Type,
+		Source:      event.Source,
+		Time:        event.Time,
+	}
+
+	err = e.publish(ctx, msg, true)
+	if err == nil {
+		return nil
+	}
+	span.RecordError(err)
+
+	if e.outbox == nil {
+		return err
+	}
+
+	storeErr := e.outbox.Put(msg)
+	if storeErr != nil {
+		return errors.Join(err, fmt.Errorf("storing in outbox: %w", storeErr))
+	}
+
+	log.Println("Stored message in outbox:", err)
+	span.AddEvent("stored in outbox")
+	return nil
 }
 
-func (e *Emitter) Push(event string, severity string) error {
-	channel, err := e.connection.Channel()
+// publish sends m on a pooled confirm-mode channel and waits for the outcome. A
+// mandatory message that no queue is bound for is an error.
+func (e *Emitter) publish(ctx context.Context, m OutboxMessage, mandatory bool) error {
+	channel, err := e.channels.get()
 	if err != nil {
 		return err
 	}
-	defer channel.Close()
+	clean := false
+	defer func() { e.channels.put(channel, clean) }()
 
-	log.Println("Pushing to channel")
+	headers := amqp.Table{}
+	for k, v := range m.Headers {
+		headers[k] = v
+	}
 
-	err = channel.Publish(
-		"logs_topic",
-		severity,
-		false,
+	confirm, err := channel.ch.PublishWithDeferredConfirmWithContext(
+		ctx,
+		m.Exchange,
+		m.Key,
+		mandatory, // hand the message back if nothing is bound to its key
 		false,
 		amqp.Publishing{
-			ContentType: "text/plain",
-			Body:        []byte(event),
+			ContentType:  m.contentType(),
+			DeliveryMode: amqp.Persistent,
+			MessageId:    m.MessageID,
+			Timestamp:    m.Time,
+			Type:         m.Type,
+			AppId:        m.Source,
+			Headers:      headers,
+			Body:         m.Body,
 		},
 	)
 	if err != nil {
 		return err
 	}
 
+	timeout := e.confirmTimeout
+	if timeout <= 0 {
+		timeout = DefaultConfirmTimeout
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	acked, err := confirm.WaitContext(waitCtx)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+			return ErrConfirmTimeout
+		}
+		return err
+	}
+	// the confirmation is in, so nothing else is due on this channel
+	clean = true
+
+	// RabbitMQ sends a return before the ack for the same message, and the client
+	// delivers them in that order, so the return is waiting by the time the ack is in
+	select {
+	case r := <-channel.returns:
+		return fmt.Errorf("%w: %s %s", ErrUnroutable, r.ReplyText, r.RoutingKey)
+	default:
+	}
+
+	if !acked {
+		return ErrNacked
+	}
+
 	return nil
 }
 
-func NewEventEmitter(conn *amqp.Connection) (Emitter, error) {
-	emitter := Emitter{
-		connection: conn,
+// ReplayOutbox publishes the messages in the emitter's outbox whenever the connection
+// is up, checking every interval. It blocks until ctx is done.
+func (e *Emitter) ReplayOutbox(ctx context.Context, interval time.Duration) {
+	if e.outbox == nil {
+		return
 	}
 
-	err := emitter.setup()
-	if err != nil {
-		return Emitter{}, err
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		err := e.connection.WaitReady(ctx)
+		if err != nil {
+			return
+		}
+
+		if e.outbox.Len() > 0 {
+			n, err := e.outbox.Replay(func(m OutboxMessage) error {
+				inFlight.add()
+				defer inFlight.done()
+
+				return e.publish(ctx, m, true)
+			})
+			if n > 0 {
+				log.Printf("Replayed %d messages from the outbox\n", n)
+			}
+			if err != nil {
+				log.Println("Replaying outbox:", err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// stringHeaders keeps the string headers of t, which is all the trace context needs
+func stringHeaders(t amqp.Table) map[string]string {
+	out := make(map[string]string, len(t))
+	for k, v := range t {
+		if s, ok := v.(string); ok {
+			out[k] = s
+		}
+	}
+
+	return out
+}
+
+// Close closes the emitter's idle channels. Call it after Flush, once nothing is
+// publishing any more.
+func (e *Emitter) Close() {
+	e.channels.close()
+}
+
+// NewEventEmitter returns an emitter that publishes over conn. The exchange is declared
+// by conn whenever it connects, so the emitter can be created while RabbitMQ is down.
+func NewEventEmitter(conn *Connection, opts ...EmitterOption) (*Emitter, error) {
+	emitter := &Emitter{
+		connection: conn,
+		poolSize:   DefaultChannelPoolSize,
+	}
+	for _, opt := range opts {
+		opt(emitter)
 	}
+	emitter.channels = newChannelPool(conn, emitter.poolSize)
 
 	return emitter, nil
 }
@@ -4,7 +4,14 @@ import (
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
-// declareExchange sets up the topic exchange
+// StreamExchange is a fanout exchange that live watchers bind their queues to. It is
+// bound to logs_topic for every routing key, so watchers see each event that any
+// service publishes there, with the key it was published with. A watcher's queue is a
+// route like any other: while one is bound, a mandatory publish to logs_topic isn't
+// returned even if nothing else takes it.
+const StreamExchange = "logs_stream"
+
+// declareExchange sets up the topic exchange, and the stream exchange bound to it
 //
 // An exchange in RabbitMQ is a message routing agent.
 // It's essentially the middleman between the publisher (who sends messages) and the queues (where messages are stored).
@@ -16,7 +23,7 @@ import (
 // There are several types of exchanges (direct, topic, fanout, headers), each with different routing rules.
 // Here, we're using a "topic" exchange named "logs_topic".
 func declareExchange(ch *amqp.Channel) error {
-	return ch.ExchangeDeclare(
+	err := ch.ExchangeDeclare(
 		"logs_topic", // name of the exchange
 		"topic",      // type of the exchange
 		true,         // durable (survives broker restarts)
@@ -25,6 +32,16 @@ func declareExchange(ch *amqp.Channel) error {
 		false,        // no-wait (don't wait for a server confirmation)
 		nil,          // arguments (optional)
 	)
+	if err != nil {
+		return err
+	}
+
+	err = ch.ExchangeDeclare(StreamExchange, "fanout", true, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+
+	return ch.ExchangeBind(StreamExchange, "#", "logs_topic", false, nil)
 }
 
 // declareRandomQueue declares a random, exclusive queue
@@ -39,6 +56,19 @@ func declareRandomQueue(ch *amqp.Channel) (amqp.Queue, error) {
 	)
 }
 
+// declareDurableQueue declares a named queue that survives broker restarts, so that
+// messages published while no consumer is running are kept until one comes back
+func declareDurableQueue(ch *amqp.Channel, name string) (amqp.Queue, error) {
+	return ch.QueueDeclare(
+		name,  // name
+		true,  // durable
+		false, // delete when unused
+		false, // exclusive
+		false, // no-wait
+		nil,   // arguments
+	)
+}
+
 /**
 A channel in RabbitMQ is a virtual connection inside a real TCP connection. It's like a lightweight socket inside the connection.
 Key points about channels:
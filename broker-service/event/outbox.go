@@ -0,0 +1,215 @@
+package event
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"log"
+	"shared/cloudevent"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	outboxBucket = []byte("outbox")
+	// deadBucket holds messages that failed to replay too often
+	deadBucket = []byte("outbox_dead")
+)
+
+// DefaultOutboxAttempts is how often a message can be refused on replay before it is
+// moved aside
+const DefaultOutboxAttempts = 10
+
+// OutboxMessage is a publish that RabbitMQ did not confirm, kept until it can be replayed.
+type OutboxMessage struct {
+	Exchange string            `json:"exchange"`
+	Key      string            `json:"key"`
+	Body     []byte            `json:"body"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	StoredAt time.Time         `json:"stored_at"`
+
+	// AMQP properties, taken from the event's envelope
+	ContentType string    `json:"content_type,omitempty"`
+	MessageID   string    `json:"message_id,omitempty"`
+	Type        string    `json:"type,omitempty"`
+	Source      string    `json:"source,omitempty"`
+	Time        time.Time `json:"time,omitempty"`
+
+	// Attempts counts how often RabbitMQ refused the message when it was replayed
+	Attempts int `json:"attempts"`
+}
+
+// contentType returns the message's content type. Messages stored before the event
+// envelope existed have none and were published as plain text.
+func (m OutboxMessage) contentType() string {
+	if m.ContentType == "" {
+		return cloudevent.LegacyContentType
+	}
+
+	return m.ContentType
+}
+
+// Outbox is a local BoltDB file holding messages waiting to be published. Messages are
+// replayed in the order they were stored. A message that RabbitMQ refuses maxAttempts
+// times is moved to the dead letters, so that it doesn't hold up the ones behind it.
+type Outbox struct {
+	db          *bolt.DB
+	maxAttempts int
+}
+
+// OpenOutbox opens, or creates, the outbox file at path. Messages are replayed at most
+// maxAttempts times; zero means DefaultOutboxAttempts.
+func OpenOutbox(path string, maxAttempts int) (*Outbox, error) {
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultOutboxAttempts
+	}
+
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{outboxBucket, deadBucket} {
+			_, err := tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Outbox{db: db, maxAttempts: maxAttempts}, nil
+}
+
+// Put stores m at the end of the outbox
+func (o *Outbox) Put(m OutboxMessage) error {
+	if m.StoredAt.IsZero() {
+		m.StoredAt = time.Now()
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	return o.db.Update(func(tx *bolt.Tx) error {
+		return appendTo(tx.Bucket(outboxBucket), data)
+	})
+}
+
+// appendTo stores data in b under the bucket's next sequence number
+func appendTo(b *bolt.Bucket, data []byte) error {
+	seq, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+
+	return b.Put(key, data)
+}
+
+// Len returns the number of messages waiting in the outbox
+func (o *Outbox) Len() int {
+	return o.count(outboxBucket)
+}
+
+// Dead returns the number of messages that were given up on. They stay in the file for
+// an operator to look at.
+func (o *Outbox) Dead() int {
+	return o.count(deadBucket)
+}
+
+func (o *Outbox) count(bucket []byte) int {
+	n := 0
+	_ = o.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(bucket).Stats().KeyN
+		return nil
+	})
+
+	return n
+}
+
+// Replay hands the stored messages to publish, oldest first. Each message is removed
+// once publish returns nil. Replay stops at the first failure, so that messages keep
+// their order. Only a refusal by RabbitMQ, a nack or a return, counts as a failed
+// attempt: once a message has been refused maxAttempts times it is moved to the dead
+// letters and Replay goes on with the next. Any other error, such as a lost connection,
+// says nothing about the message, which is left as it was. Replay returns how many
+// messages were published.
+func (o *Outbox) Replay(publish func(m OutboxMessage) error) (int, error) {
+	sent := 0
+
+	for {
+		var key []byte
+		var m OutboxMessage
+
+		err := o.db.View(func(tx *bolt.Tx) error {
+			k, v := tx.Bucket(outboxBucket).Cursor().First()
+			if k == nil {
+				return nil
+			}
+			key = append([]byte(nil), k...)
+			return json.Unmarshal(v, &m)
+		})
+		if err != nil || key == nil {
+			return sent, err
+		}
+
+		err = publish(m)
+		if err != nil && !refused(err) {
+			return sent, err
+		}
+		if err != nil {
+			m.Attempts++
+			dead := m.Attempts >= o.maxAttempts
+
+			data, jerr := json.Marshal(m)
+			if jerr != nil {
+				return sent, jerr
+			}
+			uerr := o.db.Update(func(tx *bolt.Tx) error {
+				if !dead {
+					return tx.Bucket(outboxBucket).Put(key, data)
+				}
+				err := appendTo(tx.Bucket(deadBucket), data)
+				if err != nil {
+					return err
+				}
+				return tx.Bucket(outboxBucket).Delete(key)
+			})
+			if uerr != nil || !dead {
+				return sent, errors.Join(err, uerr)
+			}
+
+			log.Printf("Gave up on outbox message %s to %s after %d attempts: %v\n", m.MessageID, m.Key, m.Attempts, err)
+			continue
+		}
+
+		err = o.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(outboxBucket).Delete(key)
+		})
+		if err != nil {
+			return sent, err
+		}
+		sent++
+	}
+}
+
+// refused reports whether err is RabbitMQ refusing a message, rather than the message
+// not getting there
+func refused(err error) bool {
+	return errors.Is(err, ErrNacked) || errors.Is(err, ErrUnroutable)
+}
+
+// Close closes the outbox file
+func (o *Outbox) Close() error {
+	return o.db.Close()
+}
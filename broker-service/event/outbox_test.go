@@ -0,0 +1,111 @@
+package event
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func openTestOutbox(t *testing.T, maxAttempts int, keys ...string) *Outbox {
+	t.Helper()
+
+	o, err := OpenOutbox(filepath.Join(t.TempDir(), "outbox.db"), maxAttempts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { o.Close() })
+
+	for _, key := range keys {
+		err := o.Put(OutboxMessage{Exchange: "logs_topic", Key: key})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return o
+}
+
+// attempts returns the Attempts of the first message in the outbox
+func attempts(t *testing.T, o *Outbox) int {
+	t.Helper()
+
+	n := -1
+	o.Replay(func(m OutboxMessage) error {
+		n = m.Attempts
+		return ErrConfirmTimeout
+	})
+
+	return n
+}
+
+func TestReplayInOrder(t *testing.T) {
+	o := openTestOutbox(t, 3, "log.a", "log.b", "log.c")
+
+	var got []string
+	n, err := o.Replay(func(m OutboxMessage) error {
+		got = append(got, m.Key)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 3 || fmt.Sprint(got) != "[log.a log.b log.c]" || o.Len() != 0 {
+		t.Errorf("replayed %d: %v, %d left", n, got, o.Len())
+	}
+}
+
+func TestReplayTransportErrors(t *testing.T) {
+	for _, transport := range []error{ErrNotConnected, ErrConfirmTimeout, errors.New("channel/connection is not open")} {
+		t.Run(transport.Error(), func(t *testing.T) {
+			o := openTestOutbox(t, 2, "log.a", "log.b")
+
+			// a broker that is down fails every message more often than maxAttempts
+			for i := 0; i < 5; i++ {
+				calls := 0
+				n, err := o.Replay(func(m OutboxMessage) error {
+					calls++
+					return transport
+				})
+				if n != 0 || !errors.Is(err, transport) || calls != 1 {
+					t.Fatalf("Replay = %d, %v after %d publishes; want it to stop at the first", n, err, calls)
+				}
+			}
+
+			if o.Len() != 2 || o.Dead() != 0 || attempts(t, o) != 0 {
+				t.Errorf("%d waiting, %d dead, %d attempts; want the messages left as they were", o.Len(), o.Dead(), attempts(t, o))
+			}
+		})
+	}
+}
+
+func TestReplayRefusals(t *testing.T) {
+	for _, refusal := range []error{ErrNacked, fmt.Errorf("%w: NO_ROUTE log.a", ErrUnroutable)} {
+		t.Run(refusal.Error(), func(t *testing.T) {
+			o := openTestOutbox(t, 2, "log.a", "log.b")
+
+			refuse := func(m OutboxMessage) error {
+				if m.Key == "log.a" {
+					return refusal
+				}
+				return nil
+			}
+
+			// the first refusal stops the replay, so that log.b stays behind log.a
+			n, err := o.Replay(refuse)
+			if n != 0 || !errors.Is(err, refusal) || attempts(t, o) != 1 {
+				t.Fatalf("Replay = %d, %v; want it stopped with one attempt counted", n, err)
+			}
+
+			// the second moves log.a aside and lets log.b through
+			n, err = o.Replay(refuse)
+			if n != 1 || err != nil {
+				t.Fatalf("Replay = %d, %v; want log.b sent", n, err)
+			}
+			if o.Len() != 0 || o.Dead() != 1 {
+				t.Errorf("%d waiting, %d dead; want log.a dead", o.Len(), o.Dead())
+			}
+		})
+	}
+}
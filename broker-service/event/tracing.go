@@ -0,0 +1,76 @@
+package event
+
+import (
+	"context"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "broker/event"
+
+// headerCarrier lets the OpenTelemetry propagator read and write trace context in the
+// headers of an AMQP message
+type headerCarrier amqp.Table
+
+func (c headerCarrier) Get(key string) string {
+	v, _ := c[key].(string)
+	return v
+}
+
+func (c headerCarrier) Set(key, value string) {
+	c[key] = value
+}
+
+func (c headerCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// startPublishSpan starts a producer span for a message sent to exchange with key and
+// returns the headers that carry its context to the consumer
+func startPublishSpan(ctx context.Context, exchange, key string) (context.Context, trace.Span, amqp.Table) {
+	ctx, span := otel.Tracer(tracerName).Start(ctx, exchange+" publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			semconv.MessagingSystemRabbitmq,
+			semconv.MessagingOperationTypePublish,
+			semconv.MessagingDestinationName(exchange),
+			semconv.MessagingRabbitmqDestinationRoutingKey(key),
+		),
+	)
+
+	headers := amqp.Table{}
+	otel.GetTextMapPropagator().Inject(ctx, headerCarrier(headers))
+
+	return ctx, span, headers
+}
+
+// startConsumeSpan starts a consumer span for d, continuing the trace the publisher
+// started if the message carries one
+func startConsumeSpan(d amqp.Delivery, queue string) (context.Context, trace.Span) {
+	ctx := context.Background()
+	if d.Headers != nil {
+		ctx = otel.GetTextMapPropagator().Extract(ctx, headerCarrier(d.Headers))
+	}
+
+	return otel.Tracer(tracerName).Start(ctx, queue+" process",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			semconv.MessagingSystemRabbitmq,
+			semconv.MessagingOperationTypeDeliver,
+			semconv.MessagingDestinationName(d.Exchange),
+			semconv.MessagingRabbitmqDestinationRoutingKey(d.RoutingKey),
+			attribute.String("messaging.rabbitmq.queue", queue),
+		),
+	)
+}
+
+var _ propagation.TextMapCarrier = headerCarrier{}
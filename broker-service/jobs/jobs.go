@@ -0,0 +1,144 @@
+// Package jobs tracks actions the broker runs asynchronously.
+//
+// A job is created as pending when a client asks for an action with "async": true,
+// and is moved to succeeded or failed once a worker has run it. Job state lives in a
+// Store; MemoryStore is the default and keeps everything in the broker's memory.
+package jobs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Job statuses.
+const (
+	StatusPending   = "pending"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+)
+
+// ErrNotFound is returned when a store has no job with the requested ID.
+var ErrNotFound = errors.New("job not found")
+
+// Job is one asynchronous action and, once it has run, its result.
+type Job struct {
+	ID     string `json:"id"`
+	Action string `json:"action"`
+	// Owner identifies the caller that queued the job; only they may read it
+	Owner  string `json:"-"`
+	Status string `json:"status"`
+	// HTTPStatus is the status the action would have returned from a synchronous /handle
+	HTTPStatus int             `json:"http_status,omitempty"`
+	Result     json.RawMessage `json:"result,omitempty"`
+	CreatedAt  time.Time       `json:"created_at"`
+	UpdatedAt  time.Time       `json:"updated_at"`
+}
+
+// Done reports whether the job has finished, successfully or not
+func (j Job) Done() bool {
+	return j.Status == StatusSucceeded || j.Status == StatusFailed
+}
+
+// Store persists jobs. Implementations must be safe for concurrent use.
+type Store interface {
+	Create(job Job) error
+	Get(id string) (Job, error)
+	Update(job Job) error
+}
+
+// New returns a pending job for action, queued by owner, with a fresh random ID
+func New(action, owner string) (Job, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return Job{}, err
+	}
+
+	now := time.Now()
+	return Job{
+		ID:        hex.EncodeToString(b),
+		Action:    action,
+		Owner:     owner,
+		Status:    StatusPending,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}, nil
+}
+
+// MemoryStore keeps jobs in memory. Finished jobs are dropped once they are older than
+// the retention period, so the store doesn't grow without bound.
+type MemoryStore struct {
+	retention time.Duration
+
+	mu        sync.RWMutex
+	jobs      map[string]Job
+	lastPrune time.Time
+}
+
+// NewMemoryStore returns an empty store that keeps finished jobs for retention
+func NewMemoryStore(retention time.Duration) *MemoryStore {
+	if retention <= 0 {
+		retention = time.Hour
+	}
+
+	return &MemoryStore{
+		retention: retention,
+		jobs:      make(map[string]Job),
+	}
+}
+
+func (s *MemoryStore) Create(job Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.prune()
+	s.jobs[job.ID] = job
+
+	return nil
+}
+
+func (s *MemoryStore) Get(id string) (Job, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	job, ok := s.jobs[id]
+	if !ok {
+		return Job{}, ErrNotFound
+	}
+
+	return job, nil
+}
+
+func (s *MemoryStore) Update(job Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.jobs[job.ID]; !ok {
+		return ErrNotFound
+	}
+
+	job.UpdatedAt = time.Now()
+	s.jobs[job.ID] = job
+
+	return nil
+}
+
+// prune removes finished jobs past the retention period, at most once a minute.
+// s.mu must be held.
+func (s *MemoryStore) prune() {
+	if time.Since(s.lastPrune) < time.Minute {
+		return
+	}
+	s.lastPrune = time.Now()
+
+	cutoff := time.Now().Add(-s.retention)
+	for id, job := range s.jobs {
+		if job.Done() && job.UpdatedAt.Before(cutoff) {
+			delete(s.jobs, id)
+		}
+	}
+}
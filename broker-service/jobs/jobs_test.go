@@ -0,0 +1,111 @@
+package jobs
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	a, err := New("mail", "user:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New("mail", "user:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.ID == b.ID || len(a.ID) != 32 {
+		t.Errorf("IDs %q and %q, want two distinct 32 character IDs", a.ID, b.ID)
+	}
+	if a.Status != StatusPending || a.Done() || !a.CreatedAt.Equal(a.UpdatedAt) {
+		t.Errorf("New = %+v, want a pending job", a)
+	}
+}
+
+func TestDone(t *testing.T) {
+	for status, want := range map[string]bool{StatusPending: false, StatusSucceeded: true, StatusFailed: true, "": false} {
+		if got := (Job{Status: status}).Done(); got != want {
+			t.Errorf("Done with status %q = %v, want %v", status, got, want)
+		}
+	}
+}
+
+func TestMemoryStoreUpdate(t *testing.T) {
+	s := NewMemoryStore(time.Hour)
+
+	job, err := New("log", "api-key:k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a job has to be created before a worker can finish it
+	err = s.Update(job)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Update before Create: err = %v, want %v", err, ErrNotFound)
+	}
+
+	job.CreatedAt = time.Now().Add(-time.Minute)
+	job.UpdatedAt = job.CreatedAt
+	err = s.Create(job)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job.Status = StatusSucceeded
+	job.HTTPStatus = 202
+	job.Result = []byte(`{"error":false}`)
+	err = s.Update(job)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.Get(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != StatusSucceeded || got.HTTPStatus != 202 || string(got.Result) != `{"error":false}` {
+		t.Errorf("Get = %+v", got)
+	}
+	if !got.UpdatedAt.After(job.CreatedAt) {
+		t.Errorf("UpdatedAt %s wasn't moved on by Update", got.UpdatedAt)
+	}
+	if got.Owner != "api-key:k1" {
+		t.Errorf("Owner = %q, want it kept", got.Owner)
+	}
+}
+
+func TestMemoryStorePrune(t *testing.T) {
+	s := NewMemoryStore(time.Minute)
+	old := time.Now().Add(-time.Hour)
+
+	s.jobs["finished"] = Job{ID: "finished", Status: StatusFailed, UpdatedAt: old}
+	s.jobs["recent"] = Job{ID: "recent", Status: StatusSucceeded, UpdatedAt: time.Now()}
+	// a job that never finished may still be waiting in the queue
+	s.jobs["stuck"] = Job{ID: "stuck", Status: StatusPending, UpdatedAt: old}
+
+	err := s.Create(Job{ID: "new", Status: StatusPending})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for id, want := range map[string]error{"finished": ErrNotFound, "recent": nil, "stuck": nil, "new": nil} {
+		if _, err := s.Get(id); !errors.Is(err, want) {
+			t.Errorf("Get(%s): err = %v, want %v", id, err, want)
+		}
+	}
+
+	// pruning runs at most once a minute
+	s.jobs["finished"] = Job{ID: "finished", Status: StatusFailed, UpdatedAt: old}
+	s.Create(Job{ID: "newer", Status: StatusPending})
+	if _, err := s.Get("finished"); err != nil {
+		t.Errorf("pruned again straight away: %v", err)
+	}
+}
+
+func TestNewMemoryStoreDefaultRetention(t *testing.T) {
+	if s := NewMemoryStore(0); s.retention != time.Hour {
+		t.Errorf("retention = %s, want an hour", s.retention)
+	}
+}
@@ -0,0 +1,128 @@
+package outbound
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned without calling the downstream service while its breaker is open.
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// Breaker states.
+const (
+	StateClosed   = "closed"
+	StateOpen     = "open"
+	StateHalfOpen = "half-open"
+)
+
+// Breaker is a consecutive-failure circuit breaker for one downstream service.
+//
+// It opens after threshold consecutive failures and rejects calls for openFor. After
+// that it lets a single trial call through (half-open): success closes the breaker,
+// failure opens it again.
+type Breaker struct {
+	threshold int
+	openFor   time.Duration
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	trial    bool
+}
+
+// BreakerStatus is a point-in-time view of a breaker, as shown on the admin endpoint.
+type BreakerStatus struct {
+	Service             string     `json:"service"`
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	OpenedAt            *time.Time `json:"opened_at,omitempty"`
+	RetryAt             *time.Time `json:"retry_at,omitempty"`
+}
+
+func newBreaker(threshold int, openFor time.Duration) *Breaker {
+	if threshold <= 0 {
+		threshold = 5
+	}
+
+	return &Breaker{
+		threshold: threshold,
+		openFor:   openFor,
+		state:     StateClosed,
+	}
+}
+
+// allow reports whether a call may go ahead
+func (b *Breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case StateOpen:
+		if time.Since(b.openedAt) < b.openFor {
+			return false
+		}
+		b.state = StateHalfOpen
+		b.trial = true
+		return true
+	case StateHalfOpen:
+		// only one trial call at a time
+		if b.trial {
+			return false
+		}
+		b.trial = true
+		return true
+	default:
+		return true
+	}
+}
+
+func (b *Breaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.state = StateClosed
+	b.failures = 0
+	b.trial = false
+}
+
+func (b *Breaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.trial = false
+	if b.state == StateHalfOpen || b.failures >= b.threshold {
+		b.state = StateOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// abandon ends a call that neither succeeded nor failed, e.g. because the caller went away
+func (b *Breaker) abandon() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.trial = false
+}
+
+func (b *Breaker) status(service string) BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := BreakerStatus{
+		Service:             service,
+		State:               b.state,
+		ConsecutiveFailures: b.failures,
+	}
+
+	if b.state != StateClosed {
+		openedAt := b.openedAt
+		retryAt := b.openedAt.Add(b.openFor)
+		s.OpenedAt = &openedAt
+		s.RetryAt = &retryAt
+	}
+
+	return s
+}
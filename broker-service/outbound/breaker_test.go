@@ -0,0 +1,94 @@
+package outbound
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreakerOpensAfterConsecutiveFailures(t *testing.T) {
+	b := newBreaker(3, time.Minute)
+
+	b.failure()
+	b.failure()
+	b.success()
+	b.failure()
+	b.failure()
+	if !b.allow() {
+		t.Fatal("a success in between didn't reset the failure count")
+	}
+
+	b.failure()
+	if b.allow() {
+		t.Fatal("breaker still closed after three consecutive failures")
+	}
+
+	s := b.status("auth")
+	if s.State != StateOpen || s.ConsecutiveFailures != 3 {
+		t.Fatalf("status = %+v", s)
+	}
+	if s.RetryAt.Sub(*s.OpenedAt) != time.Minute {
+		t.Errorf("RetryAt %s isn't the open timeout after OpenedAt %s", s.RetryAt, s.OpenedAt)
+	}
+}
+
+func TestBreakerHalfOpen(t *testing.T) {
+	open := func() *Breaker {
+		b := newBreaker(1, time.Minute)
+		b.failure()
+		// as if the open timeout had passed
+		b.openedAt = time.Now().Add(-time.Hour)
+		return b
+	}
+
+	t.Run("one trial at a time", func(t *testing.T) {
+		b := open()
+		if !b.allow() {
+			t.Fatal("trial call refused")
+		}
+		if b.allow() {
+			t.Error("second call let through while the trial is running")
+		}
+	})
+
+	t.Run("successful trial closes", func(t *testing.T) {
+		b := open()
+		b.allow()
+		b.success()
+		if s := b.status("auth"); s.State != StateClosed || s.OpenedAt != nil {
+			t.Errorf("status = %+v, want closed", s)
+		}
+	})
+
+	t.Run("failed trial opens again", func(t *testing.T) {
+		b := open()
+		b.allow()
+		b.failure()
+		if b.allow() {
+			t.Error("call let through straight after a failed trial")
+		}
+	})
+
+	t.Run("abandoned trial frees the slot", func(t *testing.T) {
+		b := open()
+		b.allow()
+		b.abandon()
+		if !b.allow() || b.status("auth").State != StateHalfOpen {
+			t.Error("no new trial after the first was abandoned")
+		}
+	})
+}
+
+func TestNewBreakerDefaultThreshold(t *testing.T) {
+	b := newBreaker(0, time.Minute)
+	for i := 0; i < 4; i++ {
+		b.failure()
+	}
+	if !b.allow() {
+		t.Fatal("opened before the default threshold of 5")
+	}
+
+	b.failure()
+	if b.allow() {
+		t.Error("still closed after 5 failures")
+	}
+}
@@ -0,0 +1,319 @@
+// Package outbound is the broker's shared layer for calls to downstream services.
+//
+// Every call goes through a Client, which applies the service's timeout, retries
+// idempotent calls with jittered exponential backoff, and keeps a circuit breaker
+// per service so that a failing downstream is cut off instead of tying up handlers.
+package outbound
+
+import (
+	"broker/discovery"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// maxResponseSize caps how much of a downstream response body is buffered
+const maxResponseSize = 10 << 20
+
+// Policy controls how calls to one service are made.
+type Policy struct {
+	// Timeout bounds each attempt
+	Timeout time.Duration
+	// Retries is how many extra attempts an idempotent call gets
+	Retries int
+	// BaseBackoff and MaxBackoff bound the jittered delay between attempts
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+	// FailureThreshold consecutive failures open the breaker for OpenTimeout
+	FailureThreshold int
+	OpenTimeout      time.Duration
+}
+
+// DefaultPolicy is used for any service without a policy of its own
+var DefaultPolicy = Policy{
+	Timeout:          5 * time.Second,
+	Retries:          2,
+	BaseBackoff:      100 * time.Millisecond,
+	MaxBackoff:       time.Second,
+	FailureThreshold: 5,
+	OpenTimeout:      30 * time.Second,
+}
+
+// PolicyFromEnv overrides fields of p from OUTBOUND_<SERVICE>_TIMEOUT, _RETRIES,
+// _FAILURE_THRESHOLD and _OPEN_TIMEOUT. An empty service reads OUTBOUND_TIMEOUT etc.
+func PolicyFromEnv(service string, p Policy) Policy {
+	prefix := "OUTBOUND_"
+	if service != "" {
+		prefix += strings.ToUpper(strings.ReplaceAll(service, "-", "_")) + "_"
+	}
+
+	if d, err := time.ParseDuration(os.Getenv(prefix + "TIMEOUT")); err == nil {
+		p.Timeout = d
+	}
+	if n, err := strconv.Atoi(os.Getenv(prefix + "RETRIES")); err == nil {
+		p.Retries = n
+	}
+	if n, err := strconv.Atoi(os.Getenv(prefix + "FAILURE_THRESHOLD")); err == nil {
+		p.FailureThreshold = n
+	}
+	if d, err := time.ParseDuration(os.Getenv(prefix + "OPEN_TIMEOUT")); err == nil {
+		p.OpenTimeout = d
+	}
+
+	return p
+}
+
+// permanentError marks an error that should neither be retried nor count against the breaker.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent wraps err so that Call returns it straight away. Use it for failures that
+// say nothing about the health of the downstream service, such as a bad request.
+func Permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// Observer is told about every attempt a Client makes. It returns a function that is
+// called with the attempt's error, or nil, once the attempt is over.
+type Observer func(service, transport string) func(err error)
+
+// Client makes calls to downstream services.
+type Client struct {
+	services *discovery.Registry
+	http     *http.Client
+	fallback Policy
+	policies map[string]Policy
+	observer Observer
+
+	mu       sync.Mutex
+	breakers map[string]*Breaker
+}
+
+// NewClient returns a client that resolves services through registry. Services without
+// an entry in policies use fallback.
+func NewClient(registry *discovery.Registry, fallback Policy, policies map[string]Policy) *Client {
+	return &Client{
+		services: registry,
+		http:     &http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)},
+		fallback: fallback,
+		policies: policies,
+		breakers: make(map[string]*Breaker),
+	}
+}
+
+// SetObserver makes c report every attempt to o. It must be called before c is used.
+func (c *Client) SetObserver(o Observer) {
+	c.observer = o
+}
+
+func (c *Client) policy(service string) Policy {
+	if p, ok := c.policies[service]; ok {
+		return p
+	}
+
+	return c.fallback
+}
+
+func (c *Client) breaker(service string) *Breaker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b, ok := c.breakers[service]
+	if !ok {
+		p := c.policy(service)
+		b = newBreaker(p.FailureThreshold, p.OpenTimeout)
+		c.breakers[service] = b
+	}
+
+	return b
+}
+
+// Breakers returns the state of every breaker that has seen traffic, sorted by service
+func (c *Client) Breakers() []BreakerStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	out := make([]BreakerStatus, 0, len(c.breakers))
+	for service, b := range c.breakers {
+		out = append(out, b.status(service))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Service < out[j].Service })
+
+	return out
+}
+
+// Call runs fn against an endpoint of service. Each attempt gets its own endpoint and
+// the service's timeout. Only idempotent calls are retried. transport names how fn
+// reaches the service ("http", "rpc", "grpc") and is only used to label observations.
+func (c *Client) Call(ctx context.Context, service, transport string, idempotent bool, fn func(ctx context.Context, ep discovery.Endpoint) error) error {
+	policy := c.policy(service)
+	breaker := c.breaker(service)
+
+	attempts := 1
+	if idempotent {
+		attempts += policy.Retries
+	}
+
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			err2 := sleep(ctx, backoff(policy, attempt))
+			if err2 != nil {
+				return err
+			}
+		}
+
+		if !breaker.allow() {
+			return fmt.Errorf("%s is unavailable: %w", service, ErrCircuitOpen)
+		}
+
+		err = c.attempt(ctx, service, transport, policy, fn)
+
+		var perm *permanentError
+		switch {
+		case err == nil:
+			breaker.success()
+			return nil
+		case errors.As(err, &perm):
+			breaker.success()
+			return perm.err
+		case ctx.Err() != nil:
+			// the caller gave up; that says nothing about the downstream service
+			breaker.abandon()
+			return err
+		case errors.Is(err, discovery.ErrNoEndpoints):
+			breaker.abandon()
+			return err
+		default:
+			breaker.failure()
+		}
+	}
+
+	return err
+}
+
+func (c *Client) attempt(ctx context.Context, service, transport string, policy Policy, fn func(ctx context.Context, ep discovery.Endpoint) error) (err error) {
+	ep, release, err := c.services.Pick(service)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if c.observer != nil {
+		done := c.observer(service, transport)
+		defer func() {
+			// a permanent error is the caller's fault, not a failed call
+			var perm *permanentError
+			if errors.As(err, &perm) {
+				done(nil)
+				return
+			}
+			done(err)
+		}()
+	}
+
+	if policy.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, policy.Timeout)
+		defer cancel()
+	}
+
+	return fn(ctx, ep)
+}
+
+// Request is an outbound HTTP call. Path is appended to the chosen endpoint's URL.
+type Request struct {
+	Service    string
+	Method     string
+	Path       string
+	Body       []byte
+	Header     http.Header
+	Idempotent bool
+}
+
+// Do sends req through Call. 5xx responses count as failures and are retried like
+// transport errors; once attempts run out the last response is returned to the caller.
+// The response body is fully buffered, so it stays readable after the attempt's
+// timeout has been released.
+func (c *Client) Do(ctx context.Context, req Request) (*http.Response, error) {
+	var response *http.Response
+
+	err := c.Call(ctx, req.Service, "http", req.Idempotent, func(ctx context.Context, ep discovery.Endpoint) error {
+		response = nil
+
+		request, err := http.NewRequestWithContext(ctx, req.Method, ep.URL(req.Path), bytes.NewReader(req.Body))
+		if err != nil {
+			return Permanent(err)
+		}
+		for k, v := range req.Header {
+			request.Header[k] = v
+		}
+
+		res, err := c.http.Do(request)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+
+		body, err := io.ReadAll(io.LimitReader(res.Body, maxResponseSize))
+		if err != nil {
+			return err
+		}
+		res.Body = io.NopCloser(bytes.NewReader(body))
+		response = res
+
+		if res.StatusCode >= http.StatusInternalServerError {
+			return fmt.Errorf("%s responded with status %d", req.Service, res.StatusCode)
+		}
+
+		return nil
+	})
+
+	// a 5xx that used up every attempt is still a response the caller can inspect
+	if err != nil && response != nil && !errors.Is(err, ErrCircuitOpen) {
+		return response, nil
+	}
+
+	return response, err
+}
+
+// backoff returns a random delay in [0, min(MaxBackoff, BaseBackoff*2^attempt)) ("full jitter")
+func backoff(p Policy, attempt int) time.Duration {
+	d := p.BaseBackoff << attempt
+	if d <= 0 || (p.MaxBackoff > 0 && d > p.MaxBackoff) {
+		d = p.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(d)))
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
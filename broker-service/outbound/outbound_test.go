@@ -0,0 +1,307 @@
+package outbound
+
+import (
+	"broker/discovery"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// staticSource resolves every service to the same endpoints
+type staticSource []string
+
+func (s staticSource) Endpoints(service string) ([]string, error) {
+	return s, nil
+}
+
+// newTestClient returns a client whose "svc" answers with the statuses in order,
+// repeating the last one, and a count of the requests it got
+func newTestClient(t *testing.T, statuses ...int) (*Client, *atomic.Int32) {
+	t.Helper()
+
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(calls.Add(1)) - 1
+		w.WriteHeader(statuses[min(n, len(statuses)-1)])
+		w.Write([]byte(r.Method + " " + r.URL.Path))
+	}))
+	t.Cleanup(srv.Close)
+
+	registry, err := discovery.NewRegistry(staticSource{srv.URL}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	policy := Policy{
+		Timeout:          time.Second,
+		Retries:          2,
+		BaseBackoff:      time.Millisecond,
+		MaxBackoff:       time.Millisecond,
+		FailureThreshold: 3,
+		OpenTimeout:      time.Minute,
+	}
+
+	return NewClient(registry, policy, nil), &calls
+}
+
+func TestDoRetries(t *testing.T) {
+	tests := []struct {
+		name       string
+		statuses   []int
+		idempotent bool
+		wantStatus int
+		wantCalls  int32
+	}{
+		{name: "success first time", statuses: []int{200}, idempotent: true, wantStatus: 200, wantCalls: 1},
+		{name: "idempotent call retried after a 5xx", statuses: []int{503, 502, 200}, idempotent: true, wantStatus: 200, wantCalls: 3},
+		{name: "last 5xx returned once attempts run out", statuses: []int{500}, idempotent: true, wantStatus: 500, wantCalls: 3},
+		{name: "other calls aren't retried", statuses: []int{503, 200}, idempotent: false, wantStatus: 503, wantCalls: 1},
+		{name: "4xx isn't retried", statuses: []int{404, 200}, idempotent: true, wantStatus: 404, wantCalls: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, calls := newTestClient(t, tt.statuses...)
+
+			res, err := c.Do(context.Background(), Request{Service: "svc", Method: "GET", Path: "/", Idempotent: tt.idempotent})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+
+			if res.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", res.StatusCode, tt.wantStatus)
+			}
+			if n := calls.Load(); n != tt.wantCalls {
+				t.Errorf("downstream got %d calls, want %d", n, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestBreakerOpensAndRejects(t *testing.T) {
+	c, calls := newTestClient(t, 500)
+
+	// each non-idempotent call is one failure; the third opens the breaker
+	for i := 0; i < 3; i++ {
+		res, err := c.Do(context.Background(), Request{Service: "svc", Method: "POST", Path: "/"})
+		if err != nil {
+			t.Fatalf("call %d: %v", i, err)
+		}
+		res.Body.Close()
+	}
+
+	_, err := c.Do(context.Background(), Request{Service: "svc", Method: "POST", Path: "/"})
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("err = %v, want %v", err, ErrCircuitOpen)
+	}
+	if n := calls.Load(); n != 3 {
+		t.Errorf("downstream got %d calls, want 3", n)
+	}
+
+	breakers := c.Breakers()
+	if len(breakers) != 1 || breakers[0].State != StateOpen || breakers[0].RetryAt == nil {
+		t.Errorf("Breakers = %+v", breakers)
+	}
+}
+
+func TestBreakerOpensDuringRetries(t *testing.T) {
+	c, calls := newTestClient(t, 503)
+	c.policies = map[string]Policy{"svc": {Retries: 5, FailureThreshold: 2, OpenTimeout: time.Minute}}
+
+	_, err := c.Do(context.Background(), Request{Service: "svc", Method: "GET", Path: "/", Idempotent: true})
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("err = %v, want %v", err, ErrCircuitOpen)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("downstream got %d calls, want retries to stop once the breaker opened after 2", n)
+	}
+}
+
+func TestDoBuffersBody(t *testing.T) {
+	c, _ := newTestClient(t, 200)
+
+	res, err := c.Do(context.Background(), Request{Service: "svc", Method: "GET", Path: "/users/1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the attempt's context is gone by now; the body must still be readable
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "GET /users/1" {
+		t.Errorf("body = %q", body)
+	}
+}
+
+func TestCallPermanent(t *testing.T) {
+	c, _ := newTestClient(t, 200)
+	bad := errors.New("bad request")
+
+	attempts := 0
+	for i := 0; i < 5; i++ {
+		err := c.Call(context.Background(), "svc", "http", true, func(ctx context.Context, ep discovery.Endpoint) error {
+			attempts++
+			return Permanent(bad)
+		})
+		if !errors.Is(err, bad) {
+			t.Fatalf("err = %v, want %v", err, bad)
+		}
+	}
+
+	// permanent errors are neither retried nor counted against the breaker
+	if attempts != 5 {
+		t.Errorf("%d attempts, want 5", attempts)
+	}
+	if state := c.Breakers()[0].State; state != StateClosed {
+		t.Errorf("breaker is %s, want %s", state, StateClosed)
+	}
+}
+
+func TestCallCancelled(t *testing.T) {
+	c, _ := newTestClient(t, 200)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	attempts := 0
+	err := c.Call(ctx, "svc", "http", true, func(ctx context.Context, ep discovery.Endpoint) error {
+		attempts++
+		cancel()
+		return ctx.Err()
+	})
+
+	if !errors.Is(err, context.Canceled) || attempts != 1 {
+		t.Errorf("err = %v after %d attempts, want %v after 1", err, attempts, context.Canceled)
+	}
+	if b := c.Breakers()[0]; b.ConsecutiveFailures != 0 {
+		t.Errorf("a cancelled call counted as a failure: %+v", b)
+	}
+}
+
+func TestCallNoEndpoints(t *testing.T) {
+	registry, err := discovery.NewRegistry(staticSource{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewClient(registry, DefaultPolicy, nil)
+
+	for i := 0; i < 10; i++ {
+		err := c.Call(context.Background(), "billing", "http", true, func(ctx context.Context, ep discovery.Endpoint) error {
+			t.Fatal("fn called without an endpoint")
+			return nil
+		})
+		if !errors.Is(err, discovery.ErrNoEndpoints) {
+			t.Fatalf("err = %v, want %v", err, discovery.ErrNoEndpoints)
+		}
+	}
+
+	// a missing configuration isn't an outage of the service
+	if b := c.Breakers()[0]; b.State != StateClosed || b.ConsecutiveFailures != 0 {
+		t.Errorf("breaker = %+v", b)
+	}
+}
+
+func TestCallTimeoutPerAttempt(t *testing.T) {
+	c, _ := newTestClient(t, 200)
+	c.policies = map[string]Policy{"svc": {Timeout: 20 * time.Millisecond, Retries: 1, FailureThreshold: 5}}
+
+	var deadlines []time.Time
+	err := c.Call(context.Background(), "svc", "http", true, func(ctx context.Context, ep discovery.Endpoint) error {
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			t.Fatal("attempt without a deadline")
+		}
+		deadlines = append(deadlines, deadline)
+
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if len(deadlines) != 2 || !deadlines[1].After(deadlines[0]) {
+		t.Errorf("deadlines = %v, want a fresh one for each of 2 attempts", deadlines)
+	}
+	// an attempt that timed out is a failure, unlike one the caller cancelled
+	if b := c.Breakers()[0]; b.ConsecutiveFailures != 2 {
+		t.Errorf("breaker = %+v, want 2 failures", b)
+	}
+}
+
+func TestObserver(t *testing.T) {
+	c, _ := newTestClient(t, 200)
+
+	var observed []string
+	c.SetObserver(func(service, transport string) func(error) {
+		return func(err error) {
+			result := "ok"
+			if err != nil {
+				result = err.Error()
+			}
+			observed = append(observed, service+"/"+transport+": "+result)
+		}
+	})
+
+	results := []error{errors.New("refused"), Permanent(errors.New("bad request")), nil}
+	for _, result := range results {
+		c.Call(context.Background(), "svc", "grpc", false, func(ctx context.Context, ep discovery.Endpoint) error {
+			return result
+		})
+	}
+
+	// the caller's own mistakes aren't failed calls
+	want := "svc/grpc: refused,svc/grpc: ok,svc/grpc: ok"
+	if got := strings.Join(observed, ","); got != want {
+		t.Errorf("observed %q, want %q", got, want)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	p := Policy{BaseBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+
+	tests := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{attempt: 1, max: 200 * time.Millisecond},
+		{attempt: 3, max: 800 * time.Millisecond},
+		{attempt: 4, max: time.Second},
+		// large enough for the shift to overflow
+		{attempt: 64, max: time.Second},
+	}
+
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			if d := backoff(p, tt.attempt); d < 0 || d >= tt.max {
+				t.Fatalf("backoff(attempt %d) = %s, want within [0, %s)", tt.attempt, d, tt.max)
+			}
+		}
+	}
+
+	if d := backoff(Policy{}, 1); d != 0 {
+		t.Errorf("backoff without any bounds = %s, want 0", d)
+	}
+}
+
+func TestPolicyFromEnv(t *testing.T) {
+	t.Setenv("OUTBOUND_LOGGER_RPC_TIMEOUT", "250ms")
+	t.Setenv("OUTBOUND_LOGGER_RPC_RETRIES", "0")
+	t.Setenv("OUTBOUND_LOGGER_RPC_OPEN_TIMEOUT", "soon")
+
+	p := PolicyFromEnv("logger-rpc", DefaultPolicy)
+
+	want := DefaultPolicy
+	want.Timeout = 250 * time.Millisecond
+	want.Retries = 0
+	if p != want {
+		t.Errorf("policy = %+v, want %+v", p, want)
+	}
+}
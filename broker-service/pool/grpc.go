@@ -0,0 +1,151 @@
+package pool
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+)
+
+// GRPCPool holds one grpc.ClientConn per endpoint. A ClientConn already multiplexes
+// calls and reconnects with backoff on its own; the pool keeps it alive for the life of
+// the broker and nudges idle or failed connections to reconnect before they're needed.
+type GRPCPool struct {
+	opts []grpc.DialOption
+
+	mu     sync.Mutex
+	conns  map[string]*grpc.ClientConn
+	closed bool
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewGRPCPool returns a pool that creates connections with opts, health-checked every interval
+func NewGRPCPool(interval time.Duration, opts ...grpc.DialOption) *GRPCPool {
+	p := &GRPCPool{
+		opts:  opts,
+		conns: make(map[string]*grpc.ClientConn),
+		done:  make(chan struct{}),
+	}
+
+	p.wg.Add(1)
+	go p.healthLoop(interval)
+
+	return p
+}
+
+// Conn returns the connection for addr, creating it on first use. Creating a
+// connection doesn't wait for it to be established.
+func (p *GRPCPool) Conn(addr string) (*grpc.ClientConn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil, ErrClosed
+	}
+
+	if conn, ok := p.conns[addr]; ok {
+		return conn, nil
+	}
+
+	conn, err := grpc.NewClient(addr, p.opts...)
+	if err != nil {
+		return nil, err
+	}
+	conn.Connect()
+	p.conns[addr] = conn
+
+	return conn, nil
+}
+
+// Warm starts connecting to addr ahead of the first call
+func (p *GRPCPool) Warm(addr string) {
+	_, err := p.Conn(addr)
+	if err != nil {
+		log.Printf("grpc pool: could not create connection to %s: %s", addr, err)
+	}
+}
+
+func (p *GRPCPool) healthLoop(interval time.Duration) {
+	defer p.wg.Done()
+
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			p.check()
+		}
+	}
+}
+
+// check asks idle connections to reconnect and logs the ones that are failing
+func (p *GRPCPool) check() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for addr, conn := range p.conns {
+		switch state := conn.GetState(); state {
+		case connectivity.Idle:
+			conn.Connect()
+		case connectivity.TransientFailure:
+			log.Printf("grpc pool: connection to %s is %s, reconnecting", addr, state)
+			conn.Connect()
+		}
+	}
+}
+
+// Status reports the connectivity state of every endpoint
+func (p *GRPCPool) Status() []EndpointStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	out := make([]EndpointStatus, 0, len(p.conns))
+	for addr, conn := range p.conns {
+		state := conn.GetState()
+		s := EndpointStatus{Address: addr, Size: 1, State: state.String()}
+		if state == connectivity.Ready {
+			s.Connected = 1
+		}
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Address < out[j].Address })
+
+	return out
+}
+
+// Close stops the health check and closes every connection
+func (p *GRPCPool) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	close(p.done)
+
+	var errs []error
+	for addr, conn := range p.conns {
+		if err := conn.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", addr, err))
+		}
+	}
+	p.conns = nil
+	p.mu.Unlock()
+
+	p.wg.Wait()
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,301 @@
+// Package pool keeps long-lived client connections to the logger service, so that the
+// broker doesn't dial a new connection for every request.
+//
+// Both pools are keyed by endpoint address, are safe for concurrent use, and run a
+// background health check that replaces broken connections, so the broker picks the
+// logger back up on its own after it restarts.
+package pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/rpc"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrClosed is returned by a pool that has been shut down.
+var ErrClosed = errors.New("pool is closed")
+
+// pingMethod is called by the health check. A server that doesn't implement it still
+// answers with an rpc.ServerError, which is enough to show the connection is alive.
+const pingMethod = "RPCServer.Ping"
+
+// RPCPool holds size net/rpc clients per endpoint and hands them out round-robin.
+// A single rpc.Client multiplexes concurrent calls, so a small pool goes a long way.
+type RPCPool struct {
+	size        int
+	dialTimeout time.Duration
+
+	mu     sync.Mutex
+	conns  map[string]*rpcConns
+	closed bool
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+type rpcConns struct {
+	clients []*rpc.Client
+	next    int
+}
+
+// EndpointStatus describes the connections a pool holds for one endpoint.
+type EndpointStatus struct {
+	Address   string `json:"address"`
+	Size      int    `json:"size"`
+	Connected int    `json:"connected"`
+	State     string `json:"state,omitempty"`
+}
+
+// NewRPCPool returns a pool with size connections per endpoint, health-checked every interval
+func NewRPCPool(size int, interval time.Duration) *RPCPool {
+	if size <= 0 {
+		size = 1
+	}
+
+	p := &RPCPool{
+		size:        size,
+		dialTimeout: 5 * time.Second,
+		conns:       make(map[string]*rpcConns),
+		done:        make(chan struct{}),
+	}
+
+	p.wg.Add(1)
+	go p.healthLoop(interval)
+
+	return p
+}
+
+// Warm dials addr ahead of the first call. Failures are logged and left to the health check.
+func (p *RPCPool) Warm(addr string) {
+	for slot := 0; slot < p.size; slot++ {
+		_, err := p.slot(addr, slot)
+		if err != nil {
+			log.Printf("rpc pool: could not connect to %s: %s", addr, err)
+			return
+		}
+	}
+}
+
+// Call invokes method on addr over a pooled connection. net/rpc has no notion of
+// contexts, so Call waits for whichever of the reply or ctx comes first.
+func (p *RPCPool) Call(ctx context.Context, addr, method string, args, reply any) error {
+	client, err := p.get(addr)
+	if err != nil {
+		return err
+	}
+
+	return p.call(ctx, addr, client, method, args, reply)
+}
+
+func (p *RPCPool) call(ctx context.Context, addr string, client *rpc.Client, method string, args, reply any) error {
+	call := client.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		if broken(call.Error) {
+			p.discard(addr, client)
+		}
+		return call.Error
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// get returns the next client for addr in round-robin order
+func (p *RPCPool) get(addr string) (*rpc.Client, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, ErrClosed
+	}
+
+	c := p.endpoint(addr)
+	slot := c.next % p.size
+	c.next++
+	p.mu.Unlock()
+
+	return p.slot(addr, slot)
+}
+
+// endpoint returns the slots for addr, creating them on first use. p.mu must be held.
+func (p *RPCPool) endpoint(addr string) *rpcConns {
+	c, ok := p.conns[addr]
+	if !ok {
+		c = &rpcConns{clients: make([]*rpc.Client, p.size)}
+		p.conns[addr] = c
+	}
+
+	return c
+}
+
+// slot returns the client in one slot for addr, dialling a new one if the slot is empty
+func (p *RPCPool) slot(addr string, slot int) (*rpc.Client, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, ErrClosed
+	}
+	c := p.endpoint(addr)
+	client := c.clients[slot]
+	p.mu.Unlock()
+
+	if client != nil {
+		return client, nil
+	}
+
+	client, err := p.dial(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		client.Close()
+		return nil, ErrClosed
+	}
+
+	// another caller may have filled the slot while we were dialling
+	if existing := c.clients[slot]; existing != nil {
+		client.Close()
+		return existing, nil
+	}
+	c.clients[slot] = client
+
+	return client, nil
+}
+
+func (p *RPCPool) dial(addr string) (*rpc.Client, error) {
+	conn, err := net.DialTimeout("tcp", addr, p.dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return rpc.NewClient(conn), nil
+}
+
+// discard drops client from the pool so the next call or health check redials
+func (p *RPCPool) discard(addr string, client *rpc.Client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if c, ok := p.conns[addr]; ok {
+		for i, existing := range c.clients {
+			if existing == client {
+				c.clients[i] = nil
+			}
+		}
+	}
+
+	client.Close()
+}
+
+// broken reports whether err means the connection itself is gone, as opposed to the
+// server returning an error for this one call
+func broken(err error) bool {
+	return errors.Is(err, rpc.ErrShutdown) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// healthLoop pings every pooled client, dropping dead ones and refilling empty slots
+func (p *RPCPool) healthLoop(interval time.Duration) {
+	defer p.wg.Done()
+
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			p.check()
+		}
+	}
+}
+
+func (p *RPCPool) check() {
+	p.mu.Lock()
+	addrs := make([]string, 0, len(p.conns))
+	for addr := range p.conns {
+		addrs = append(addrs, addr)
+	}
+	p.mu.Unlock()
+
+	for _, addr := range addrs {
+		for slot := 0; slot < p.size; slot++ {
+			client, err := p.slot(addr, slot)
+			if err != nil {
+				continue
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), p.dialTimeout)
+			err = p.call(ctx, addr, client, pingMethod, struct{}{}, new(string))
+			cancel()
+
+			var serverErr rpc.ServerError
+			if err != nil && !errors.As(err, &serverErr) {
+				log.Printf("rpc pool: dropping connection to %s: %s", addr, err)
+				p.discard(addr, client)
+			}
+		}
+	}
+}
+
+// Status reports how many live connections the pool holds per endpoint
+func (p *RPCPool) Status() []EndpointStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	out := make([]EndpointStatus, 0, len(p.conns))
+	for addr, c := range p.conns {
+		s := EndpointStatus{Address: addr, Size: p.size}
+		for _, client := range c.clients {
+			if client != nil {
+				s.Connected++
+			}
+		}
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Address < out[j].Address })
+
+	return out
+}
+
+// Close stops the health check and closes every connection
+func (p *RPCPool) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	close(p.done)
+
+	var errs []error
+	for addr, c := range p.conns {
+		for _, client := range c.clients {
+			if client == nil {
+				continue
+			}
+			if err := client.Close(); err != nil && !errors.Is(err, rpc.ErrShutdown) {
+				errs = append(errs, fmt.Errorf("%s: %w", addr, err))
+			}
+		}
+	}
+	p.conns = nil
+	p.mu.Unlock()
+
+	p.wg.Wait()
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,113 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a Store that keeps everything in process memory. Limits are per broker
+// instance, and reset when the broker restarts.
+type MemoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	counters  map[string]*counter
+	lastPrune time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	idle   time.Duration // time for an empty bucket to refill completely
+}
+
+type counter struct {
+	value   int64
+	expires time.Time
+}
+
+// NewMemoryStore returns an empty store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets:  make(map[string]*bucket),
+		counters: make(map[string]*counter),
+	}
+}
+
+func (s *MemoryStore) Take(ctx context.Context, key string, rate float64, burst int) (bool, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.prune(now)
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(burst), last: now}
+		s.buckets[key] = b
+	}
+	b.idle = time.Duration(float64(burst) / rate * float64(time.Second))
+
+	// refill for the time that has passed since the last request
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / rate * float64(time.Second))
+		return false, wait, nil
+	}
+
+	b.tokens--
+	return true, 0, nil
+}
+
+func (s *MemoryStore) Add(ctx context.Context, key string, delta int64, expires time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.prune(now)
+
+	c, ok := s.counters[key]
+	if !ok || now.After(c.expires) {
+		c = &counter{}
+		s.counters[key] = c
+	}
+	c.value += delta
+	c.expires = expires
+
+	return c.value, nil
+}
+
+func (s *MemoryStore) Count(ctx context.Context, key string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.counters[key]
+	if !ok || time.Now().After(c.expires) {
+		return 0, nil
+	}
+
+	return c.value, nil
+}
+
+// prune drops full buckets and expired counters, at most once a minute. s.mu must be held.
+func (s *MemoryStore) prune(now time.Time) {
+	if now.Sub(s.lastPrune) < time.Minute {
+		return
+	}
+	s.lastPrune = now
+
+	for key, b := range s.buckets {
+		if now.Sub(b.last) > b.idle {
+			delete(s.buckets, key)
+		}
+	}
+
+	for key, c := range s.counters {
+		if now.After(c.expires) {
+			delete(s.counters, key)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+// Package ratelimit limits how often each client may run each broker action.
+//
+// Every client and action pair gets a token bucket, and actions can additionally have
+// a daily quota. Bucket and counter state lives in a Store: MemoryStore keeps it in the
+// broker process, and a shared implementation (Redis, for example) can be plugged in
+// when several brokers run side by side.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Store holds limiter state. Implementations must be safe for concurrent use.
+type Store interface {
+	// Take removes one token from the bucket key, which refills at rate tokens per
+	// second up to burst. When the bucket is empty it reports how long until a token
+	// becomes available.
+	Take(ctx context.Context, key string, rate float64, burst int) (ok bool, retryAfter time.Duration, err error)
+	// Add adds delta to the counter key and returns the new value. The counter is
+	// discarded at expires.
+	Add(ctx context.Context, key string, delta int64, expires time.Time) (int64, error)
+	// Count returns the value of the counter key, or 0 if it doesn't exist.
+	Count(ctx context.Context, key string) (int64, error)
+}
+
+// Rule is the limit for one action. A zero Rate means no rate limit and a zero
+// DailyQuota means no quota.
+type Rule struct {
+	Rate       float64
+	Burst      int
+	DailyQuota int64
+}
+
+// Limiter applies rules to clients.
+type Limiter struct {
+	store    Store
+	fallback Rule
+	rules    map[string]Rule
+}
+
+// New returns a limiter that applies rules per action and fallback to any other action
+func New(store Store, fallback Rule, rules map[string]Rule) *Limiter {
+	return &Limiter{
+		store:    store,
+		fallback: fallback,
+		rules:    rules,
+	}
+}
+
+// Rule returns the rule for action
+func (l *Limiter) Rule(action string) Rule {
+	if r, ok := l.rules[action]; ok {
+		return r
+	}
+
+	return l.fallback
+}
+
+// Decision is the outcome of Allow.
+type Decision struct {
+	Allowed    bool
+	RetryAfter time.Duration
+	Reason     string
+}
+
+// Allow checks the daily quota and rate limit of client for action, and if both allow
+// it, counts the request against them. A request either refuses doesn't count against
+// the other: the quota is checked first, and given back if the rate limit refuses.
+func (l *Limiter) Allow(ctx context.Context, client, action string) (Decision, error) {
+	rule := l.Rule(action)
+
+	var refund func() error
+	if rule.DailyQuota > 0 {
+		now := time.Now().UTC()
+		key := quotaKey(client, action, now)
+		reset := endOfDay(now)
+
+		count, err := l.store.Add(ctx, key, 1, reset)
+		if err != nil {
+			return Decision{}, err
+		}
+		refund = func() error {
+			_, err := l.store.Add(ctx, key, -1, reset)
+			return err
+		}
+
+		if count > rule.DailyQuota {
+			// rejected requests don't count against the quota
+			err = refund()
+			if err != nil {
+				return Decision{}, err
+			}
+
+			return Decision{
+				Allowed:    false,
+				RetryAfter: time.Until(reset),
+				Reason:     fmt.Sprintf("daily quota of %d for %s used up", rule.DailyQuota, action),
+			}, nil
+		}
+	}
+
+	if rule.Rate > 0 {
+		burst := rule.Burst
+		if burst < 1 {
+			burst = 1
+		}
+
+		ok, retryAfter, err := l.store.Take(ctx, bucketKey(client, action), rule.Rate, burst)
+		if err == nil && !ok && refund != nil {
+			err = refund()
+		}
+		if err != nil {
+			return Decision{}, err
+		}
+		if !ok {
+			return Decision{
+				Allowed:    false,
+				RetryAfter: retryAfter,
+				Reason:     fmt.Sprintf("rate limit for %s exceeded", action),
+			}, nil
+		}
+	}
+
+	return Decision{Allowed: true}, nil
+}
+
+// QuotaStatus reports how much of its daily quota a client has used for one action.
+type QuotaStatus struct {
+	Action    string    `json:"action"`
+	Limit     int64     `json:"limit"`
+	Used      int64     `json:"used"`
+	Remaining int64     `json:"remaining"`
+	ResetsAt  time.Time `json:"resets_at"`
+}
+
+// Quotas returns the quota status of client for every action in actions that has a quota
+func (l *Limiter) Quotas(ctx context.Context, client string, actions []string) ([]QuotaStatus, error) {
+	now := time.Now().UTC()
+
+	out := []QuotaStatus{}
+	for _, action := range actions {
+		rule := l.Rule(action)
+		if rule.DailyQuota <= 0 {
+			continue
+		}
+
+		used, err := l.store.Count(ctx, quotaKey(client, action, now))
+		if err != nil {
+			return nil, err
+		}
+
+		out = append(out, QuotaStatus{
+			Action:    action,
+			Limit:     rule.DailyQuota,
+			Used:      used,
+			Remaining: int64(math.Max(0, float64(rule.DailyQuota-used))),
+			ResetsAt:  endOfDay(now),
+		})
+	}
+
+	return out, nil
+}
+
+func bucketKey(client, action string) string {
+	return "rate:" + client + ":" + action
+}
+
+func quotaKey(client, action string, day time.Time) string {
+	return "quota:" + client + ":" + action + ":" + day.Format("2006-01-02")
+}
+
+// endOfDay returns midnight UTC following t
+func endOfDay(t time.Time) time.Time {
+	y, m, d := t.UTC().Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC)
+}
@@ -0,0 +1,258 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func allow(t *testing.T, l *Limiter, client, action string) Decision {
+	t.Helper()
+
+	d, err := l.Allow(context.Background(), client, action)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return d
+}
+
+func TestBurst(t *testing.T) {
+	l := New(NewMemoryStore(), Rule{Rate: 1, Burst: 3}, nil)
+
+	for i := 0; i < 3; i++ {
+		if d := allow(t, l, "a", "mail"); !d.Allowed {
+			t.Fatalf("call %d of the burst refused: %s", i+1, d.Reason)
+		}
+	}
+
+	d := allow(t, l, "a", "mail")
+	if d.Allowed {
+		t.Fatal("call past the burst allowed")
+	}
+	if d.Reason != "rate limit for mail exceeded" {
+		t.Errorf("reason = %q", d.Reason)
+	}
+	// one token a second, and the bucket was only just emptied
+	if d.RetryAfter <= 900*time.Millisecond || d.RetryAfter > time.Second {
+		t.Errorf("RetryAfter = %s, want just under a second", d.RetryAfter)
+	}
+}
+
+func TestZeroBurstAllowsOne(t *testing.T) {
+	l := New(NewMemoryStore(), Rule{Rate: 0.001}, nil)
+
+	if d := allow(t, l, "a", "mail"); !d.Allowed {
+		t.Fatal("first call refused by a rule without a burst")
+	}
+	if d := allow(t, l, "a", "mail"); d.Allowed {
+		t.Fatal("second call allowed")
+	}
+}
+
+func TestRefill(t *testing.T) {
+	l := New(NewMemoryStore(), Rule{Rate: 100, Burst: 1}, nil)
+
+	allow(t, l, "a", "mail")
+	if d := allow(t, l, "a", "mail"); d.Allowed {
+		t.Fatal("second call allowed before a refill")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if d := allow(t, l, "a", "mail"); !d.Allowed {
+		t.Errorf("call after the refill refused, retry after %s", d.RetryAfter)
+	}
+}
+
+func TestBucketsPerClientAndAction(t *testing.T) {
+	// mail falls back to the default rule, log has a rule with no limits at all
+	l := New(NewMemoryStore(), Rule{Rate: 0.001, Burst: 1}, map[string]Rule{"log": {}})
+
+	allow(t, l, "a", "mail")
+
+	steps := []struct {
+		client, action string
+		want           bool
+	}{
+		{"a", "mail", false},
+		{"b", "mail", true},
+		{"a", "auth", true},
+		{"a", "log", true},
+		{"a", "log", true},
+	}
+	for _, s := range steps {
+		if d := allow(t, l, s.client, s.action); d.Allowed != s.want {
+			t.Errorf("%s running %s: allowed = %v, want %v", s.client, s.action, d.Allowed, s.want)
+		}
+	}
+}
+
+func TestDailyQuota(t *testing.T) {
+	l := New(NewMemoryStore(), Rule{}, map[string]Rule{"mail": {DailyQuota: 2}})
+
+	allow(t, l, "a", "mail")
+	allow(t, l, "a", "mail")
+
+	d := allow(t, l, "a", "mail")
+	if d.Allowed {
+		t.Fatal("call past the quota allowed")
+	}
+	if d.Reason != "daily quota of 2 for mail used up" {
+		t.Errorf("reason = %q", d.Reason)
+	}
+
+	reset := endOfDay(time.Now())
+	if wait := time.Until(reset); (d.RetryAfter - wait).Abs() > time.Second {
+		t.Errorf("RetryAfter = %s, want about %s until midnight UTC", d.RetryAfter, wait)
+	}
+
+	if d := allow(t, l, "b", "mail"); !d.Allowed {
+		t.Error("another client's quota was used up too")
+	}
+}
+
+func TestRefusalsDontCountAgainstTheOtherLimit(t *testing.T) {
+	store := NewMemoryStore()
+	l := New(store, Rule{}, map[string]Rule{"mail": {Rate: 0.001, Burst: 2, DailyQuota: 1}})
+
+	allow(t, l, "a", "mail")
+
+	// the quota refuses this one, which must leave the second token in the bucket
+	if d := allow(t, l, "a", "mail"); d.Allowed || d.Reason != "daily quota of 1 for mail used up" {
+		t.Fatalf("second call = %+v, want a quota refusal", d)
+	}
+	if ok, _, _ := store.Take(context.Background(), bucketKey("a", "mail"), 0.001, 2); !ok {
+		t.Error("the quota refusal took a token from the bucket")
+	}
+
+	// the bucket is now empty, so the rate limit refuses this one before the quota
+	// can, and gives its quota back
+	l = New(store, Rule{}, map[string]Rule{"mail": {Rate: 0.001, Burst: 2, DailyQuota: 5}})
+	if d := allow(t, l, "a", "mail"); d.Allowed || d.Reason != "rate limit for mail exceeded" {
+		t.Fatalf("third call = %+v, want a rate limit refusal", d)
+	}
+	if n, _ := store.Count(context.Background(), quotaKey("a", "mail", time.Now().UTC())); n != 1 {
+		t.Errorf("quota used = %d after a rate limit refusal, want 1", n)
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	l := New(NewMemoryStore(), Rule{}, map[string]Rule{"mail": {DailyQuota: 5}})
+
+	for i := 0; i < 7; i++ {
+		allow(t, l, "a", "mail")
+	}
+
+	quotas, err := l.Quotas(context.Background(), "a", []string{"auth", "mail"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(quotas) != 1 {
+		t.Fatalf("got %d quotas, want only the one for mail", len(quotas))
+	}
+
+	// the two refused calls don't count against the quota
+	want := QuotaStatus{Action: "mail", Limit: 5, Used: 5, Remaining: 0, ResetsAt: endOfDay(time.Now())}
+	if quotas[0] != want {
+		t.Errorf("quota = %+v, want %+v", quotas[0], want)
+	}
+}
+
+func TestEndOfDay(t *testing.T) {
+	tests := []struct {
+		in, want time.Time
+	}{
+		{time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 11, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2024, 2, 29, 23, 59, 59, 0, time.UTC), time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2024, 12, 31, 12, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		// 23:30 in New York is already the next day in UTC
+		{time.Date(2024, 6, 1, 23, 30, 0, 0, time.FixedZone("EDT", -4*3600)), time.Date(2024, 6, 3, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		if got := endOfDay(tt.in); !got.Equal(tt.want) {
+			t.Errorf("endOfDay(%s) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+// failingStore is a Store whose every call fails
+type failingStore struct{}
+
+var errStore = errors.New("store unavailable")
+
+func (failingStore) Take(context.Context, string, float64, int) (bool, time.Duration, error) {
+	return false, 0, errStore
+}
+
+func (failingStore) Add(context.Context, string, int64, time.Time) (int64, error) {
+	return 0, errStore
+}
+
+func (failingStore) Count(context.Context, string) (int64, error) {
+	return 0, errStore
+}
+
+func TestStoreErrors(t *testing.T) {
+	rules := map[string]Rule{
+		"rate":  {Rate: 1},
+		"quota": {DailyQuota: 1},
+		"free":  {},
+	}
+	l := New(failingStore{}, Rule{}, rules)
+
+	for _, action := range []string{"rate", "quota"} {
+		if _, err := l.Allow(context.Background(), "a", action); !errors.Is(err, errStore) {
+			t.Errorf("Allow(%s): err = %v, want %v", action, err, errStore)
+		}
+	}
+
+	// an action without limits never touches the store
+	if _, err := l.Allow(context.Background(), "a", "free"); err != nil {
+		t.Errorf("Allow(free): %v", err)
+	}
+}
+
+func TestMemoryStorePrune(t *testing.T) {
+	s := NewMemoryStore()
+	ctx := context.Background()
+
+	s.Take(ctx, "idle", 10, 1)
+	s.Take(ctx, "busy", 0.001, 1)
+	s.Add(ctx, "expired", 1, time.Now().Add(-time.Second))
+	s.Add(ctx, "live", 1, time.Now().Add(time.Hour))
+
+	// pretend the last prune was long ago and the idle bucket has had time to refill
+	s.lastPrune = time.Time{}
+	s.buckets["idle"].last = time.Now().Add(-time.Second)
+	s.prune(time.Now())
+
+	if _, ok := s.buckets["idle"]; ok {
+		t.Error("full bucket kept")
+	}
+	if _, ok := s.buckets["busy"]; !ok {
+		t.Error("bucket that is still refilling was dropped")
+	}
+	if _, ok := s.counters["expired"]; ok {
+		t.Error("expired counter kept")
+	}
+	if n, _ := s.Count(ctx, "live"); n != 1 {
+		t.Errorf("live counter = %d, want 1", n)
+	}
+}
+
+func TestMemoryStoreCounterExpiry(t *testing.T) {
+	s := NewMemoryStore()
+	ctx := context.Background()
+
+	s.Add(ctx, "c", 5, time.Now().Add(-time.Second))
+	if n, _ := s.Count(ctx, "c"); n != 0 {
+		t.Errorf("Count of an expired counter = %d, want 0", n)
+	}
+
+	// adding to an expired counter starts it again from zero
+	if n, _ := s.Add(ctx, "c", 1, time.Now().Add(time.Hour)); n != 1 {
+		t.Errorf("Add to an expired counter = %d, want 1", n)
+	}
+}
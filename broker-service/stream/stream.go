@@ -0,0 +1,181 @@
+// Package stream fans messages out to clients watching the broker live.
+//
+// Every message has a topic made of dot-separated words, such as "log.ERROR" or
+// "action.mail". Subscribers pick what they want with RabbitMQ-style patterns: "*"
+// matches exactly one word and "#" matches zero or more, so "log.*" is every log
+// severity and "#" is everything.
+package stream
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultBuffer is how many messages a subscriber may fall behind before messages are
+// dropped for it
+const DefaultBuffer = 64
+
+// Message is one item pushed to subscribers
+type Message struct {
+	Topic string    `json:"topic"`
+	Kind  string    `json:"kind"`
+	Time  time.Time `json:"time"`
+	Data  any       `json:"data"`
+}
+
+// Hub delivers published messages to every subscriber whose patterns match.
+// A slow subscriber never holds up the others: once its buffer is full, messages for
+// it are dropped and counted.
+type Hub struct {
+	buffer int
+
+	mu     sync.RWMutex
+	subs   map[*Subscription]struct{}
+	closed bool
+}
+
+// NewHub returns a hub that buffers up to buffer messages per subscriber
+func NewHub(buffer int) *Hub {
+	if buffer <= 0 {
+		buffer = DefaultBuffer
+	}
+
+	return &Hub{
+		buffer: buffer,
+		subs:   make(map[*Subscription]struct{}),
+	}
+}
+
+// Subscription receives the messages matching its patterns on C until it is closed,
+// or the hub is. C is closed when the subscription ends.
+type Subscription struct {
+	C <-chan Message
+
+	hub      *Hub
+	patterns []string
+	ch       chan Message
+	dropped  atomic.Int64
+	once     sync.Once
+}
+
+// Subscribe starts a subscription to topics matching any of patterns; no patterns
+// means everything. It returns nil once the hub has been closed.
+func (h *Hub) Subscribe(patterns []string) *Subscription {
+	if len(patterns) == 0 {
+		patterns = []string{"#"}
+	}
+
+	ch := make(chan Message, h.buffer)
+	s := &Subscription{C: ch, hub: h, patterns: patterns, ch: ch}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return nil
+	}
+	h.subs[s] = struct{}{}
+
+	return s
+}
+
+// Publish hands m to every matching subscriber without blocking
+func (h *Hub) Publish(m Message) {
+	if m.Time.IsZero() {
+		m.Time = time.Now().UTC()
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for s := range h.subs {
+		if !s.matches(m.Topic) {
+			continue
+		}
+
+		select {
+		case s.ch <- m:
+		default:
+			s.dropped.Add(1)
+		}
+	}
+}
+
+// Subscribers returns the number of open subscriptions
+func (h *Hub) Subscribers() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return len(h.subs)
+}
+
+// Close ends every subscription and refuses new ones
+func (h *Hub) Close() {
+	h.mu.Lock()
+	subs := h.subs
+	h.subs = make(map[*Subscription]struct{})
+	h.closed = true
+	h.mu.Unlock()
+
+	for s := range subs {
+		s.once.Do(func() { close(s.ch) })
+	}
+}
+
+// Close ends the subscription
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	delete(s.hub.subs, s)
+	s.hub.mu.Unlock()
+
+	s.once.Do(func() { close(s.ch) })
+}
+
+// Dropped returns how many messages were dropped because the subscriber fell behind,
+// and resets the count
+func (s *Subscription) Dropped() int64 {
+	return s.dropped.Swap(0)
+}
+
+func (s *Subscription) matches(topic string) bool {
+	for _, p := range s.patterns {
+		if Match(p, topic) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Match reports whether topic matches pattern, using RabbitMQ topic exchange rules
+func Match(pattern, topic string) bool {
+	return match(strings.Split(pattern, "."), strings.Split(topic, "."))
+}
+
+func match(pattern, words []string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case "#":
+			// # may swallow any number of words, including none
+			for i := 0; i <= len(words); i++ {
+				if match(pattern[1:], words[i:]) {
+					return true
+				}
+			}
+			return false
+		case "*":
+			if len(words) == 0 {
+				return false
+			}
+		default:
+			if len(words) == 0 || words[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, words = pattern[1:], words[1:]
+	}
+
+	return len(words) == 0
+}
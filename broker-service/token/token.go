@@ -0,0 +1,352 @@
+// Package token issues and verifies the JWTs the broker hands out after a successful login.
+//
+// A login yields a short-lived access token, sent as "Authorization: Bearer ..." on
+// protected actions, and a longer-lived refresh token that can be exchanged once for a
+// new pair. Tokens are signed with HS256, RS256 or EdDSA; for the asymmetric methods the
+// public key is published as a JWKS so that other services can verify tokens themselves.
+//
+// Tokens carry the session version of their user at the time they were issued. When a
+// Sessions store is configured, Verify and Refresh refuse tokens from an older version,
+// so revoking a user's sessions is a matter of moving them to a new version. The store
+// also records which refresh tokens have been exchanged, so that each is used once
+// across every broker; without one refresh tokens can't be exchanged.
+package token
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Token types, carried in the "typ" claim.
+const (
+	TypeAccess  = "access"
+	TypeRefresh = "refresh"
+)
+
+// Errors returned by Verify and Refresh.
+var (
+	ErrInvalid     = errors.New("invalid token")
+	ErrWrongType   = errors.New("wrong token type")
+	ErrRefreshUsed = errors.New("refresh token has already been used")
+	ErrRevoked     = errors.New("token has been revoked")
+	// ErrUnavailable means the token could not be checked against the user's sessions
+	ErrUnavailable = errors.New("sessions can't be checked right now")
+)
+
+// Sessions tells the current session version of a subject. Implementations return
+// ErrRevoked for a subject whose sessions are all gone, such as a deactivated user.
+//
+// UseRefresh records that the refresh token with ID id, issued to subject and valid
+// until expires, has been exchanged. It returns ErrRefreshUsed if it already was, and
+// ErrRevoked for a subject that is gone.
+type Sessions interface {
+	Version(ctx context.Context, subject string) (int, error)
+	UseRefresh(ctx context.Context, subject, id string, expires time.Time) error
+}
+
+// Config describes how tokens are signed.
+type Config struct {
+	// Method is HS256, RS256 or EdDSA
+	Method string
+	// Secret is the HMAC key for HS256
+	Secret []byte
+	// PrivateKey is an *rsa.PrivateKey for RS256 or an ed25519.PrivateKey for EdDSA
+	PrivateKey crypto.PrivateKey
+	// KeyID is published in the JWKS and the token header. It defaults to a thumbprint of the public key.
+	KeyID      string
+	Issuer     string
+	AccessTTL  time.Duration
+	RefreshTTL time.Duration
+	// Sessions, if set, is asked for the current session version whenever a token is
+	// verified, and keeps track of the refresh tokens that have been exchanged
+	Sessions Sessions
+}
+
+// Claims are the claims the broker puts in its tokens.
+type Claims struct {
+	jwt.RegisteredClaims
+	Email string `json:"email,omitempty"`
+	Type  string `json:"typ"`
+	// Version is the subject's session version when the token was issued
+	Version int `json:"ver,omitempty"`
+}
+
+// Pair is what a successful login or refresh returns.
+type Pair struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+// Manager issues and verifies tokens.
+type Manager struct {
+	method     jwt.SigningMethod
+	signKey    any
+	verifyKey  any
+	keyID      string
+	issuer     string
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+	sessions   Sessions
+}
+
+// NewManager checks cfg and returns a manager for it
+func NewManager(cfg Config) (*Manager, error) {
+	m := &Manager{
+		issuer:     cfg.Issuer,
+		accessTTL:  cfg.AccessTTL,
+		refreshTTL: cfg.RefreshTTL,
+		keyID:      cfg.KeyID,
+		sessions:   cfg.Sessions,
+	}
+
+	if m.accessTTL <= 0 {
+		m.accessTTL = 15 * time.Minute
+	}
+	if m.refreshTTL <= 0 {
+		m.refreshTTL = 24 * time.Hour
+	}
+
+	switch cfg.Method {
+	case "", "HS256":
+		if len(cfg.Secret) < 32 {
+			return nil, errors.New("HS256 needs a secret of at least 32 bytes")
+		}
+		m.method = jwt.SigningMethodHS256
+		m.signKey = cfg.Secret
+		m.verifyKey = cfg.Secret
+	case "RS256":
+		key, ok := cfg.PrivateKey.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("RS256 needs an RSA private key")
+		}
+		m.method = jwt.SigningMethodRS256
+		m.signKey = key
+		m.verifyKey = &key.PublicKey
+	case "EdDSA":
+		key, ok := cfg.PrivateKey.(ed25519.PrivateKey)
+		if !ok {
+			return nil, errors.New("EdDSA needs an Ed25519 private key")
+		}
+		m.method = jwt.SigningMethodEdDSA
+		m.signKey = key
+		m.verifyKey = key.Public()
+	default:
+		return nil, fmt.Errorf("unsupported signing method %q", cfg.Method)
+	}
+
+	if m.keyID == "" {
+		m.keyID = keyID(m.verifyKey)
+	}
+
+	return m, nil
+}
+
+// Issue returns a new access and refresh token for subject, whose sessions are at version
+func (m *Manager) Issue(subject, email string, version int) (Pair, error) {
+	access, err := m.sign(subject, email, version, TypeAccess, m.accessTTL)
+	if err != nil {
+		return Pair{}, err
+	}
+
+	refresh, err := m.sign(subject, email, version, TypeRefresh, m.refreshTTL)
+	if err != nil {
+		return Pair{}, err
+	}
+
+	return Pair{
+		AccessToken:  access,
+		RefreshToken: refresh,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(m.accessTTL.Seconds()),
+	}, nil
+}
+
+func (m *Manager) sign(subject, email string, version int, typ string, ttl time.Duration) (string, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	claims := Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        hex.EncodeToString(id),
+			Issuer:    m.issuer,
+			Subject:   subject,
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+		},
+		Email:   email,
+		Type:    typ,
+		Version: version,
+	}
+
+	t := jwt.NewWithClaims(m.method, claims)
+	t.Header["kid"] = m.keyID
+
+	return t.SignedString(m.signKey)
+}
+
+// Verify checks the signature, issuer and expiry of raw, that it is of type typ and that
+// its subject's sessions haven't been revoked since it was issued
+func (m *Manager) Verify(ctx context.Context, raw, typ string) (*Claims, error) {
+	var claims Claims
+
+	_, err := jwt.ParseWithClaims(raw, &claims, func(t *jwt.Token) (any, error) {
+		return m.verifyKey, nil
+	},
+		jwt.WithValidMethods([]string{m.method.Alg()}),
+		jwt.WithIssuer(m.issuer),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalid, err)
+	}
+
+	if claims.Type != typ {
+		return nil, fmt.Errorf("%w: expected %s token", ErrWrongType, typ)
+	}
+
+	if m.sessions != nil {
+		current, err := m.sessions.Version(ctx, claims.Subject)
+		if errors.Is(err, ErrRevoked) {
+			return nil, ErrRevoked
+		} else if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrUnavailable, err)
+		}
+		if claims.Version < current {
+			return nil, ErrRevoked
+		}
+	}
+
+	return &claims, nil
+}
+
+// Refresh exchanges a refresh token for a new pair. Each refresh token can be used once,
+// which the Sessions store keeps track of.
+func (m *Manager) Refresh(ctx context.Context, raw string) (Pair, error) {
+	if m.sessions == nil {
+		return Pair{}, fmt.Errorf("%w: no sessions store configured", ErrUnavailable)
+	}
+
+	claims, err := m.Verify(ctx, raw, TypeRefresh)
+	if err != nil {
+		return Pair{}, err
+	}
+
+	err = m.sessions.UseRefresh(ctx, claims.Subject, claims.ID, claims.ExpiresAt.Time)
+	if errors.Is(err, ErrRefreshUsed) || errors.Is(err, ErrRevoked) {
+		return Pair{}, err
+	} else if err != nil {
+		return Pair{}, fmt.Errorf("%w: %s", ErrUnavailable, err)
+	}
+
+	return m.Issue(claims.Subject, claims.Email, claims.Version)
+}
+
+// JWK is one key of a JSON Web Key Set.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Ed25519
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+}
+
+// JWKS is a JSON Web Key Set.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public verification key. It is empty for HS256, whose key is secret.
+func (m *Manager) JWKS() JWKS {
+	set := JWKS{Keys: []JWK{}}
+
+	switch key := m.verifyKey.(type) {
+	case *rsa.PublicKey:
+		set.Keys = append(set.Keys, JWK{
+			KeyType:   "RSA",
+			Use:       "sig",
+			Algorithm: m.method.Alg(),
+			KeyID:     m.keyID,
+			N:         base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:         base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		})
+	case ed25519.PublicKey:
+		set.Keys = append(set.Keys, JWK{
+			KeyType:   "OKP",
+			Use:       "sig",
+			Algorithm: m.method.Alg(),
+			KeyID:     m.keyID,
+			Curve:     "Ed25519",
+			X:         base64.RawURLEncoding.EncodeToString(key),
+		})
+	}
+
+	return set
+}
+
+// keyID derives a stable key ID from a public key. HMAC secrets get a fixed ID, since
+// nothing derived from them should be published.
+func keyID(key any) string {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "hs256"
+	}
+
+	sum := sha256.Sum256(der)
+	return base64.RawURLEncoding.EncodeToString(sum[:8])
+}
+
+// LoadPrivateKey reads a PEM encoded RSA or Ed25519 private key for method
+func LoadPrivateKey(method string, pemData []byte) (crypto.PrivateKey, error) {
+	switch method {
+	case "RS256":
+		return jwt.ParseRSAPrivateKeyFromPEM(pemData)
+	case "EdDSA":
+		return jwt.ParseEdPrivateKeyFromPEM(pemData)
+	default:
+		return nil, fmt.Errorf("%s does not use a private key", method)
+	}
+}
+
+// GenerateKey creates a throwaway signing key for method. Tokens signed with it stop
+// verifying when the process restarts, so it is only meant for development.
+func GenerateKey(method string) (secret []byte, key crypto.PrivateKey, err error) {
+	switch method {
+	case "", "HS256":
+		secret = make([]byte, 32)
+		_, err = rand.Read(secret)
+		return secret, nil, err
+	case "RS256":
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+		return nil, key, err
+	case "EdDSA":
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+		return nil, key, err
+	default:
+		return nil, nil, fmt.Errorf("unsupported signing method %q", method)
+	}
+}
@@ -0,0 +1,252 @@
+package token
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSessions keeps session versions and used refresh tokens in memory
+type fakeSessions struct {
+	mu       sync.Mutex
+	versions map[string]int
+	used     map[string]bool
+	err      error
+}
+
+func (s *fakeSessions) Version(ctx context.Context, subject string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return 0, s.err
+	}
+	v, ok := s.versions[subject]
+	if !ok {
+		return 0, ErrRevoked
+	}
+
+	return v, nil
+}
+
+func (s *fakeSessions) UseRefresh(ctx context.Context, subject, id string, expires time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return s.err
+	}
+	if s.used[id] {
+		return ErrRefreshUsed
+	}
+	if s.used == nil {
+		s.used = make(map[string]bool)
+	}
+	s.used[id] = true
+
+	return nil
+}
+
+func (s *fakeSessions) revoke(subject string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.versions[subject]++
+}
+
+func newTestManager(t *testing.T, sessions Sessions) *Manager {
+	t.Helper()
+
+	m, err := NewManager(Config{
+		Secret:     []byte("0123456789abcdef0123456789abcdef"),
+		Issuer:     "test",
+		AccessTTL:  time.Minute,
+		RefreshTTL: time.Hour,
+		Sessions:   sessions,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return m
+}
+
+func TestVerify(t *testing.T) {
+	sessions := &fakeSessions{versions: map[string]int{"1": 1}}
+	m := newTestManager(t, sessions)
+	other, err := NewManager(Config{Secret: []byte("another secret, at least 32 bytes long"), Issuer: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pair, err := m.Issue("1", "a@example.com", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	foreign, err := other.Issue("1", "a@example.com", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale, err := m.Issue("1", "a@example.com", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknown, err := m.Issue("2", "b@example.com", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		raw  string
+		typ  string
+		want error
+	}{
+		{name: "access token", raw: pair.AccessToken, typ: TypeAccess},
+		{name: "refresh token", raw: pair.RefreshToken, typ: TypeRefresh},
+		{name: "refresh token as access token", raw: pair.RefreshToken, typ: TypeAccess, want: ErrWrongType},
+		{name: "garbage", raw: "not.a.token", typ: TypeAccess, want: ErrInvalid},
+		{name: "signed with another key", raw: foreign.AccessToken, typ: TypeAccess, want: ErrInvalid},
+		{name: "older session version", raw: stale.AccessToken, typ: TypeAccess, want: ErrRevoked},
+		{name: "user without sessions", raw: unknown.AccessToken, typ: TypeAccess, want: ErrRevoked},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := m.Verify(context.Background(), tt.raw, tt.typ)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("Verify err = %v, want %v", err, tt.want)
+			}
+			if err == nil && (claims.Subject != "1" || claims.Email != "a@example.com" || claims.Type != tt.typ) {
+				t.Errorf("claims = %+v", claims)
+			}
+		})
+	}
+}
+
+func TestVerifySessionsUnavailable(t *testing.T) {
+	sessions := &fakeSessions{versions: map[string]int{"1": 1}}
+	m := newTestManager(t, sessions)
+
+	pair, err := m.Issue("1", "a@example.com", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessions.err = errors.New("auth service down")
+	_, err = m.Verify(context.Background(), pair.AccessToken, TypeAccess)
+	if !errors.Is(err, ErrUnavailable) {
+		t.Errorf("Verify err = %v, want %v", err, ErrUnavailable)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	m := newTestManager(t, &fakeSessions{versions: map[string]int{"1": 1}})
+
+	pair, err := m.Issue("1", "a@example.com", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next, err := m.Refresh(context.Background(), pair.RefreshToken)
+	if err != nil {
+		t.Fatalf("first refresh: %v", err)
+	}
+	if _, err := m.Verify(context.Background(), next.AccessToken, TypeAccess); err != nil {
+		t.Errorf("refreshed access token: %v", err)
+	}
+
+	_, err = m.Refresh(context.Background(), pair.RefreshToken)
+	if !errors.Is(err, ErrRefreshUsed) {
+		t.Errorf("reused refresh token: err = %v, want %v", err, ErrRefreshUsed)
+	}
+
+	_, err = m.Refresh(context.Background(), pair.AccessToken)
+	if !errors.Is(err, ErrWrongType) {
+		t.Errorf("access token as refresh token: err = %v, want %v", err, ErrWrongType)
+	}
+}
+
+func TestRefreshSharedSessions(t *testing.T) {
+	// two brokers that share a sessions store, as they do through the auth service
+	sessions := &fakeSessions{versions: map[string]int{"1": 1}}
+	a, b := newTestManager(t, sessions), newTestManager(t, sessions)
+
+	pair, err := a.Issue("1", "a@example.com", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = a.Refresh(context.Background(), pair.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.Refresh(context.Background(), pair.RefreshToken)
+	if !errors.Is(err, ErrRefreshUsed) {
+		t.Errorf("refresh on another broker: err = %v, want %v", err, ErrRefreshUsed)
+	}
+}
+
+func TestRefreshWithoutSessions(t *testing.T) {
+	m := newTestManager(t, nil)
+
+	pair, err := m.Issue("1", "a@example.com", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = m.Refresh(context.Background(), pair.RefreshToken)
+	if !errors.Is(err, ErrUnavailable) {
+		t.Errorf("Refresh err = %v, want %v", err, ErrUnavailable)
+	}
+}
+
+func TestRevokedSessions(t *testing.T) {
+	sessions := &fakeSessions{versions: map[string]int{"1": 1, "2": 1}}
+	m := newTestManager(t, sessions)
+
+	before, err := m.Issue("1", "a@example.com", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bystander, err := m.Issue("2", "b@example.com", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessions.revoke("1")
+
+	// a login straight after the revocation, within the same second, must work
+	after, err := m.Issue("1", "a@example.com", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		raw  string
+		typ  string
+		want error
+	}{
+		{name: "access token issued before", raw: before.AccessToken, typ: TypeAccess, want: ErrRevoked},
+		{name: "refresh token issued before", raw: before.RefreshToken, typ: TypeRefresh, want: ErrRevoked},
+		{name: "access token issued after", raw: after.AccessToken, typ: TypeAccess},
+		{name: "another user's token", raw: bystander.AccessToken, typ: TypeAccess},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := m.Verify(context.Background(), tt.raw, tt.typ)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Verify err = %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	_, err = m.Refresh(context.Background(), before.RefreshToken)
+	if !errors.Is(err, ErrRevoked) {
+		t.Errorf("Refresh with a revoked token: err = %v, want %v", err, ErrRevoked)
+	}
+}
@@ -2,12 +2,15 @@ package event
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"shared/cloudevent"
 
 	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
 
 // Consumer represents a RabbitMQ consumer
@@ -87,10 +90,22 @@ func (consumer *Consumer) Listen(topics []string) error {
 	go func() {
 		for d := range messages {
 			var payload Payload
-			_ = json.Unmarshal(d.Body, &payload)
-
-			// Process each message in a separate goroutine
-			go handlePayload(payload)
+			event, err := cloudevent.Parse(d.Body, d.ContentType)
+			if err == nil {
+				err = event.Decode(&payload)
+			}
+			if err != nil {
+				log.Println("skipping message:", err)
+				continue
+			}
+
+			// Process each message in a separate goroutine, continuing the publisher's trace
+			go func(d amqp.Delivery) {
+				ctx, span := startConsumeSpan(d, q.Name)
+				defer span.End()
+
+				handlePayload(ctx, payload)
+			}(d)
 		}
 	}()
 
@@ -101,11 +116,11 @@ func (consumer *Consumer) Listen(topics []string) error {
 }
 
 // handlePayload processes different types of payloads
-func handlePayload(payload Payload) {
+func handlePayload(ctx context.Context, payload Payload) {
 	switch payload.Name {
 	case "log", "event":
 		// Log the payload
-		err := logEvent(payload)
+		err := logEvent(ctx, payload)
 		if err != nil {
 			log.Println(err)
 		}
@@ -115,7 +130,7 @@ func handlePayload(payload Payload) {
 
 	default:
 		// Log any unknown payload types
-		err := logEvent(payload)
+		err := logEvent(ctx, payload)
 		if err != nil {
 			log.Println(err)
 		}
@@ -123,20 +138,20 @@ func handlePayload(payload Payload) {
 }
 
 // logEvent sends the payload to a logging service
-func logEvent(entry Payload) error {
+func logEvent(ctx context.Context, entry Payload) error {
 	jsonData, _ := json.MarshalIndent(entry, "", "\t")
 
 	logServiceURL := "http://logger-service:8080/log"
 
 	// Create a new HTTP request
-	request, err := http.NewRequest("POST", logServiceURL, bytes.NewBuffer(jsonData))
+	request, err := http.NewRequestWithContext(ctx, "POST", logServiceURL, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return err
 	}
 
 	request.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
+	client := &http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)}
 
 	// Send the request
 	response, err := client.Do(request)
@@ -1,17 +1,31 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"listener/event"
 	"log"
 	"math"
 	"os"
+	"shared/tracing"
 	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
 func main() {
+	// send traces to the collector, or to stdout/a file when there isn't one
+	shutdownTracing, err := tracing.Setup(context.Background(), "listener-service")
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = shutdownTracing(ctx)
+	}()
+
 	// try to connect to rabbitmq
 	rabbitConn, err := connect()
 	if err != nil {
@@ -20,7 +20,7 @@ func (l *LogServer) WriteLog(ctx context.Context, req *logs.LogRequest) (*logs.L
 		Data: input.Data,
 	}
 
-	err := l.Models.LogEntry.Insert(logEntry)
+	err := l.Models.LogEntry.Insert(ctx, logEntry)
 	if err != nil {
 		res := &logs.LogResponse{Result: "failed"}
 		return res, err
@@ -1,8 +1,23 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
 	"log-service/data"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultLogLimit is how many entries ReadLogs returns when no limit is asked for
+	defaultLogLimit = 20
+	// maxLogLimit is the most entries ReadLogs returns at once
+	maxLogLimit = 100
 )
 
 type JSONPayload struct {
@@ -21,7 +36,7 @@ func (app *App) WriteLog(w http.ResponseWriter, r *http.Request) {
 		Data: requestPayload.Data,
 	}
 
-	err := app.Models.LogEntry.Insert(event)
+	err := app.Models.LogEntry.Insert(r.Context(), event)
 	if err != nil {
 		app.errorJSON(w, err)
 		return
@@ -34,3 +49,71 @@ func (app *App) WriteLog(w http.ResponseWriter, r *http.Request) {
 
 	app.writeJSON(w, http.StatusAccepted, resp)
 }
+
+// ReadLogs returns the latest log entries, newest first. ?name= keeps the entries
+// logged under one name and ?limit= says how many to return (20 by default, at most
+// 100).
+func (app *App) ReadLogs(w http.ResponseWriter, r *http.Request) {
+	limit := defaultLogLimit
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			app.errorJSON(w, errors.New("limit must be a positive number"))
+			return
+		}
+		limit = min(n, maxLogLimit)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 15*time.Second)
+	defer cancel()
+
+	entries, err := app.Models.LogEntry.Recent(ctx, r.URL.Query().Get("name"), int64(limit))
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := jsonResponse{
+		Error:   false,
+		Message: "log entries",
+		Data:    entries,
+	}
+
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// requireServiceToken only lets through callers presenting SERVICE_TOKEN, the credential
+// the services share, as a bearer token. Without SERVICE_TOKEN the routes it guards
+// are off.
+func (app *App) requireServiceToken(next http.Handler) http.Handler {
+	return app.requireBearer("service", "SERVICE_TOKEN", next)
+}
+
+// requireMetrics is middleware for /metrics: Prometheus scrapes with METRICS_TOKEN as a
+// bearer token, as it does on the broker. Without METRICS_TOKEN /metrics is off.
+func (app *App) requireMetrics(next http.Handler) http.Handler {
+	return app.requireBearer("metrics", "METRICS_TOKEN", next)
+}
+
+// requireBearer only lets through requests whose bearer token is the value of the
+// environment variable env. While env is unset the routes it guards are off. realm
+// names the token in errors and in WWW-Authenticate.
+func (app *App) requireBearer(realm, env string, next http.Handler) http.Handler {
+	token := os.Getenv(env)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			app.errorJSON(w, fmt.Errorf("%s endpoints are disabled; set %s", realm, env), http.StatusForbidden)
+			return
+		}
+
+		raw, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(strings.TrimSpace(raw)), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf("Bearer realm=%q", realm))
+			app.errorJSON(w, fmt.Errorf("%s token required", realm), http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
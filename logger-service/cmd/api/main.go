@@ -9,10 +9,15 @@ import (
 	"net"
 	"net/http"
 	"net/rpc"
+	"shared/metrics"
+	"shared/tracing"
 	"time"
 
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/contrib/instrumentation/go.mongodb.org/mongo-driver/mongo/otelmongo"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"google.golang.org/grpc"
 )
 
@@ -26,10 +31,22 @@ const (
 var client *mongo.Client
 
 type App struct {
-	Models data.Models
+	Models  data.Models
+	Metrics *metrics.Metrics
 }
 
 func main() {
+	// send traces to the collector, or to stdout/a file when there isn't one
+	shutdownTracing, err := tracing.Setup(context.Background(), "logger-service")
+	if err != nil {
+		log.Panic(err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = shutdownTracing(ctx)
+	}()
+
 	// connect to mongo
 	mongoClient, err := connectToMongo()
 	if err != nil {
@@ -49,7 +66,8 @@ func main() {
 	}()
 
 	app := App{
-		Models: data.New(client),
+		Models:  data.New(client),
+		Metrics: metrics.New("logger"),
 	}
 
 	// Register the RPC Server
@@ -62,7 +80,7 @@ func main() {
 
 	srv := &http.Server{
 		Addr:    fmt.Sprintf(":%s", webPort),
-		Handler: app.routes(),
+		Handler: otelhttp.NewHandler(app.routes(), "logger-service"),
 	}
 
 	err = srv.ListenAndServe()
@@ -92,7 +110,7 @@ func (app *App) rpcListen() error {
 
 func connectToMongo() (*mongo.Client, error) {
 	// create connection options
-	clientOptions := options.Client().ApplyURI(mongoURL)
+	clientOptions := options.Client().ApplyURI(mongoURL).SetMonitor(otelmongo.NewMonitor())
 	clientOptions.SetAuth(options.Credential{
 		Username: "admin",
 		Password: "password",
@@ -114,7 +132,7 @@ func (app *App) gRPCListen() {
 		log.Fatalf("Failed to listen for gRPC: %v", err)
 	}
 
-	s := grpc.NewServer()
+	s := grpc.NewServer(grpc.StatsHandler(otelgrpc.NewServerHandler()))
 
 	logs.RegisterLogServiceServer(s, &LogServer{Models: app.Models})
 
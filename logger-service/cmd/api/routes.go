@@ -22,8 +22,15 @@ func (app *App) routes() http.Handler {
 	}))
 
 	mux.Use(middleware.Heartbeat("/ping"))
+	mux.Use(app.Metrics.Middleware)
+
+	// prometheus metrics, behind METRICS_TOKEN
+	mux.With(app.requireMetrics).Handle("/metrics", app.Metrics.Handler())
 
 	mux.Post("/log", app.WriteLog)
 
+	// recent entries, for the broker's logs action
+	mux.With(app.requireServiceToken).Get("/logs", app.ReadLogs)
+
 	return mux
 }
@@ -5,6 +5,12 @@ import (
 	"log"
 	"log-service/data"
 	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // RPCServer is the type for our RPC Server. Methods that take this as a receiver are available
@@ -15,17 +21,31 @@ type RPCServer struct{}
 type RPCPayload struct {
 	Name string
 	Data string
+	// TraceContext carries the caller's trace, since net/rpc has no headers to put it in
+	TraceContext map[string]string
 }
 
 // LogInfo writes our payload to mongo
 func (r *RPCServer) LogInfo(payload RPCPayload, resp *string) error {
+	ctx := otel.GetTextMapPropagator().Extract(context.Background(), propagation.MapCarrier(payload.TraceContext))
+	ctx, span := otel.Tracer("log-service").Start(ctx, "RPCServer.LogInfo",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.RPCSystemKey.String("net/rpc"),
+			semconv.RPCService("RPCServer"),
+			semconv.RPCMethod("LogInfo"),
+		),
+	)
+	defer span.End()
+
 	collection := client.Database("logs").Collection("logs")
-	_, err := collection.InsertOne(context.TODO(), data.LogEntry{
+	_, err := collection.InsertOne(ctx, data.LogEntry{
 		Name:      payload.Name,
 		Data:      payload.Data,
 		CreatedAt: time.Now(),
 	})
 	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
 		log.Println("error writing to mongo", err)
 		return err
 	}
@@ -34,3 +54,9 @@ func (r *RPCServer) LogInfo(payload RPCPayload, resp *string) error {
 	*resp = "Processed payload via RPC:" + payload.Name
 	return nil
 }
+
+// Ping lets RPC clients check that their connection is still alive
+func (r *RPCServer) Ping(_ struct{}, resp *string) error {
+	*resp = "pong"
+	return nil
+}
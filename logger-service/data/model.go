@@ -33,10 +33,12 @@ type LogEntry struct {
 	UpdatedAt time.Time `bson:"updated_at" json:"updated_at"`
 }
 
-func (l *LogEntry) Insert(entry LogEntry) error {
+// Insert writes entry to the logs collection. ctx carries the caller's trace, so the
+// Mongo command shows up under the request that caused it.
+func (l *LogEntry) Insert(ctx context.Context, entry LogEntry) error {
 	collection := client.Database("logs").Collection("logs")
 
-	_, err := collection.InsertOne(context.TODO(), LogEntry{
+	_, err := collection.InsertOne(ctx, LogEntry{
 		Name:      entry.Name,
 		Data:      entry.Data,
 		CreatedAt: time.Now(),
@@ -50,6 +52,32 @@ func (l *LogEntry) Insert(entry LogEntry) error {
 	return nil
 }
 
+// Recent returns the latest entries, newest first, at most limit of them. A name keeps
+// only the entries logged under it.
+func (l *LogEntry) Recent(ctx context.Context, name string, limit int64) ([]*LogEntry, error) {
+	collection := client.Database("logs").Collection("logs")
+
+	filter := bson.M{}
+	if name != "" {
+		filter["name"] = name
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}).SetLimit(limit)
+
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	logs := []*LogEntry{}
+	err = cursor.All(ctx, &logs)
+	if err != nil {
+		return nil, err
+	}
+
+	return logs, nil
+}
+
 func (l *LogEntry) All() ([]*LogEntry, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
 	defer cancel()
@@ -0,0 +1,121 @@
+// Package cloudevent is the envelope around every event published to logs_topic. The
+// broker publishes it and the broker and the listener consume it, so it lives here
+// rather than in either service.
+package cloudevent
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"time"
+)
+
+// The envelope follows the CloudEvents 1.0 JSON format (structured mode), so that any
+// CloudEvents tooling can read what goes over logs_topic.
+const (
+	// SpecVersion is the CloudEvents version the envelope implements
+	SpecVersion = "1.0"
+	// SchemaVersion versions the data carried by each event type. Bump it when a
+	// payload changes in a way older consumers can't read.
+	SchemaVersion = "1"
+
+	// ContentType is the AMQP content type of a message carrying an Envelope
+	ContentType = "application/cloudevents+json"
+	// LegacyContentType marks messages published before the envelope existed
+	LegacyContentType = "text/plain"
+)
+
+// Event types published to logs_topic
+const (
+	// TypeLog carries a log entry, {"name": ..., "data": ...}, for the logger
+	TypeLog = "go-micro.log"
+	// TypeJob carries an action queued by the broker for its own job worker
+	TypeJob = "go-micro.broker.job"
+)
+
+// Envelope is the versioned wrapper around every event published to logs_topic.
+type Envelope struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Subject         string          `json:"subject,omitempty"`
+	Time            time.Time       `json:"time"`
+	DataContentType string          `json:"datacontenttype"`
+	SchemaVersion   string          `json:"schemaversion"`
+	Data            json.RawMessage `json:"data"`
+}
+
+// New wraps data, encoded as JSON, in an event of type typ from source
+func New(source, typ string, data any) (Envelope, error) {
+	id, err := newEventID()
+	if err != nil {
+		return Envelope{}, err
+	}
+
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return Envelope{}, fmt.Errorf("encoding %s event: %w", typ, err)
+	}
+
+	return Envelope{
+		SpecVersion:     SpecVersion,
+		ID:              id,
+		Source:          source,
+		Type:            typ,
+		Time:            time.Now().UTC(),
+		DataContentType: "application/json",
+		SchemaVersion:   SchemaVersion,
+		Data:            raw,
+	}, nil
+}
+
+// Parse reads the envelope out of a message body. Messages without the
+// CloudEvents content type come from publishers that predate the envelope; their body
+// is taken to be the data itself, so they keep working.
+func Parse(body []byte, contentType string) (Envelope, error) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType != ContentType {
+		return Envelope{
+			SpecVersion:     SpecVersion,
+			DataContentType: "application/json",
+			Data:            body,
+		}, nil
+	}
+
+	var e Envelope
+	err := json.Unmarshal(body, &e)
+	if err != nil {
+		return Envelope{}, fmt.Errorf("malformed event envelope: %w", err)
+	}
+
+	if e.SpecVersion != SpecVersion {
+		return Envelope{}, fmt.Errorf("unsupported specversion %q", e.SpecVersion)
+	}
+	if e.ID == "" || e.Source == "" || e.Type == "" {
+		return Envelope{}, errors.New("event envelope is missing id, source or type")
+	}
+
+	return e, nil
+}
+
+// Decode unmarshals the event's data into v
+func (e Envelope) Decode(v any) error {
+	return json.Unmarshal(e.Data, v)
+}
+
+// newEventID returns a random (version 4) UUID
+func newEventID() (string, error) {
+	var b [16]byte
+	_, err := rand.Read(b[:])
+	if err != nil {
+		return "", err
+	}
+
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
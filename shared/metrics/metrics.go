@@ -0,0 +1,189 @@
+// Package metrics exposes Prometheus metrics for a service.
+//
+// It covers the three things every service in this project does: serve HTTP requests,
+// run named actions, and call other services. Nothing in it is specific to one service:
+// each creates a Metrics, wraps its router with Middleware and mounts Handler on
+// /metrics.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Outcomes recorded for downstream calls
+const (
+	OutcomeSuccess = "success"
+	OutcomeError   = "error"
+)
+
+// Metrics holds the collectors for one service.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	httpRequests *prometheus.CounterVec
+	httpDuration *prometheus.HistogramVec
+	httpInFlight prometheus.Gauge
+
+	actions        *prometheus.CounterVec
+	actionErrors   *prometheus.CounterVec
+	actionDuration *prometheus.HistogramVec
+	actionInFlight *prometheus.GaugeVec
+
+	downstreamCalls    *prometheus.CounterVec
+	downstreamDuration *prometheus.HistogramVec
+	downstreamInFlight *prometheus.GaugeVec
+}
+
+// New creates the collectors, with every metric name prefixed by namespace, and
+// registers them together with the Go runtime and process collectors.
+func New(namespace string) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_requests_total",
+			Help:      "HTTP requests served, by method, route and status code.",
+		}, []string{"method", "route", "code"}),
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Time spent serving HTTP requests, by method and route.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "route"}),
+		httpInFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "http_requests_in_flight",
+			Help:      "HTTP requests currently being served.",
+		}),
+
+		actions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "actions_total",
+			Help:      "Actions run, by action and the HTTP status they finished with.",
+		}, []string{"action", "status"}),
+		actionErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "action_errors_total",
+			Help:      "Actions that finished with a status of 400 or above.",
+		}, []string{"action"}),
+		actionDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "action_duration_seconds",
+			Help:      "Time spent running actions.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"action"}),
+		actionInFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "actions_in_flight",
+			Help:      "Actions currently running.",
+		}, []string{"action"}),
+
+		downstreamCalls: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "downstream_calls_total",
+			Help:      "Calls made to other services, by service, transport and outcome.",
+		}, []string{"service", "transport", "outcome"}),
+		downstreamDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "downstream_call_duration_seconds",
+			Help:      "Time spent waiting on other services.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"service", "transport"}),
+		downstreamInFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "downstream_calls_in_flight",
+			Help:      "Calls to other services currently waiting on a reply.",
+		}, []string{"service", "transport"}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.httpRequests, m.httpDuration, m.httpInFlight,
+		m.actions, m.actionErrors, m.actionDuration, m.actionInFlight,
+		m.downstreamCalls, m.downstreamDuration, m.downstreamInFlight,
+	)
+
+	return m
+}
+
+// Register adds extra collectors to the registry served by Handler
+func (m *Metrics) Register(cs ...prometheus.Collector) {
+	m.registry.MustRegister(cs...)
+}
+
+// Handler serves the metrics in the Prometheus text format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Middleware records every request served by a chi router. Requests are labelled by
+// route pattern rather than path, so /jobs/{id} is one series and not one per job.
+func (m *Metrics) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.httpInFlight.Inc()
+		defer m.httpInFlight.Dec()
+
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		m.httpRequests.WithLabelValues(r.Method, route, strconv.Itoa(status)).Inc()
+		m.httpDuration.WithLabelValues(r.Method, route).Observe(time.Since(start).Seconds())
+	})
+}
+
+// TrackAction marks action as running. Call the returned function with the status the
+// action finished with.
+func (m *Metrics) TrackAction(action string) func(status int) {
+	inFlight := m.actionInFlight.WithLabelValues(action)
+	inFlight.Inc()
+	start := time.Now()
+
+	return func(status int) {
+		inFlight.Dec()
+		m.actionDuration.WithLabelValues(action).Observe(time.Since(start).Seconds())
+		m.actions.WithLabelValues(action, strconv.Itoa(status)).Inc()
+		if status >= http.StatusBadRequest {
+			m.actionErrors.WithLabelValues(action).Inc()
+		}
+	}
+}
+
+// TrackDownstream marks a call to service over transport as in flight. Call the
+// returned function with the call's error, or nil if it succeeded.
+func (m *Metrics) TrackDownstream(service, transport string) func(err error) {
+	inFlight := m.downstreamInFlight.WithLabelValues(service, transport)
+	inFlight.Inc()
+	start := time.Now()
+
+	return func(err error) {
+		inFlight.Dec()
+		m.downstreamDuration.WithLabelValues(service, transport).Observe(time.Since(start).Seconds())
+
+		outcome := OutcomeSuccess
+		if err != nil {
+			outcome = OutcomeError
+		}
+		m.downstreamCalls.WithLabelValues(service, transport, outcome).Inc()
+	}
+}